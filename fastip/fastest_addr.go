@@ -1,6 +1,7 @@
 package fastip
 
 import (
+	"context"
 	"net"
 	"strings"
 	"sync"
@@ -50,7 +51,12 @@ func NewFastestAddr() *FastestAddr {
 // . Choose the fastest address between this and the one previously found in cache
 // . Return DNS packet containing the chosen IP address (remove all other IP addresses from the packet)
 func (f *FastestAddr) ExchangeFastest(req *dns.Msg, upstreams []upstream.Upstream) (*dns.Msg, upstream.Upstream, error) {
-	replies, err := upstream.ExchangeAll(upstreams, req)
+	return f.ExchangeFastestContext(context.Background(), req, upstreams)
+}
+
+// ExchangeFastestContext is ExchangeFastest that honors ctx cancellation and deadline
+func (f *FastestAddr) ExchangeFastestContext(ctx context.Context, req *dns.Msg, upstreams []upstream.Upstream) (*dns.Msg, upstream.Upstream, error) {
+	replies, err := upstream.ExchangeAllContext(ctx, upstreams, req)
 	if err != nil || len(replies) == 0 {
 		return nil, nil, err
 	}
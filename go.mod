@@ -1,24 +1,30 @@
 module github.com/AdguardTeam/dnsproxy
 
-go 1.13
+go 1.24
 
 require (
-	github.com/AdguardTeam/golibs v0.4.0
-	github.com/ameshkov/dnscrypt v1.1.0
-	github.com/ameshkov/dnsstamps v1.0.1
+	github.com/AdguardTeam/golibs v0.4.2
+	github.com/ameshkov/dnscrypt/v2 v2.2.3
+	github.com/ameshkov/dnsstamps v1.0.3
 	github.com/beefsack/go-rate v0.0.0-20180408011153-efa7637bb9b6
 	github.com/go-test/deep v1.0.5
 	github.com/jessevdk/go-flags v1.4.0
 	github.com/joomcode/errorx v1.0.1
-	github.com/kr/text v0.2.0 // indirect
-	github.com/miekg/dns v1.1.29
-	github.com/niemeyer/pretty v0.0.0-20200227124842-a10e7caefd8e // indirect
+	github.com/miekg/dns v1.1.40
 	github.com/patrickmn/go-cache v2.1.0+incompatible
-	github.com/stretchr/testify v1.5.1
-	golang.org/x/crypto v0.0.0-20200403201458-baeed622b8d8 // indirect
-	golang.org/x/net v0.0.0-20200324143707-d3edc9973b7e
-	golang.org/x/sync v0.0.0-20200317015054-43a5402ce75a // indirect
-	golang.org/x/sys v0.0.0-20200331124033-c3d80250170d
-	golang.org/x/text v0.3.2 // indirect
-	gopkg.in/check.v1 v1.0.0-20200227125254-8fa46927fb4f // indirect
+	github.com/quic-go/quic-go v0.59.1
+	github.com/stretchr/testify v1.11.1
+	golang.org/x/crypto v0.41.0
+	golang.org/x/net v0.43.0
+	golang.org/x/sys v0.35.0
+	gopkg.in/yaml.v3 v3.0.1
+)
+
+require (
+	github.com/aead/chacha20 v0.0.0-20180709150244-8b13a72661da // indirect
+	github.com/aead/poly1305 v0.0.0-20180717145839-3fee0db0b635 // indirect
+	github.com/davecgh/go-spew v1.1.1 // indirect
+	github.com/kr/text v0.2.0 // indirect
+	github.com/pmezard/go-difflib v1.0.0 // indirect
+	golang.org/x/text v0.28.0 // indirect
 )
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"time"
+
+	"github.com/AdguardTeam/golibs/log"
+	"github.com/ameshkov/dnscrypt/v2"
+	goFlags "github.com/jessevdk/go-flags"
+	"gopkg.in/yaml.v3"
+)
+
+// generateDNSCryptCommand is the name of the subcommand that generates DNSCrypt configuration
+const generateDNSCryptCommand = "generate-dnscrypt"
+
+// DNSCryptOptions represents console arguments of the generate-dnscrypt subcommand
+type DNSCryptOptions struct {
+	// DNSCrypt provider name
+	ProviderName string `short:"p" long:"provider-name" description:"DNSCrypt provider name, e.g. example.org" required:"true"`
+
+	// Path to the resulting configuration file
+	Out string `short:"o" long:"out" description:"Path to the resulting DNSCrypt configuration file" required:"true"`
+
+	// Server address that will be put to the DNS stamp
+	ServerAddr string `short:"a" long:"addr" description:"DNSCrypt server address (ip:port) to put into the DNS stamp" default:"127.0.0.1:443"`
+
+	// Certificate TTL in days
+	CertificateTTL int `short:"t" long:"ttl" description:"Certificate time-to-live, in days" default:"365"`
+}
+
+// generateDNSCrypt handles the generate-dnscrypt subcommand:
+// it generates the provider keys and the resolver short-term keypair,
+// creates the certificate, saves the configuration and prints the DNS stamp
+func generateDNSCrypt(args []string) {
+	var options DNSCryptOptions
+	parser := goFlags.NewParser(&options, goFlags.Default)
+	parser.Usage = generateDNSCryptCommand + " [OPTIONS]"
+
+	_, err := parser.ParseArgs(args)
+	if err != nil {
+		if flagsErr, ok := err.(*goFlags.Error); ok && flagsErr.Type == goFlags.ErrHelp {
+			os.Exit(0)
+		}
+		os.Exit(1)
+	}
+
+	rc, err := dnscrypt.GenerateResolverConfig(options.ProviderName, nil)
+	if err != nil {
+		log.Fatalf("cannot generate DNSCrypt configuration: %s", err)
+	}
+	rc.CertificateTTL = time.Duration(options.CertificateTTL) * 24 * time.Hour
+
+	// Make sure that the certificate can be created from this configuration
+	_, err = rc.CreateCert()
+	if err != nil {
+		log.Fatalf("cannot create DNSCrypt certificate: %s", err)
+	}
+
+	stamp, err := rc.CreateStamp(options.ServerAddr)
+	if err != nil {
+		log.Fatalf("cannot create DNS stamp: %s", err)
+	}
+
+	b, err := yaml.Marshal(rc)
+	if err != nil {
+		log.Fatalf("cannot serialize DNSCrypt configuration: %s", err)
+	}
+
+	err = ioutil.WriteFile(options.Out, b, 0600)
+	if err != nil {
+		log.Fatalf("cannot save DNSCrypt configuration to %s: %s", options.Out, err)
+	}
+
+	log.Printf("DNSCrypt configuration has been saved to %s", options.Out)
+	fmt.Println(stamp.String())
+}
+
+// loadDNSCryptConfig reads the DNSCrypt configuration file created by the generate-dnscrypt subcommand
+// and returns the provider name and the signed resolver certificate
+func loadDNSCryptConfig(path string) (string, *dnscrypt.Cert, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", nil, err
+	}
+
+	rc := dnscrypt.ResolverConfig{}
+	err = yaml.Unmarshal(b, &rc)
+	if err != nil {
+		return "", nil, err
+	}
+
+	if rc.ProviderName == "" {
+		return "", nil, fmt.Errorf("provider name is not set in %s", path)
+	}
+
+	cert, err := rc.CreateCert()
+	if err != nil {
+		return "", nil, err
+	}
+
+	return rc.ProviderName, cert, nil
+}
@@ -1,29 +1,96 @@
 package proxy
 
 import (
+	"context"
 	"fmt"
 	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/AdguardTeam/dnsproxy/upstream"
 	"github.com/AdguardTeam/golibs/log"
+	"github.com/joomcode/errorx"
 	"github.com/miekg/dns"
 )
 
-// isEmptyAAAAResponse checks AAAA answer to be empty
-// returns true if NAT64 prefix already calculated and there are no answers for AAAA question
-func (p *Proxy) isEmptyAAAAResponse(resp, req *dns.Msg) bool {
-	return p.isNAT64PrefixAvailable() && req.Question[0].Qtype == dns.TypeAAAA && (resp == nil || len(resp.Answer) == 0)
+const (
+	// nat64DiscoveryHost is the well-known name resolved to discover the NAT64 prefix (RFC 7050)
+	nat64DiscoveryHost = "ipv4only.arpa."
+
+	// defaultNAT64DiscoveryInterval is the default NAT64DiscoveryInterval
+	defaultNAT64DiscoveryInterval = 30 * time.Minute
+
+	// minNAT64DiscoveryInterval is the minimum time between the discoveries.
+	// It's used when the discovery fails or the ipv4only.arpa records have a lower TTL.
+	minNAT64DiscoveryInterval = time.Minute
+
+	// dns64MaxTTL is the maximum TTL of the synthesized records if the negative AAAA response has no SOA
+	// (RFC 6147, section 5.1.7)
+	dns64MaxTTL = 600
+
+	// nat64WellKnownPrefix is the Well-Known Prefix that must not be used for the non-global IPv4 addresses
+	// (RFC 6052, section 3.1)
+	nat64WellKnownPrefix = "64:ff9b::/96"
+
+	// defaultDNS64ExcludeAAAA is the range of the AAAA records ignored by DNS64 by default (RFC 6147, section 5.1.4)
+	defaultDNS64ExcludeAAAA = "::ffff:0:0/96"
+)
+
+// nat64WellKnownAddrs are the IPv4 addresses of ipv4only.arpa (RFC 7050)
+var nat64WellKnownAddrs = []net.IP{{192, 0, 0, 170}, {192, 0, 0, 171}}
+
+// nat64PrefixLengths are the NAT64 prefix lengths defined by RFC 6052
+var nat64PrefixLengths = []int{96, 64, 56, 48, 40, 32}
+
+// validateDNS64Config checks the NAT64 prefixes and the DNS64 exclusion lists
+func validateDNS64Config(c *Config) error {
+	for _, s := range c.DNS64Prefixes {
+		_, prefix, err := net.ParseCIDR(s)
+		if err != nil {
+			return errorx.Decorate(err, "invalid NAT64 prefix")
+		}
+		ones, bits := prefix.Mask.Size()
+		if prefix.IP.To4() != nil || bits != net.IPv6len*8 || !isNAT64PrefixLength(ones) {
+			return fmt.Errorf("invalid NAT64 prefix %s: the prefix length must be 32, 40, 48, 56, 64 or 96", s)
+		}
+	}
+
+	for _, s := range c.DNS64ExcludeIPv4 {
+		_, err := parseIPOrCIDR(s)
+		if err != nil {
+			return errorx.Decorate(err, "invalid DNS64 IPv4 exclusion")
+		}
+		if strings.Contains(s, ":") {
+			return fmt.Errorf("invalid DNS64 IPv4 exclusion %s: not an IPv4 address", s)
+		}
+	}
+
+	for _, s := range c.DNS64ExcludeAAAA {
+		_, err := parseIPOrCIDR(s)
+		if err != nil {
+			return errorx.Decorate(err, "invalid DNS64 AAAA exclusion")
+		}
+		if !strings.Contains(s, ":") {
+			return fmt.Errorf("invalid DNS64 AAAA exclusion %s: not an IPv6 address", s)
+		}
+	}
+	return nil
 }
 
-// isNAT64PrefixAvailable returns true if NAT64 prefix was calculated
-func (p *Proxy) isNAT64PrefixAvailable() bool {
-	p.nat64Lock.Lock()
-	prefixSize := len(p.nat64Prefix)
-	p.nat64Lock.Unlock()
-	return prefixSize == 12
+// isNAT64PrefixLength checks if the NAT64 prefix length is one of the lengths defined by RFC 6052
+func isNAT64PrefixLength(ones int) bool {
+	for _, l := range nat64PrefixLengths {
+		if l == ones {
+			return true
+		}
+	}
+	return false
 }
 
 // SetNAT64Prefix sets NAT64 prefix
+// prefix is the /96 prefix (12 bytes), it's set only if there's no prefix yet.
 func (p *Proxy) SetNAT64Prefix(prefix []byte) {
 	if len(prefix) != 12 {
 		return
@@ -31,100 +98,491 @@ func (p *Proxy) SetNAT64Prefix(prefix []byte) {
 
 	// Check if proxy is started and has no prefix yet
 	p.nat64Lock.Lock()
-	if len(p.nat64Prefix) == 0 {
+	if len(p.nat64Prefixes) == 0 {
 		if p.started {
-			p.nat64Prefix = prefix
-			log.Printf("NAT64 prefix: %v", prefix)
+			ip := make(net.IP, net.IPv6len)
+			copy(ip, prefix)
+			p.nat64Prefixes = []*net.IPNet{{IP: ip, Mask: net.CIDRMask(96, net.IPv6len*8)}}
+			log.Printf("NAT64 prefix: %s", p.nat64Prefixes[0])
 		}
 	}
 	p.nat64Lock.Unlock()
 }
 
-// createModifiedARequest returns modified question to make A DNS request
-func createModifiedARequest(d *dns.Msg) (*dns.Msg, error) {
-	if d.Question[0].Qtype != dns.TypeAAAA {
-		return nil, fmt.Errorf("question is not AAAA, do nothing")
+// setNAT64Prefixes replaces the NAT64 prefixes, DNS64 is disabled if there are none
+func (p *Proxy) setNAT64Prefixes(prefixes []*net.IPNet) {
+	p.nat64Lock.Lock()
+	defer p.nat64Lock.Unlock()
+
+	if equalIPNets(p.nat64Prefixes, prefixes) {
+		return
 	}
+	if len(prefixes) == 0 {
+		log.Printf("NAT64 prefix is not available anymore")
+	} else {
+		log.Printf("NAT64 prefixes: %v", prefixes)
+	}
+	p.nat64Prefixes = prefixes
+}
 
-	req := dns.Msg{}
-	req.Id = dns.Id()
-	req.RecursionDesired = true
-	req.Question = []dns.Question{
-		{Name: d.Question[0].Name, Qtype: dns.TypeA, Qclass: dns.ClassINET},
+// getNAT64Prefixes returns the current NAT64 prefixes
+func (p *Proxy) getNAT64Prefixes() []*net.IPNet {
+	p.nat64Lock.Lock()
+	defer p.nat64Lock.Unlock()
+	return p.nat64Prefixes
+}
+
+// equalIPNets checks if the lists contain the same networks in the same order
+func equalIPNets(a, b []*net.IPNet) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i].String() != b[i].String() {
+			return false
+		}
+	}
+	return true
+}
+
+// containsIPNet checks if the list contains the network
+func containsIPNet(nets []*net.IPNet, n *net.IPNet) bool {
+	for _, existing := range nets {
+		if existing.String() == n.String() {
+			return true
+		}
+	}
+	return false
+}
+
+// ipNetsContain checks if any of the networks contains the IP address
+func ipNetsContain(nets []*net.IPNet, ip net.IP) bool {
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
 	}
-	return &req, nil
+	return false
 }
 
-// createDNS64MappedResponse adds NAT 64 mapped answer to the old message
-// newAResp is new A response. oldAAAAResp is old *dns.Msg with AAAA request and empty answer
-func (p *Proxy) createDNS64MappedResponse(newAResp, oldAAAAResp *dns.Msg) (*dns.Msg, error) {
-	// do nothing if prefix is not valid
-	if !p.isNAT64PrefixAvailable() {
-		return nil, fmt.Errorf("can not create DNS64 mapped response: NAT64 prefix was not calculated")
+// exchangeDNS64 exchanges the request with the upstreams and performs DNS64 (RFC 6147) if there's a NAT64 prefix:
+// the AAAA records are synthesized from the A records and the PTR queries for the synthesized addresses
+// are answered using the corresponding in-addr.arpa names.
+func (p *Proxy) exchangeDNS64(ctx context.Context, d *DNSContext, upstreams []upstream.Upstream, selector UpstreamSelector) (*dns.Msg, upstream.Upstream, error) {
+	req := d.Req
+	prefixes := p.getNAT64Prefixes()
+
+	// The synthesized records can't be validated, so they aren't returned to the clients that validate DNSSEC
+	// themselves, i.e. set both DO and CD bits (RFC 6147, section 5.5)
+	if len(prefixes) == 0 || req.Question[0].Qclass != dns.ClassINET || (req.CheckingDisabled && isDNSSECOK(req)) {
+		return p.exchange(ctx, req, upstreams, selector)
+	}
+
+	switch req.Question[0].Qtype {
+	case dns.TypeAAAA:
+		return p.exchangeDNS64AAAA(ctx, req, prefixes, upstreams, selector)
+	case dns.TypePTR:
+		ip4 := nat64ReverseIPv4(req.Question[0].Name, prefixes)
+		if ip4 == nil {
+			break
+		}
+		ptrName, _ := dns.ReverseAddr(ip4.String())
+		if len(d.Upstreams) == 0 {
+			upstreams = p.getUpstreamsForDomain(ptrName)
+			selector = p.getSelectorForDomain(ptrName)
+		}
+		return p.exchangeDNS64PTR(ctx, req, ptrName, upstreams, selector)
+	}
+
+	return p.exchange(ctx, req, upstreams, selector)
+}
+
+// exchangeDNS64AAAA exchanges the AAAA request and synthesizes the AAAA records if there are none,
+// the AAAA records from DNS64ExcludeAAAA are treated as nonexistent (RFC 6147, section 5.1)
+func (p *Proxy) exchangeDNS64AAAA(ctx context.Context, req *dns.Msg, prefixes []*net.IPNet, upstreams []upstream.Upstream, selector UpstreamSelector) (*dns.Msg, upstream.Upstream, error) {
+	resp, u, err := p.exchange(ctx, req, upstreams, selector)
+	if err == nil {
+		// The name doesn't exist, there's nothing to synthesize (RFC 6147, section 5.1.2)
+		if resp.Rcode == dns.RcodeNameError {
+			return resp, u, err
+		}
+
+		resp = p.removeExcludedAAAA(resp)
+		if resp.Rcode == dns.RcodeSuccess && hasAnswer(resp, dns.TypeAAAA) {
+			return resp, u, err
+		}
+	}
+
+	// The other errors are treated as an empty response (RFC 6147, section 5.1.3)
+	aReq := createModifiedARequest(req)
+	aResp, aU, aErr := p.exchange(ctx, aReq, upstreams, selector)
+	if aErr != nil || aResp.Rcode != dns.RcodeSuccess {
+		log.Tracef("Failed to exchange DNS64 request: %v", aErr)
+		return resp, u, err
 	}
 
-	// check if there are no answers
-	if len(newAResp.Answer) == 0 {
-		return nil, fmt.Errorf("no ipv4 answer")
+	synthesized := p.synthesizeAAAA(req, resp, aResp, prefixes)
+	if synthesized == nil {
+		return resp, u, err
 	}
+	return synthesized, aU, nil
+}
 
-	oldAAAAResp.Answer = []dns.RR{}
-	// add NAT 64 prefix for each ipv4 answer
-	for _, ans := range newAResp.Answer {
-		i, ok := ans.(*dns.A)
-		if !ok {
+// removeExcludedAAAA removes the AAAA records that are in DNS64ExcludeAAAA from the response
+func (p *Proxy) removeExcludedAAAA(resp *dns.Msg) *dns.Msg {
+	var answer []dns.RR
+	for _, rr := range resp.Answer {
+		if aaaa, ok := rr.(*dns.AAAA); ok && ipNetsContain(p.dns64ExcludeAAAA, aaaa.AAAA) {
 			continue
 		}
+		answer = append(answer, rr)
+	}
+	if len(answer) == len(resp.Answer) {
+		return resp
+	}
+
+	resp = resp.Copy()
+	resp.Answer = answer
+	return resp
+}
+
+// hasAnswer checks if the response has the answer records of the specified type
+func hasAnswer(resp *dns.Msg, rrType uint16) bool {
+	for _, rr := range resp.Answer {
+		if rr.Header().Rrtype == rrType {
+			return true
+		}
+	}
+	return false
+}
 
-		// new ip address
-		mappedAddress := make(net.IP, net.IPv6len)
+// isDNSSECOK checks if the request has the DO bit set
+func isDNSSECOK(req *dns.Msg) bool {
+	opt := req.IsEdns0()
+	return opt != nil && opt.Do()
+}
+
+// createModifiedARequest returns the A request for the same name with the same flags and EDNS options
+func createModifiedARequest(d *dns.Msg) *dns.Msg {
+	req := d.Copy()
+	req.Id = dns.Id()
+	req.Question[0].Qtype = dns.TypeA
+	return req
+}
+
+// synthesizeAAAA creates the response to the AAAA request using the A response (RFC 6147, section 5.1.7)
+// The CNAME records are kept, the A records are mapped using each NAT64 prefix except for the ones in DNS64ExcludeIPv4.
+// aaaaResp is the AAAA response without AAAA records (nil if the upstreams have failed).
+// Returns nil if there are no addresses to map.
+func (p *Proxy) synthesizeAAAA(req, aaaaResp, aResp *dns.Msg, prefixes []*net.IPNet) *dns.Msg {
+	maxTTL := uint32(dns64MaxTTL)
+	if soa := findSOA(aaaaResp); soa != nil {
+		maxTTL = min(soa.Hdr.Ttl, soa.Minttl)
+	}
+
+	resp := &dns.Msg{}
+	resp.SetReply(req)
+	resp.RecursionAvailable = aResp.RecursionAvailable
+	mapped := false
+	for _, rr := range aResp.Answer {
+		switch v := rr.(type) {
+		case *dns.CNAME:
+			resp.Answer = append(resp.Answer, dns.Copy(v))
+		case *dns.A:
+			if ipNetsContain(p.dns64ExcludeIPv4, v.A) {
+				continue
+			}
+			for _, prefix := range prefixes {
+				if prefix.String() == nat64WellKnownPrefix && !isPublicIP(v.A) {
+					continue
+				}
+				resp.Answer = append(resp.Answer, &dns.AAAA{
+					Hdr:  dns.RR_Header{Name: v.Hdr.Name, Rrtype: dns.TypeAAAA, Class: dns.ClassINET, Ttl: min(v.Hdr.Ttl, maxTTL)},
+					AAAA: embedIPv4(prefix, v.A),
+				})
+				mapped = true
+			}
+		}
+	}
+	if !mapped {
+		return nil
+	}
 
-		// add NAT 64 prefix and append ipv4 record
-		copy(mappedAddress, p.nat64Prefix)
-		for index, b := range i.A {
-			mappedAddress[12+index] = b
+	// The OPT record is kept, the DNSSEC records of the A response don't cover the synthesized records
+	for _, rr := range aResp.Extra {
+		if opt, ok := rr.(*dns.OPT); ok {
+			resp.Extra = append(resp.Extra, dns.Copy(opt))
 		}
+	}
+	return resp
+}
 
-		// create new response and fill it
-		rr := new(dns.AAAA)
-		rr.Hdr = dns.RR_Header{Name: newAResp.Question[0].Name, Rrtype: dns.TypeAAAA, Ttl: ans.Header().Ttl, Class: dns.ClassINET}
-		rr.AAAA = mappedAddress
-		oldAAAAResp.Answer = append(oldAAAAResp.Answer, rr)
+// findSOA returns the SOA record from the authority section of the response (if any)
+func findSOA(resp *dns.Msg) *dns.SOA {
+	if resp == nil {
+		return nil
 	}
-	return oldAAAAResp, nil
+	for _, rr := range resp.Ns {
+		if soa, ok := rr.(*dns.SOA); ok {
+			return soa
+		}
+	}
+	return nil
 }
 
-// checkDNS64 is called when there is no answer for AAAA request and NAT64 prefix available.
-// this function creates modified A request from oldAAAAReq, exchanges it and returns DNS64 mapped response
-// oldAAAAReq is message with AAAA Question. oldAAAAResp is response for oldAAAAReq with empty answer section
-func (p *Proxy) checkDNS64(oldAAAAReq, oldAAAAResp *dns.Msg, upstreams []upstream.Upstream) (*dns.Msg, upstream.Upstream, error) {
-	// Let's create A request to the same hostname
-	modifiedAReq, err := createModifiedARequest(oldAAAAReq)
+// exchangeDNS64PTR answers the ip6.arpa PTR request for the synthesized address with the CNAME record
+// pointing to the in-addr.arpa name and the records resolved for that name (RFC 6147, section 5.3.1)
+func (p *Proxy) exchangeDNS64PTR(ctx context.Context, req *dns.Msg, ptrName string, upstreams []upstream.Upstream, selector UpstreamSelector) (*dns.Msg, upstream.Upstream, error) {
+	ptrReq := req.Copy()
+	ptrReq.Id = dns.Id()
+	ptrReq.Question[0].Name = ptrName
+
+	ptrResp, u, err := p.exchange(ctx, ptrReq, upstreams, selector)
 	if err != nil {
-		log.Tracef("Failed to create DNS64 mapped request %s", err)
-		return nil, nil, err
+		return nil, u, err
+	}
+
+	// The CNAME record expires along with the records it points to
+	ttl := uint32(dns64MaxTTL)
+	if soa := findSOA(ptrResp); soa != nil {
+		ttl = min(soa.Hdr.Ttl, soa.Minttl)
+	}
+	for i, rr := range ptrResp.Answer {
+		if i == 0 || rr.Header().Ttl < ttl {
+			ttl = rr.Header().Ttl
+		}
+	}
+
+	resp := ptrResp.Copy()
+	resp.Id = req.Id
+	resp.Question = []dns.Question{req.Question[0]}
+	resp.AuthenticatedData = false
+	cname := &dns.CNAME{
+		Hdr:    dns.RR_Header{Name: req.Question[0].Name, Rrtype: dns.TypeCNAME, Class: dns.ClassINET, Ttl: ttl},
+		Target: ptrName,
+	}
+	resp.Answer = append([]dns.RR{cname}, resp.Answer...)
+	return resp, u, nil
+}
+
+// nat64ReverseIPv4 returns the IPv4 address embedded into the IPv6 address of the ip6.arpa name
+// if the address is synthesized with one of the NAT64 prefixes, or nil otherwise
+func nat64ReverseIPv4(name string, prefixes []*net.IPNet) net.IP {
+	ip := reverseIPv6(name)
+	if ip == nil {
+		return nil
+	}
+
+	for _, prefix := range prefixes {
+		ones, _ := prefix.Mask.Size()
+		// The "u" octet must be zero (RFC 6052, section 2.2)
+		if prefix.Contains(ip) && (ones == 96 || ip[8] == 0) {
+			return extractIPv4(ip, ones)
+		}
+	}
+	return nil
+}
+
+// reverseIPv6 parses the full ip6.arpa name, returns nil if it's not a reverse name of an IPv6 address
+func reverseIPv6(name string) net.IP {
+	name = strings.TrimSuffix(strings.ToLower(dns.Fqdn(name)), ".ip6.arpa.")
+	labels := strings.Split(name, ".")
+	if len(labels) != net.IPv6len*2 {
+		return nil
+	}
+
+	ip := make(net.IP, net.IPv6len)
+	for i, label := range labels {
+		if len(label) != 1 {
+			return nil
+		}
+		nibble, err := strconv.ParseUint(label, 16, 8)
+		if err != nil {
+			return nil
+		}
+		// The labels are in the reverse order, the lower nibble comes first
+		pos := len(labels) - 1 - i
+		if pos%2 == 0 {
+			ip[pos/2] |= byte(nibble) << 4
+		} else {
+			ip[pos/2] |= byte(nibble)
+		}
+	}
+	return ip
+}
+
+// embedIPv4 maps the IPv4 address to IPv6 using the NAT64 prefix (RFC 6052, section 2.2)
+// Bits 64 to 71 of the address (the "u" octet) and the suffix are zero.
+func embedIPv4(prefix *net.IPNet, ip4 net.IP) net.IP {
+	ip := make(net.IP, net.IPv6len)
+	copy(ip, prefix.IP.To16())
+
+	ones, _ := prefix.Mask.Size()
+	ip4 = ip4.To4()
+	for i, j := ones/8, 0; j < net.IPv4len; i++ {
+		if i == 8 {
+			continue
+		}
+		ip[i] = ip4[j]
+		j++
+	}
+	return ip
+}
+
+// extractIPv4 extracts the IPv4 address embedded into the IPv6 address with the NAT64 prefix of the specified length.
+// Bits 64 to 71 of the address (the "u" octet) are skipped (RFC 6052, section 2.2).
+func extractIPv4(ip net.IP, prefixLen int) net.IP {
+	ip4 := make(net.IP, 0, net.IPv4len)
+	for i := prefixLen / 8; len(ip4) < net.IPv4len; i++ {
+		if i == 8 {
+			continue
+		}
+		ip4 = append(ip4, ip[i])
+	}
+	return ip4
+}
+
+// extractNAT64Prefixes finds the well-known IPv4 addresses in the AAAA records of ipv4only.arpa
+// and returns the NAT64 prefixes they're synthesized with (RFC 7050, section 3) along with the minimum TTL
+func extractNAT64Prefixes(resp *dns.Msg) ([]*net.IPNet, uint32) {
+	var prefixes []*net.IPNet
+	var ttl uint32
+	for _, rr := range resp.Answer {
+		aaaa, ok := rr.(*dns.AAAA)
+		if !ok || aaaa.AAAA.To4() != nil {
+			continue
+		}
+
+		for _, prefixLen := range nat64PrefixLengths {
+			ip4 := extractIPv4(aaaa.AAAA, prefixLen)
+			if !ip4.Equal(nat64WellKnownAddrs[0]) && !ip4.Equal(nat64WellKnownAddrs[1]) {
+				continue
+			}
+
+			mask := net.CIDRMask(prefixLen, net.IPv6len*8)
+			prefix := &net.IPNet{IP: aaaa.AAAA.Mask(mask), Mask: mask}
+			if !containsIPNet(prefixes, prefix) {
+				prefixes = append(prefixes, prefix)
+			}
+			if ttl == 0 || aaaa.Hdr.Ttl < ttl {
+				ttl = aaaa.Hdr.Ttl
+			}
+			break
+		}
 	}
+	return prefixes, ttl
+}
 
-	// Exchange new A request with selected upstreams
-	newAResp, u, err := p.exchange(modifiedAReq, upstreams)
+// discoverNAT64Prefixes resolves ipv4only.arpa through the upstreams and returns the NAT64 prefixes
+// along with the TTL of the records. No prefixes and no error are returned if there's no NAT64 in the network.
+func (p *Proxy) discoverNAT64Prefixes(ctx context.Context) ([]*net.IPNet, uint32, error) {
+	req := &dns.Msg{}
+	req.SetQuestion(nat64DiscoveryHost, dns.TypeAAAA)
+
+	upstreams := p.getUpstreamsForDomain(nat64DiscoveryHost)
+	selector := p.getSelectorForDomain(nat64DiscoveryHost)
+	resp, _, err := p.exchange(ctx, req, upstreams, selector)
 	if err != nil {
-		log.Tracef("Failed to exchange DNS64 request: %s", err)
-		return nil, nil, err
+		return nil, 0, err
+	}
+	if resp.Rcode != dns.RcodeSuccess {
+		return nil, 0, nil
 	}
 
-	// Check if oldAAAAResp is nil
-	if oldAAAAResp == nil {
-		oldAAAAResp = &dns.Msg{}
-		oldAAAAResp.Id = oldAAAAReq.Id
-		oldAAAAResp.RecursionDesired = oldAAAAReq.RecursionDesired
-		oldAAAAResp.Question = []dns.Question{oldAAAAReq.Question[0]}
+	prefixes, ttl := extractNAT64Prefixes(resp)
+	return prefixes, ttl, nil
+}
+
+// nat64Discovery discovers the NAT64 prefix in the background and updates it when the network changes
+type nat64Discovery struct {
+	proxy    *Proxy
+	interval time.Duration // maximum time between the discoveries
+
+	stop chan struct{} // closed to stop the discovery
+	wg   sync.WaitGroup
+}
+
+// newNAT64Discovery creates a new nat64Discovery for the proxy
+func newNAT64Discovery(p *Proxy) *nat64Discovery {
+	d := &nat64Discovery{
+		proxy:    p,
+		interval: p.NAT64DiscoveryInterval,
+		stop:     make(chan struct{}),
 	}
+	if d.interval <= 0 {
+		d.interval = defaultNAT64DiscoveryInterval
+	}
+	return d
+}
+
+// start discovers the NAT64 prefix right away and then repeats the discovery in the background
+func (d *nat64Discovery) start() {
+	log.Printf("Discovering the NAT64 prefix using %s", nat64DiscoveryHost)
+
+	d.wg.Add(1)
+	go func() {
+		defer d.wg.Done()
 
-	// new A response should be mapped with NAT64 prefix
-	mappedAAAAResponse, err := p.createDNS64MappedResponse(newAResp, oldAAAAResp)
+		for {
+			timer := time.NewTimer(d.discover())
+
+			select {
+			case <-timer.C:
+			case <-d.stop:
+				timer.Stop()
+				return
+			}
+		}
+	}()
+}
+
+// close stops the discovery, the discovery in progress is cancelled
+func (d *nat64Discovery) close() {
+	close(d.stop)
+}
+
+// wait waits until the discovery in progress is finished
+func (d *nat64Discovery) wait() {
+	d.wg.Wait()
+}
+
+// discover updates the NAT64 prefix and returns the time after which the discovery should be repeated.
+// The previous prefix is kept if the upstreams can't be queried.
+func (d *nat64Discovery) discover() time.Duration {
+	ctx, cancel := context.WithTimeout(context.Background(), defaultTimeout)
+	defer cancel()
+
+	// Stop the discovery in progress along with the proxy
+	go func() {
+		select {
+		case <-d.stop:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	prefixes, ttl, err := d.proxy.discoverNAT64Prefixes(ctx)
 	if err != nil {
-		log.Tracef("Failed to create DNS64 mapped request %s", err)
-		return nil, u, err
+		log.Debug("Failed to discover the NAT64 prefix: %s", err)
+		return d.limit(minNAT64DiscoveryInterval)
+	}
+
+	d.proxy.setNAT64Prefixes(prefixes)
+
+	if len(prefixes) == 0 {
+		return d.interval
+	}
+	next := time.Duration(ttl) * time.Second
+	if next < minNAT64DiscoveryInterval {
+		next = minNAT64DiscoveryInterval
+	}
+	return d.limit(next)
+}
+
+// limit returns the interval if the specified time is longer
+func (d *nat64Discovery) limit(next time.Duration) time.Duration {
+	if next > d.interval {
+		return d.interval
 	}
-	return mappedAAAAResponse, u, nil
+	return next
 }
@@ -1,11 +1,17 @@
 package proxy
 
 import (
+	"context"
+	"fmt"
 	"net"
+	"strings"
 	"sync"
 	"testing"
+	"time"
 
+	"github.com/AdguardTeam/dnsproxy/upstream"
 	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
 )
 
 const ipv4OnlyHost = "and.ru"
@@ -13,10 +19,17 @@ const ipv4OnlyHost = "and.ru"
 // Valid NAT-64 prefix for 2001:67c:27e4:15::64 server
 var prefix = []byte{32, 1, 6, 124, 39, 228, 16, 100, 0, 0, 0, 0} //nolint
 
+// prefixNet returns prefix as a network
+func prefixNet() *net.IPNet {
+	ip := make(net.IP, net.IPv6len)
+	copy(ip, prefix)
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(96, net.IPv6len*8)}
+}
+
 func TestProxyWithDNS64(t *testing.T) {
 	// Create test proxy and manually set NAT64 prefix
 	dnsProxy := createTestProxy(t, nil)
-	dnsProxy.nat64Prefix = prefix
+	dnsProxy.nat64Prefixes = []*net.IPNet{prefixNet()}
 
 	err := dnsProxy.Start()
 	if err != nil {
@@ -25,7 +38,7 @@ func TestProxyWithDNS64(t *testing.T) {
 
 	// Let's create test A request to ipv4OnlyHost and exchange it with test proxy
 	req := createHostTestMessage(ipv4OnlyHost)
-	resp, _, err := dnsProxy.exchange(req, dnsProxy.Upstreams)
+	resp, _, err := dnsProxy.exchange(context.Background(), req, dnsProxy.Upstreams, dnsProxy.selector)
 	if err != nil {
 		t.Fatalf("Can not exchange test message for %s cause: %s", ipv4OnlyHost, err)
 	}
@@ -37,7 +50,7 @@ func TestProxyWithDNS64(t *testing.T) {
 
 	// Let's manually add NAT64 prefix to IPv4 response
 	mappedIP := make(net.IP, net.IPv6len)
-	copy(mappedIP, dnsProxy.nat64Prefix)
+	copy(mappedIP, prefix)
 	for index, b := range a.A {
 		mappedIP[12+index] = b
 	}
@@ -73,7 +86,7 @@ func TestProxyWithDNS64(t *testing.T) {
 
 func TestDNS64Race(t *testing.T) {
 	dnsProxy := createTestProxy(t, nil)
-	dnsProxy.nat64Prefix = prefix
+	dnsProxy.nat64Prefixes = []*net.IPNet{prefixNet()}
 	dnsProxy.Upstreams = append(dnsProxy.Upstreams, dnsProxy.Upstreams[0])
 
 	// Start listening
@@ -151,3 +164,465 @@ func createTestDNSContext(host string) *DNSContext {
 	d.Req = createAAAATestMessage(host)
 	return &d
 }
+
+// nat64TestUpstream resolves ipv4only.arpa using the NAT64 prefix (if any) and the other names to 1.2.3.4 (A only)
+type nat64TestUpstream struct {
+	prefix net.IP // /96 NAT64 prefix, nil if there's no NAT64
+	lock   sync.Mutex
+}
+
+func (u *nat64TestUpstream) setPrefix(prefix net.IP) {
+	u.lock.Lock()
+	u.prefix = prefix
+	u.lock.Unlock()
+}
+
+func (u *nat64TestUpstream) Exchange(m *dns.Msg) (*dns.Msg, error) {
+	u.lock.Lock()
+	prefix := u.prefix
+	u.lock.Unlock()
+
+	resp := &dns.Msg{}
+	resp.SetReply(m)
+	q := m.Question[0]
+	hdr := dns.RR_Header{Name: q.Name, Rrtype: q.Qtype, Class: dns.ClassINET, Ttl: 60}
+	switch {
+	case q.Name == nat64DiscoveryHost && q.Qtype == dns.TypeAAAA && prefix != nil:
+		for _, wka := range nat64WellKnownAddrs {
+			ip := make(net.IP, net.IPv6len)
+			copy(ip, prefix)
+			copy(ip[12:], wka)
+			resp.Answer = append(resp.Answer, &dns.AAAA{Hdr: hdr, AAAA: ip})
+		}
+	case q.Qtype == dns.TypeA:
+		resp.Answer = append(resp.Answer, &dns.A{Hdr: hdr, A: net.IP{1, 2, 3, 4}})
+	}
+	return resp, nil
+}
+
+func (u *nat64TestUpstream) Address() string {
+	return "nat64-test"
+}
+
+// resolveAAAA resolves the AAAA records of the host with the proxy
+func resolveAAAA(t *testing.T, p *Proxy, host string) []dns.RR {
+	d := createTestDNSContext(host)
+	err := p.Resolve(d)
+	assert.Nil(t, err)
+	return d.Res.Answer
+}
+
+func TestEmbedIPv4(t *testing.T) {
+	// The examples from RFC 6052, section 2.4
+	addrs := map[int]string{
+		32: "2001:db8:c000:221::",
+		40: "2001:db8:1c0:2:21::",
+		48: "2001:db8:122:c000:2:2100::",
+		56: "2001:db8:122:3c0:0:221::",
+		64: "2001:db8:122:344:c0:2:2100:0",
+		96: "2001:db8:122:344::192.0.2.33",
+	}
+	ip4 := net.IP{192, 0, 2, 33}
+	for prefixLen, addr := range addrs {
+		_, prefix, err := net.ParseCIDR(fmt.Sprintf("2001:db8:122:344::/%d", prefixLen))
+		assert.Nil(t, err)
+		assert.True(t, net.ParseIP(addr).Equal(embedIPv4(prefix, ip4)), "/%d", prefixLen)
+		assert.Equal(t, ip4.String(), extractIPv4(net.ParseIP(addr), prefixLen).String(), "/%d", prefixLen)
+	}
+}
+
+func TestExtractNAT64Prefixes(t *testing.T) {
+	resp := &dns.Msg{}
+	resp.SetQuestion(nat64DiscoveryHost, dns.TypeAAAA)
+	for _, rr := range []string{
+		"ipv4only.arpa. 300 IN AAAA 64:ff9b::192.0.0.170",
+		"ipv4only.arpa. 60 IN AAAA 64:ff9b::192.0.0.171",
+		"ipv4only.arpa. 120 IN AAAA 2001:db8:1c0:0:aa::",
+		"ipv4only.arpa. 10 IN AAAA 2001:db8::1",
+	} {
+		a, err := dns.NewRR(rr)
+		assert.Nil(t, err)
+		resp.Answer = append(resp.Answer, a)
+	}
+
+	prefixes, ttl := extractNAT64Prefixes(resp)
+	assert.Equal(t, uint32(60), ttl)
+	assert.Len(t, prefixes, 2)
+	assert.Equal(t, "64:ff9b::/96", prefixes[0].String())
+	assert.Equal(t, "2001:db8:100::/40", prefixes[1].String())
+}
+
+func TestNAT64PrefixDiscovery(t *testing.T) {
+	u := &nat64TestUpstream{prefix: net.ParseIP("64:ff9b::")}
+	dnsProxy := createTestProxy(t, nil)
+	dnsProxy.Upstreams = []upstream.Upstream{u}
+	dnsProxy.DNS64 = true
+	dnsProxy.NAT64DiscoveryInterval = 20 * time.Millisecond
+
+	err := dnsProxy.Start()
+	if err != nil {
+		t.Fatalf("cannot start the DNS proxy: %s", err)
+	}
+	defer func() {
+		_ = dnsProxy.Stop()
+	}()
+
+	assert.Eventually(t, func() bool {
+		return len(dnsProxy.getNAT64Prefixes()) != 0
+	}, time.Second, 10*time.Millisecond)
+	answer := resolveAAAA(t, dnsProxy, "ipv4.example")
+	assert.Len(t, answer, 1)
+	assert.Equal(t, "64:ff9b::102:304", answer[0].(*dns.AAAA).AAAA.String())
+
+	// The prefix is updated when the network changes
+	u.setPrefix(net.ParseIP("2001:db8:64::"))
+	assert.Eventually(t, func() bool {
+		prefixes := dnsProxy.getNAT64Prefixes()
+		return len(prefixes) == 1 && prefixes[0].String() == "2001:db8:64::/96"
+	}, time.Second, 10*time.Millisecond)
+
+	// DNS64 is disabled when there's no NAT64 anymore
+	u.setPrefix(nil)
+	assert.Eventually(t, func() bool {
+		return len(dnsProxy.getNAT64Prefixes()) == 0
+	}, time.Second, 10*time.Millisecond)
+	assert.Empty(t, resolveAAAA(t, dnsProxy, "ipv4-2.example"))
+}
+
+func TestDNS64StaticPrefix(t *testing.T) {
+	dnsProxy := createTestProxy(t, nil)
+	dnsProxy.Upstreams = []upstream.Upstream{&nat64TestUpstream{}}
+	dnsProxy.DNS64Prefixes = []string{"64:ff9b::/80"}
+	assert.NotNil(t, dnsProxy.Start())
+	dnsProxy.DNS64Prefixes = []string{"192.0.2.0/24"}
+	assert.NotNil(t, dnsProxy.Start())
+
+	dnsProxy.DNS64Prefixes = []string{"64:ff9b::/96"}
+	err := dnsProxy.Start()
+	if err != nil {
+		t.Fatalf("cannot start the DNS proxy: %s", err)
+	}
+	defer func() {
+		_ = dnsProxy.Stop()
+	}()
+
+	answer := resolveAAAA(t, dnsProxy, "ipv4.example")
+	assert.Len(t, answer, 1)
+	assert.Equal(t, "64:ff9b::102:304", answer[0].(*dns.AAAA).AAAA.String())
+}
+
+// dns64TestUpstream answers from the zone, the CNAME records are followed once.
+// The responses to the requests with the DO bit have an RRSIG record in the answer.
+type dns64TestUpstream struct {
+	zone []dns.RR
+}
+
+// newDNS64TestUpstream creates a dns64TestUpstream with the records in the zone file format
+func newDNS64TestUpstream(t *testing.T, records ...string) *dns64TestUpstream {
+	u := &dns64TestUpstream{}
+	for _, r := range records {
+		rr, err := dns.NewRR(r)
+		assert.Nil(t, err)
+		u.zone = append(u.zone, rr)
+	}
+	return u
+}
+
+// lookup returns the records of the name with the specified type and whether the name exists
+func (u *dns64TestUpstream) lookup(name string, qtype uint16) ([]dns.RR, bool) {
+	var rrs []dns.RR
+	exists := false
+	for _, rr := range u.zone {
+		if rr.Header().Name != name {
+			continue
+		}
+		exists = true
+		if rr.Header().Rrtype == qtype {
+			rrs = append(rrs, rr)
+		} else if cname, ok := rr.(*dns.CNAME); ok {
+			rrs = append(rrs, cname)
+			target, _ := u.lookup(cname.Target, qtype)
+			rrs = append(rrs, target...)
+		}
+	}
+	return rrs, exists
+}
+
+func (u *dns64TestUpstream) Exchange(m *dns.Msg) (*dns.Msg, error) {
+	resp := &dns.Msg{}
+	resp.SetReply(m)
+	q := m.Question[0]
+
+	if opt := m.IsEdns0(); opt != nil {
+		resp.SetEdns0(opt.UDPSize(), opt.Do())
+	}
+
+	answer, exists := u.lookup(q.Name, q.Qtype)
+	resp.Answer = answer
+	if len(answer) == 0 {
+		if !exists {
+			resp.Rcode = dns.RcodeNameError
+		}
+		soa, _ := dns.NewRR("example. 300 IN SOA ns.example. hostmaster.example. 1 3600 600 86400 30")
+		resp.Ns = append(resp.Ns, soa)
+	} else if isDNSSECOK(m) {
+		resp.Answer = append(resp.Answer, &dns.RRSIG{
+			Hdr:         dns.RR_Header{Name: q.Name, Rrtype: dns.TypeRRSIG, Class: dns.ClassINET, Ttl: 300},
+			TypeCovered: q.Qtype,
+		})
+	}
+	return resp, nil
+}
+
+func (u *dns64TestUpstream) Address() string {
+	return "dns64-test"
+}
+
+// createDNS64TestProxy creates and starts the proxy with DNS64 enabled
+func createDNS64TestProxy(t *testing.T, u upstream.Upstream, prefixes []string, excludeIPv4, excludeAAAA []string) *Proxy {
+	dnsProxy := createTestProxy(t, nil)
+	dnsProxy.Upstreams = []upstream.Upstream{u}
+	dnsProxy.DNS64Prefixes = prefixes
+	dnsProxy.DNS64ExcludeIPv4 = excludeIPv4
+	dnsProxy.DNS64ExcludeAAAA = excludeAAAA
+
+	err := dnsProxy.Start()
+	if err != nil {
+		t.Fatalf("cannot start the DNS proxy: %s", err)
+	}
+	t.Cleanup(func() {
+		_ = dnsProxy.Stop()
+	})
+	return dnsProxy
+}
+
+// rrStrings returns the records in the zone file format
+func rrStrings(rrs []dns.RR) []string {
+	var res []string
+	for _, rr := range rrs {
+		res = append(res, rr.String())
+	}
+	return res
+}
+
+func TestDNS64Synthesis(t *testing.T) {
+	u := newDNS64TestUpstream(t,
+		"ipv4.example. 3600 IN A 1.2.3.4",
+		"ttl.example. 10 IN A 1.2.3.5",
+		"alias.example. 3600 IN CNAME ipv4.example.",
+		"dual.example. 3600 IN A 1.2.3.4",
+		"dual.example. 3600 IN AAAA 2001:db8::1",
+		"mapped.example. 3600 IN A 1.2.3.6",
+		"mapped.example. 3600 IN AAAA ::ffff:1.2.3.6",
+		"private.example. 3600 IN A 192.168.1.1",
+		"excluded.example. 3600 IN A 198.51.100.1",
+		"nodata.example. 3600 IN TXT \"no addresses\"",
+	)
+	dnsProxy := createDNS64TestProxy(t, u, []string{"64:ff9b::/96", "2001:db8:122:344::/64"}, []string{"198.51.100.0/24"}, nil)
+
+	testCases := []struct {
+		name   string
+		host   string
+		rcode  int
+		answer []string
+	}{{
+		// The TTL is limited by the SOA of the negative AAAA response
+		name:  "each_prefix",
+		host:  "ipv4.example.",
+		rcode: dns.RcodeSuccess,
+		answer: []string{
+			"ipv4.example.\t30\tIN\tAAAA\t64:ff9b::102:304",
+			"ipv4.example.\t30\tIN\tAAAA\t2001:db8:122:344:1:203:400:0",
+		},
+	}, {
+		name:  "a_ttl",
+		host:  "ttl.example.",
+		rcode: dns.RcodeSuccess,
+		answer: []string{
+			"ttl.example.\t10\tIN\tAAAA\t64:ff9b::102:305",
+			"ttl.example.\t10\tIN\tAAAA\t2001:db8:122:344:1:203:500:0",
+		},
+	}, {
+		// The AAAA response has no SOA, so the TTL is limited by 10 minutes
+		name:  "cname",
+		host:  "alias.example.",
+		rcode: dns.RcodeSuccess,
+		answer: []string{
+			"alias.example.\t3600\tIN\tCNAME\tipv4.example.",
+			"ipv4.example.\t600\tIN\tAAAA\t64:ff9b::102:304",
+			"ipv4.example.\t600\tIN\tAAAA\t2001:db8:122:344:1:203:400:0",
+		},
+	}, {
+		name:   "native_aaaa",
+		host:   "dual.example.",
+		rcode:  dns.RcodeSuccess,
+		answer: []string{"dual.example.\t3600\tIN\tAAAA\t2001:db8::1"},
+	}, {
+		name:  "excluded_aaaa",
+		host:  "mapped.example.",
+		rcode: dns.RcodeSuccess,
+		answer: []string{
+			"mapped.example.\t600\tIN\tAAAA\t64:ff9b::102:306",
+			"mapped.example.\t600\tIN\tAAAA\t2001:db8:122:344:1:203:600:0",
+		},
+	}, {
+		// The Well-Known Prefix isn't used for the private addresses
+		name:   "private_ipv4",
+		host:   "private.example.",
+		rcode:  dns.RcodeSuccess,
+		answer: []string{"private.example.\t30\tIN\tAAAA\t2001:db8:122:344:c0:a801:100:0"},
+	}, {
+		name:   "excluded_ipv4",
+		host:   "excluded.example.",
+		rcode:  dns.RcodeSuccess,
+		answer: nil,
+	}, {
+		name:   "nodata",
+		host:   "nodata.example.",
+		rcode:  dns.RcodeSuccess,
+		answer: nil,
+	}, {
+		name:   "nxdomain",
+		host:   "nonexistent.example.",
+		rcode:  dns.RcodeNameError,
+		answer: nil,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			req := &dns.Msg{}
+			req.SetQuestion(tc.host, dns.TypeAAAA)
+			d := &DNSContext{Req: req}
+			err := dnsProxy.Resolve(d)
+			assert.Nil(t, err)
+			assert.Equal(t, tc.rcode, d.Res.Rcode)
+			assert.Equal(t, tc.answer, rrStrings(d.Res.Answer))
+		})
+	}
+}
+
+func TestDNS64DNSSEC(t *testing.T) {
+	u := newDNS64TestUpstream(t, "ipv4.example. 3600 IN A 1.2.3.4")
+	dnsProxy := createDNS64TestProxy(t, u, []string{"64:ff9b::/96"}, nil, nil)
+
+	// The synthesized records aren't signed
+	req := &dns.Msg{}
+	req.SetQuestion("ipv4.example.", dns.TypeAAAA)
+	req.SetEdns0(4096, true)
+	d := &DNSContext{Req: req}
+	err := dnsProxy.Resolve(d)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"ipv4.example.\t30\tIN\tAAAA\t64:ff9b::102:304"}, rrStrings(d.Res.Answer))
+	assert.NotNil(t, d.Res.IsEdns0())
+
+	// Nothing is synthesized for the validating clients
+	req = req.Copy()
+	req.CheckingDisabled = true
+	d = &DNSContext{Req: req}
+	err = dnsProxy.Resolve(d)
+	assert.Nil(t, err)
+	assert.Empty(t, d.Res.Answer)
+
+	// CD bit alone doesn't disable DNS64
+	req = &dns.Msg{}
+	req.SetQuestion("ipv4.example.", dns.TypeAAAA)
+	req.CheckingDisabled = true
+	d = &DNSContext{Req: req}
+	err = dnsProxy.Resolve(d)
+	assert.Nil(t, err)
+	assert.Len(t, d.Res.Answer, 1)
+}
+
+func TestDNS64PTR(t *testing.T) {
+	reverse := func(ip string) string {
+		name, err := dns.ReverseAddr(ip)
+		assert.Nil(t, err)
+		return name
+	}
+
+	u := newDNS64TestUpstream(t,
+		"4.3.2.1.in-addr.arpa. 3600 IN PTR ipv4.example.",
+		reverse("2001:db8::1")+" 3600 IN PTR ipv6.example.",
+	)
+	dnsProxy := createDNS64TestProxy(t, u, []string{"64:ff9b::/96", "2001:db8:122:344::/64"}, nil, nil)
+
+	testCases := []struct {
+		name   string
+		ip     string
+		rcode  int
+		answer []string
+	}{{
+		name:  "prefix_96",
+		ip:    "64:ff9b::102:304",
+		rcode: dns.RcodeSuccess,
+		answer: []string{
+			reverse("64:ff9b::102:304") + "\t3600\tIN\tCNAME\t4.3.2.1.in-addr.arpa.",
+			"4.3.2.1.in-addr.arpa.\t3600\tIN\tPTR\tipv4.example.",
+		},
+	}, {
+		name:  "prefix_64",
+		ip:    "2001:db8:122:344:1:203:400:0",
+		rcode: dns.RcodeSuccess,
+		answer: []string{
+			reverse("2001:db8:122:344:1:203:400:0") + "\t3600\tIN\tCNAME\t4.3.2.1.in-addr.arpa.",
+			"4.3.2.1.in-addr.arpa.\t3600\tIN\tPTR\tipv4.example.",
+		},
+	}, {
+		name:   "unknown_ipv4",
+		ip:     "64:ff9b::102:305",
+		rcode:  dns.RcodeNameError,
+		answer: []string{reverse("64:ff9b::102:305") + "\t30\tIN\tCNAME\t5.3.2.1.in-addr.arpa."},
+	}, {
+		// The "u" octet isn't zero
+		name:   "invalid_u_octet",
+		ip:     "2001:db8:122:344:101:203:400:0",
+		rcode:  dns.RcodeNameError,
+		answer: nil,
+	}, {
+		name:   "not_synthesized",
+		ip:     "2001:db8::1",
+		rcode:  dns.RcodeSuccess,
+		answer: []string{reverse("2001:db8::1") + "\t3600\tIN\tPTR\tipv6.example."},
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			name := reverse(tc.ip)
+			req := &dns.Msg{}
+			req.SetQuestion(name, dns.TypePTR)
+			d := &DNSContext{Req: req}
+			err := dnsProxy.Resolve(d)
+			assert.Nil(t, err)
+			assert.Equal(t, tc.rcode, d.Res.Rcode)
+			assert.Equal(t, tc.answer, rrStrings(d.Res.Answer))
+			assert.Equal(t, name, d.Res.Question[0].Name)
+		})
+	}
+}
+
+func TestReverseIPv6(t *testing.T) {
+	name, err := dns.ReverseAddr("2001:db8::1")
+	assert.Nil(t, err)
+	assert.Equal(t, "2001:db8::1", reverseIPv6(name).String())
+	assert.Equal(t, "2001:db8::1", reverseIPv6(strings.ToUpper(name)).String())
+
+	assert.Nil(t, reverseIPv6("1.0.0.2.ip6.arpa."))
+	assert.Nil(t, reverseIPv6("33.2.0.192.in-addr.arpa."))
+	assert.Nil(t, reverseIPv6(strings.Replace(name, "1.", "x.", 1)))
+}
+
+func TestDNS64InvalidConfig(t *testing.T) {
+	for _, c := range []Config{
+		{DNS64Prefixes: []string{"64:ff9b::/80"}},
+		{DNS64Prefixes: []string{"invalid"}},
+		{DNS64ExcludeIPv4: []string{"2001:db8::/32"}},
+		{DNS64ExcludeAAAA: []string{"192.0.2.0/24"}},
+	} {
+		assert.NotNil(t, validateDNS64Config(&c))
+	}
+	assert.Nil(t, validateDNS64Config(&Config{
+		DNS64Prefixes:    []string{"64:ff9b::/96", "2001:db8::/32", "2001:db8:100::/40"},
+		DNS64ExcludeIPv4: []string{"10.0.0.0/8", "192.0.2.1"},
+		DNS64ExcludeAAAA: []string{"::ffff:0:0/96", "2001:db8::1", "::ffff:192.0.2.1"},
+	}))
+}
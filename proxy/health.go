@@ -0,0 +1,256 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/AdguardTeam/golibs/log"
+	"github.com/miekg/dns"
+)
+
+const (
+	defaultHealthCheckDomain    = "example.org."
+	defaultHealthCheckFailures  = 3
+	defaultHealthCheckSuccesses = 2
+)
+
+// UpstreamHealth is the health state of an upstream
+type UpstreamHealth struct {
+	Upstream             upstream.Upstream // checked upstream
+	Healthy              bool              // false if the upstream is marked down
+	ConsecutiveFailures  int               // number of consecutive failed probes
+	ConsecutiveSuccesses int               // number of consecutive successful probes
+	LastCheck            time.Time         // time of the last probe (zero if it hasn't been probed yet)
+	LastError            error             // error of the last probe (nil if it succeeded)
+}
+
+// healthChecker probes the upstreams in the background and works as a circuit breaker:
+// an upstream is marked down after the specified number of consecutive failed probes
+// and is brought back after the specified number of consecutive successful ones.
+type healthChecker struct {
+	upstreams []upstream.Upstream // upstreams to check
+	interval  time.Duration       // how often the upstreams are probed
+	domain    string              // domain name to query
+	failures  int                 // failed probes to mark the upstream down
+	successes int                 // successful probes to bring the upstream back
+
+	states map[upstream.Upstream]*UpstreamHealth // health states by the upstream instance
+	lock   sync.RWMutex                          // protects states
+
+	stop chan struct{} // closed to stop the checker
+	wg   sync.WaitGroup
+}
+
+// newHealthChecker creates a new healthChecker for the configured upstreams (including Fallbacks)
+func newHealthChecker(c *Config) *healthChecker {
+	h := &healthChecker{
+		interval:  c.HealthCheckInterval,
+		domain:    dns.Fqdn(c.HealthCheckDomain),
+		failures:  c.HealthCheckFailures,
+		successes: c.HealthCheckSuccesses,
+		states:    map[upstream.Upstream]*UpstreamHealth{},
+		stop:      make(chan struct{}),
+	}
+	if c.HealthCheckDomain == "" {
+		h.domain = defaultHealthCheckDomain
+	}
+	if h.failures <= 0 {
+		h.failures = defaultHealthCheckFailures
+	}
+	if h.successes <= 0 {
+		h.successes = defaultHealthCheckSuccesses
+	}
+
+	// The upstreams with the same address may differ in their options (e.g. sni or ip),
+	// so they're checked separately
+	add := func(upstreams []upstream.Upstream) {
+		for _, u := range upstreams {
+			if _, ok := h.states[u]; ok || isLocalUpstream(u) {
+				continue
+			}
+			h.states[u] = &UpstreamHealth{Upstream: u, Healthy: true}
+			h.upstreams = append(h.upstreams, u)
+		}
+	}
+	add(c.Upstreams)
+	for _, upstreams := range c.DomainsReservedUpstreams {
+		add(upstreams)
+	}
+	add(c.Fallbacks)
+
+	return h
+}
+
+// start starts probing the upstreams in the background
+func (h *healthChecker) start() {
+	log.Printf("Checking the health of %d upstreams every %s", len(h.upstreams), h.interval)
+
+	h.wg.Add(1)
+	go func() {
+		defer h.wg.Done()
+
+		ticker := time.NewTicker(h.interval)
+		defer ticker.Stop()
+
+		for {
+			h.checkAll()
+
+			select {
+			case <-ticker.C:
+			case <-h.stop:
+				return
+			}
+		}
+	}()
+}
+
+// close stops the checker and waits until the probes in progress are finished
+func (h *healthChecker) close() {
+	close(h.stop)
+	h.wg.Wait()
+}
+
+// checkAll probes all the upstreams in parallel
+func (h *healthChecker) checkAll() {
+	// The probe should not last longer than the interval
+	timeout := h.interval
+	if timeout > defaultTimeout {
+		timeout = defaultTimeout
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	// Stop the probes in progress along with the checker
+	go func() {
+		select {
+		case <-h.stop:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	var wg sync.WaitGroup
+	for _, u := range h.upstreams {
+		wg.Add(1)
+		go func(u upstream.Upstream) {
+			defer wg.Done()
+			h.report(u, h.probe(ctx, u))
+		}(u)
+	}
+	wg.Wait()
+}
+
+// probe sends the test query to the upstream
+func (h *healthChecker) probe(ctx context.Context, u upstream.Upstream) error {
+	req := &dns.Msg{}
+	req.SetQuestion(h.domain, dns.TypeA)
+	req.RecursionDesired = true
+
+	reply, err := upstream.ExchangeContext(ctx, u, req)
+	if err != nil {
+		return err
+	}
+	if reply.Rcode == dns.RcodeServerFailure || reply.Rcode == dns.RcodeRefused {
+		return fmt.Errorf("upstream responded with %s", dns.RcodeToString[reply.Rcode])
+	}
+	return nil
+}
+
+// report updates the upstream's health state with the probe result
+func (h *healthChecker) report(u upstream.Upstream, err error) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	s := h.states[u]
+	s.LastCheck = time.Now()
+	s.LastError = err
+
+	if err != nil {
+		s.ConsecutiveFailures++
+		s.ConsecutiveSuccesses = 0
+		if s.Healthy && s.ConsecutiveFailures >= h.failures {
+			log.Printf("Upstream %s is down: %s", u.Address(), err)
+			s.Healthy = false
+		}
+		return
+	}
+
+	s.ConsecutiveSuccesses++
+	s.ConsecutiveFailures = 0
+	if !s.Healthy && s.ConsecutiveSuccesses >= h.successes {
+		log.Printf("Upstream %s is up again", u.Address())
+		s.Healthy = true
+	}
+}
+
+// isHealthy returns false if the upstream is marked down
+// The upstreams that aren't checked are considered healthy
+func (h *healthChecker) isHealthy(u upstream.Upstream) bool {
+	h.lock.RLock()
+	defer h.lock.RUnlock()
+
+	s, ok := h.states[u]
+	return !ok || s.Healthy
+}
+
+// health returns a copy of the health states of all the checked upstreams
+func (h *healthChecker) health() []UpstreamHealth {
+	h.lock.RLock()
+	defer h.lock.RUnlock()
+
+	res := make([]UpstreamHealth, 0, len(h.upstreams))
+	for _, u := range h.upstreams {
+		res = append(res, *h.states[u])
+	}
+	return res
+}
+
+// UpstreamsHealth returns the health state of all the configured upstreams including Fallbacks.
+// Returns nil if the health checking is disabled (HealthCheckInterval is 0) or the proxy is not started.
+func (p *Proxy) UpstreamsHealth() []UpstreamHealth {
+	p.RLock()
+	h := p.healthChecker
+	p.RUnlock()
+
+	if h == nil {
+		return nil
+	}
+	return h.health()
+}
+
+// IsUpstreamHealthy returns false if the upstream is marked down by the health checker.
+// All the upstreams are considered healthy if the health checking is disabled.
+func (p *Proxy) IsUpstreamHealthy(u upstream.Upstream) bool {
+	p.RLock()
+	h := p.healthChecker
+	p.RUnlock()
+
+	return h == nil || h.isHealthy(u)
+}
+
+// healthyUpstreams returns the upstreams that aren't marked down.
+// If all of them are down, the whole list is returned since there's nothing better to try.
+func (p *Proxy) healthyUpstreams(upstreams []upstream.Upstream) []upstream.Upstream {
+	p.RLock()
+	h := p.healthChecker
+	p.RUnlock()
+
+	if h == nil {
+		return upstreams
+	}
+
+	var healthy []upstream.Upstream
+	for _, u := range upstreams {
+		if h.isHealthy(u) {
+			healthy = append(healthy, u)
+		}
+	}
+	if len(healthy) == 0 {
+		return upstreams
+	}
+	return healthy
+}
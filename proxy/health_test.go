@@ -0,0 +1,149 @@
+package proxy
+
+import (
+	"errors"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+// healthTestUpstream is an upstream that fails while it's down
+type healthTestUpstream struct {
+	addr    string
+	down    int32 // 1 if the upstream is down
+	queries int32 // number of the queries except for the health probes
+}
+
+func (u *healthTestUpstream) Exchange(m *dns.Msg) (*dns.Msg, error) {
+	if m.Question[0].Name != defaultHealthCheckDomain {
+		atomic.AddInt32(&u.queries, 1)
+	}
+	if atomic.LoadInt32(&u.down) == 1 {
+		return nil, errors.New("upstream is down")
+	}
+
+	resp := &dns.Msg{}
+	resp.SetReply(m)
+	resp.Answer = append(resp.Answer, &dns.A{
+		Hdr: dns.RR_Header{Name: m.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60},
+		A:   net.IP{1, 2, 3, 4},
+	})
+	return resp, nil
+}
+
+func (u *healthTestUpstream) Address() string {
+	return u.addr
+}
+
+func TestHealthCheckSameAddress(t *testing.T) {
+	// The same address with different options
+	u1 := &healthTestUpstream{addr: "same", down: 1}
+	u2 := &healthTestUpstream{addr: "same"}
+
+	dnsProxy := createTestProxy(t, nil)
+	dnsProxy.Upstreams = []upstream.Upstream{u1, u2}
+	dnsProxy.HealthCheckInterval = 20 * time.Millisecond
+	dnsProxy.HealthCheckFailures = 1
+
+	err := dnsProxy.Start()
+	if err != nil {
+		t.Fatalf("cannot start the DNS proxy: %s", err)
+	}
+	defer func() {
+		_ = dnsProxy.Stop()
+	}()
+
+	waitForHealth(t, dnsProxy, u1, false)
+	assert.True(t, dnsProxy.IsUpstreamHealthy(u2))
+	assert.Equal(t, 2, len(dnsProxy.UpstreamsHealth()))
+}
+
+func TestHealthCheck(t *testing.T) {
+	u1 := &healthTestUpstream{addr: "u1", down: 1}
+	u2 := &healthTestUpstream{addr: "u2"}
+	fallback := &healthTestUpstream{addr: "fallback"}
+
+	dnsProxy := createTestProxy(t, nil)
+	dnsProxy.Upstreams = []upstream.Upstream{u1, u2}
+	dnsProxy.Fallbacks = []upstream.Upstream{fallback}
+	dnsProxy.HealthCheckInterval = 20 * time.Millisecond
+	dnsProxy.HealthCheckFailures = 2
+	dnsProxy.HealthCheckSuccesses = 2
+
+	// All the upstreams are healthy before the proxy is started
+	assert.Nil(t, dnsProxy.UpstreamsHealth())
+	assert.True(t, dnsProxy.IsUpstreamHealthy(u1))
+
+	err := dnsProxy.Start()
+	if err != nil {
+		t.Fatalf("cannot start the DNS proxy: %s", err)
+	}
+	defer func() {
+		_ = dnsProxy.Stop()
+	}()
+
+	waitForHealth(t, dnsProxy, u1, false)
+	assert.True(t, dnsProxy.IsUpstreamHealthy(u2))
+
+	health := dnsProxy.UpstreamsHealth()
+	assert.Equal(t, 3, len(health))
+	assert.Equal(t, u1, health[0].Upstream)
+	assert.False(t, health[0].Healthy)
+	assert.NotNil(t, health[0].LastError)
+	assert.True(t, health[0].ConsecutiveFailures >= 2)
+	assert.Equal(t, fallback, health[2].Upstream)
+	assert.True(t, health[2].Healthy)
+
+	// The upstream that is down is not queried at all
+	for i := 0; i < 10; i++ {
+		d := &DNSContext{Req: createHostTestMessage("test.org")}
+		err = dnsProxy.Resolve(d)
+		assert.Nil(t, err)
+		assert.Equal(t, u2, d.Upstream)
+	}
+	assert.Equal(t, int32(0), atomic.LoadInt32(&u1.queries))
+
+	// The upstream is brought back after the successful probes
+	atomic.StoreInt32(&u1.down, 0)
+	waitForHealth(t, dnsProxy, u1, true)
+}
+
+func TestHealthCheckAllDown(t *testing.T) {
+	u1 := &healthTestUpstream{addr: "u1", down: 1}
+	u2 := &healthTestUpstream{addr: "u2", down: 1}
+
+	dnsProxy := createTestProxy(t, nil)
+	dnsProxy.Upstreams = []upstream.Upstream{u1, u2}
+	dnsProxy.HealthCheckInterval = 20 * time.Millisecond
+	dnsProxy.HealthCheckFailures = 1
+
+	err := dnsProxy.Start()
+	if err != nil {
+		t.Fatalf("cannot start the DNS proxy: %s", err)
+	}
+	defer func() {
+		_ = dnsProxy.Stop()
+	}()
+
+	waitForHealth(t, dnsProxy, u1, false)
+	waitForHealth(t, dnsProxy, u2, false)
+
+	// There's nothing better to try so all the upstreams are used
+	assert.Equal(t, []upstream.Upstream{u1, u2}, dnsProxy.healthyUpstreams(dnsProxy.Upstreams))
+}
+
+// waitForHealth waits until the upstream's health state is the specified one
+func waitForHealth(t *testing.T, p *Proxy, u upstream.Upstream, healthy bool) {
+	for i := 0; i < 100; i++ {
+		if p.IsUpstreamHealthy(u) == healthy {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("upstream %s health is not %v", u.Address(), healthy)
+}
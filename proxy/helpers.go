@@ -3,10 +3,15 @@ package proxy
 import (
 	"encoding/binary"
 	"errors"
+	"fmt"
+	"io"
+	"math"
 	"net"
 	"strings"
+	"time"
 
 	"github.com/AdguardTeam/golibs/log"
+	"github.com/joomcode/errorx"
 	"github.com/miekg/dns"
 )
 
@@ -97,29 +102,51 @@ func getIPString(addr net.Addr) string {
 	return ""
 }
 
-// readPrefixed reads DNS message prefixed with its length (2 bytes)
-func readPrefixed(conn *net.Conn) ([]byte, error) {
-	buf := make([]byte, 2+dns.MaxMsgSize)
-	packetLength, pos := -1, 0
-	for {
-		readnb, err := (*conn).Read(buf[pos:])
+// closeListeners closes the listeners and appends the errors (if any) to errs
+func closeListeners(errs []error, listeners []net.Listener, name string) []error {
+	for _, l := range listeners {
+		err := l.Close()
 		if err != nil {
-			return buf, err
-		}
-		pos += readnb
-		if pos >= 2 && packetLength < 0 {
-			packetLength = int(binary.BigEndian.Uint16(buf[0:2]))
-			if packetLength >= dns.MaxMsgSize {
-				return buf, errors.New("packet too large")
-			}
-			if packetLength < minDNSPacketSize {
-				return buf, errors.New("packet too short")
-			}
-		}
-		if packetLength >= 0 && pos >= 2+packetLength {
-			return buf[2 : 2+packetLength], nil
+			errs = append(errs, errorx.Decorate(err, "couldn't close %s", name))
 		}
 	}
+	return errs
+}
+
+// listenersAddrs returns the addresses of the listeners
+func listenersAddrs(listeners []net.Listener) []net.Addr {
+	var addrs []net.Addr
+	for _, l := range listeners {
+		addrs = append(addrs, l.Addr())
+	}
+	return addrs
+}
+
+// readPrefixed reads DNS message prefixed with its length (2 bytes)
+// Once the length is read, the rest of the message must be read within readTimeout (if it's not zero)
+func readPrefixed(conn *net.Conn, readTimeout time.Duration) ([]byte, error) {
+	// Read exactly one message, the rest may be the next pipelined queries
+	l := make([]byte, 2)
+	_, err := io.ReadFull(*conn, l)
+	if err != nil {
+		return nil, err
+	}
+
+	packetLength := int(binary.BigEndian.Uint16(l))
+	if packetLength < minDNSPacketSize {
+		return nil, errors.New("packet too short")
+	}
+
+	if readTimeout > 0 {
+		(*conn).SetReadDeadline(time.Now().Add(readTimeout)) //nolint
+	}
+
+	buf := make([]byte, packetLength)
+	_, err = io.ReadFull(*conn, buf)
+	if err != nil {
+		return nil, err
+	}
+	return buf, nil
 }
 
 // prefixWithSize adds 2-byte prefix with the packet length
@@ -134,6 +161,48 @@ func prefixWithSize(packet []byte) ([]byte, error) {
 	return packet, nil
 }
 
+// removeTCPKeepalive removes the edns-tcp-keepalive option (RFC 7828) from the message
+// Returns true if the option was there
+func removeTCPKeepalive(m *dns.Msg) bool {
+	opt := m.IsEdns0()
+	if opt == nil {
+		return false
+	}
+
+	found := false
+	options := opt.Option[:0]
+	for _, o := range opt.Option {
+		if o.Option() == dns.EDNS0TCPKEEPALIVE {
+			found = true
+			continue
+		}
+		options = append(options, o)
+	}
+	opt.Option = options
+	return found
+}
+
+// setTCPKeepalive adds the edns-tcp-keepalive option (RFC 7828) with the specified idle timeout to the response
+// udpSize is used if the response does not have an OPT record yet
+func setTCPKeepalive(m *dns.Msg, timeout time.Duration, udpSize uint16) {
+	// The timeout is specified in units of 100 milliseconds
+	units := timeout / (100 * time.Millisecond)
+	if units > math.MaxUint16 {
+		units = math.MaxUint16
+	}
+
+	opt := m.IsEdns0()
+	if opt == nil {
+		m.SetEdns0(udpSize, false)
+		opt = m.IsEdns0()
+	}
+
+	// dns.EDNS0_TCP_KEEPALIVE is not used since this version of miekg/dns packs it incorrectly
+	data := make([]byte, 2)
+	binary.BigEndian.PutUint16(data, uint16(units))
+	opt.Option = append(opt.Option, &dns.EDNS0_LOCAL{Code: dns.EDNS0TCPKEEPALIVE, Data: data})
+}
+
 // Parse ECS option from DNS response
 // Return IP, mask, scope
 func parseECS(m *dns.Msg) (net.IP, uint8, uint8) {
@@ -250,6 +319,39 @@ func isPublicIP(ip net.IP) bool {
 	return true
 }
 
+// parseIPOrCIDR parses either a CIDR ("192.168.0.0/16") or a single IP address ("10.0.0.1")
+// A single IP address is converted to a /32 (or /128) network
+func parseIPOrCIDR(s string) (*net.IPNet, error) {
+	if strings.Contains(s, "/") {
+		_, ipNet, err := net.ParseCIDR(s)
+		return ipNet, err
+	}
+
+	ip := net.ParseIP(s)
+	if ip == nil {
+		return nil, fmt.Errorf("invalid IP address: %s", s)
+	}
+
+	bits := 8 * net.IPv6len
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+		bits = 8 * net.IPv4len
+	}
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}, nil
+}
+
+// parseIPNets parses the list of IP addresses and CIDRs, invalid entries are skipped
+func parseIPNets(list []string) []*net.IPNet {
+	var nets []*net.IPNet
+	for _, s := range list {
+		ipNet, err := parseIPOrCIDR(s)
+		if err == nil {
+			nets = append(nets, ipNet)
+		}
+	}
+	return nets
+}
+
 // split string by a byte and return the first chunk
 // Whitespace is trimmed
 func splitNext(str *string, splitBy byte) string {
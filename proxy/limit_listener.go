@@ -0,0 +1,60 @@
+package proxy
+
+import (
+	"net"
+	"sync"
+
+	"github.com/AdguardTeam/golibs/log"
+)
+
+// limitListener is a net.Listener that limits the number of simultaneously open connections.
+// The limit is shared by all the listeners created with the same semaphore.
+// Unlike golang.org/x/net/netutil it does not block Accept when the limit is reached,
+// the new connections are closed right away instead so that the clients could try another server.
+type limitListener struct {
+	net.Listener
+	sem chan bool // a slot is taken for every open connection
+}
+
+// Accept waits for and returns the next connection to the listener
+func (l *limitListener) Accept() (net.Conn, error) {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+
+		select {
+		case l.sem <- true:
+			return &limitConn{Conn: conn, sem: l.sem}, nil
+		default:
+			log.Debug("too many open connections, closing the connection from %s", conn.RemoteAddr())
+			_ = conn.Close()
+		}
+	}
+}
+
+// limitConn is a net.Conn that frees its slot when it's closed
+type limitConn struct {
+	net.Conn
+	sem  chan bool
+	once sync.Once
+}
+
+// Close closes the connection and frees the slot
+func (c *limitConn) Close() error {
+	err := c.Conn.Close()
+	c.once.Do(func() {
+		<-c.sem
+	})
+	return err
+}
+
+// withConnLimit wraps the listener so that it limits the number of client connections
+// if MaxTCPConnections is configured
+func (p *Proxy) withConnLimit(l net.Listener) net.Listener {
+	if p.tcpConns == nil {
+		return l
+	}
+	return &limitListener{Listener: l, sem: p.tcpConns}
+}
@@ -2,6 +2,7 @@
 package proxy
 
 import (
+	"context"
 	"crypto/tls"
 	"encoding/base64"
 	"errors"
@@ -9,26 +10,34 @@ import (
 	"io/ioutil"
 	"net"
 	"net/http"
-	"sort"
+	"net/url"
 	"strconv"
 	"strings"
 	"sync"
 	"time"
 
-	"github.com/AdguardTeam/dnsproxy/fastip"
-
 	"github.com/AdguardTeam/dnsproxy/upstream"
 	"github.com/AdguardTeam/golibs/log"
 	"github.com/AdguardTeam/golibs/utils"
+	"github.com/ameshkov/dnscrypt/v2"
 	"github.com/joomcode/errorx"
 	"github.com/miekg/dns"
 	gocache "github.com/patrickmn/go-cache"
+	"github.com/quic-go/quic-go"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
 )
 
 const (
 	defaultTimeout   = 10 * time.Second
 	minDNSPacketSize = 12 + 5
 
+	maxTCPInFlightQueries = 100 // maximum number of pipelined queries processed at once for a single TCP/TLS connection
+
+	// defaultMaxUDPResponseSize is the default maximum UDP response size, it is recommended by DNS Flag Day 2020
+	// to avoid IP fragmentation (see https://dnsflagday.net/2020/)
+	defaultMaxUDPResponseSize = 1232
+
 	ednsCSDefaultNetmaskV4 = 24  // default network mask for IPv4 address for EDNS ClientSubnet option
 	ednsCSDefaultNetmaskV6 = 112 // default network mask for IPv6 address for EDNS ClientSubnet option
 )
@@ -42,6 +51,12 @@ const (
 	ProtoTLS = "tls"
 	// ProtoHTTPS is DNS-over-HTTPS
 	ProtoHTTPS = "https"
+	// ProtoHTTP is unencrypted DNS-over-HTTP (for use behind a reverse proxy that terminates TLS)
+	ProtoHTTP = "http"
+	// ProtoQUIC is DNS-over-QUIC
+	ProtoQUIC = "quic"
+	// ProtoDNSCrypt is DNSCrypt (both over UDP and TCP)
+	ProtoDNSCrypt = "dnscrypt"
 	// UnqualifiedNames is reserved name for "unqualified names only", ie names without dots
 	UnqualifiedNames = "unqualified_names"
 )
@@ -62,49 +77,92 @@ type ResponseHandler func(d *DNSContext, err error)
 
 // Proxy combines the proxy server state and configuration
 type Proxy struct {
-	started     bool         // Started flag
-	udpListen   *net.UDPConn // UDP listen connection
-	tcpListen   net.Listener // TCP listener
-	tlsListen   net.Listener // TLS listener
-	httpsListen net.Listener // HTTPS listener
-	httpsServer *http.Server // HTTPS server instance
-
-	upstreamRttStats map[string]int // Map of upstream addresses and their rtt. Used to sort upstreams "from fast to slow"
-	rttLock          sync.Mutex     // Synchronizes access to the upstreamRttStats map
-
-	nat64Prefix []byte     // NAT 64 prefix
-	nat64Lock   sync.Mutex // Prefix lock
+	started     bool             // Started flag
+	udpListen   []*net.UDPConn   // UDP listen connections
+	tcpListen   []net.Listener   // TCP listeners
+	tlsListen   []net.Listener   // TLS listeners
+	httpsListen []net.Listener   // HTTPS listeners
+	httpsServer *http.Server     // HTTPS server instance (serves all HTTPS listeners)
+	httpListen  []net.Listener   // plain HTTP listeners
+	httpServer  *http.Server     // plain HTTP server instance (serves all HTTP listeners)
+	quicListen  []*quic.Listener // QUIC listeners
+
+	dnsCryptUDPListen []*net.UDPConn   // UDP listen connections for DNSCrypt
+	dnsCryptTCPListen []net.Listener   // TCP listeners for DNSCrypt
+	dnsCryptServer    *dnscrypt.Server // DNSCrypt server instance
+
+	nat64Prefixes []*net.IPNet // NAT64 prefixes, DNS64 is disabled if there are none
+	nat64Lock     sync.Mutex   // protects nat64Prefixes
+
+	dns64ExcludeIPv4 []*net.IPNet // parsed DNS64ExcludeIPv4
+	dns64ExcludeAAAA []*net.IPNet // parsed DNS64ExcludeAAAA (or the default range)
 
 	ratelimitBuckets *gocache.Cache // where the ratelimiters are stored, per IP
 	ratelimitLock    sync.Mutex     // Synchronizes access to ratelimitBuckets
 
+	trustedProxies    []*net.IPNet // parsed TrustedProxies
+	proxyProtoTrusted []*net.IPNet // parsed ProxyProtocolTrustedNets
+
 	cache       *cache       // cache instance (nil if cache is disabled)
 	cacheSubnet *cacheSubnet // cache instance (nil if cache is disabled)
 
-	fastestAddr *fastip.FastestAddr // fastest-addr module
+	selector UpstreamSelector // selector for the default upstreams and the custom ones (DNSContext.Upstreams)
+
+	healthChecker *healthChecker // upstreams health checker (nil if it's disabled)
+
+	nat64Discovery *nat64Discovery // NAT64 prefix discovery (nil if it's disabled)
 
 	udpOOBSize int // size for received OOB data
 
 	Config // proxy configuration
 
 	maxGoroutines chan bool // limits the number of parallel queries. if nil, there's no limit
-	sync.RWMutex            // protects parallel access to proxy structures
+	tcpConns      chan bool // limits the number of open client connections. if nil, there's no limit
+
+	idleTimeout time.Duration // TCPIdleTimeout or the default value
+	readTimeout time.Duration // TCPReadTimeout or the default value
+
+	sync.RWMutex // protects parallel access to proxy structures
 }
 
 // Config contains all the fields necessary for proxy configuration
 type Config struct {
-	UDPListenAddr *net.UDPAddr // if nil, then it does not listen for UDP
-	TCPListenAddr *net.TCPAddr // if nil, then it does not listen for TCP
+	// Listen addresses. Every protocol may listen on several addresses,
+	// a separate listener loop is started for each of them.
+	// If a list is empty, the proxy does not listen for that protocol.
+
+	UDPListenAddr []*net.UDPAddr // addresses to listen for UDP
+	TCPListenAddr []*net.TCPAddr // addresses to listen for TCP
+
+	HTTPSListenAddr []*net.TCPAddr // addresses to listen for HTTPS (DoH)
+	TLSListenAddr   []*net.TCPAddr // addresses to listen for TLS (DoT)
+	QUICListenAddr  []*net.UDPAddr // addresses to listen for QUIC (DoQ)
+	TLSConfig       *tls.Config    // necessary for listening for TLS, HTTPS and QUIC
 
-	HTTPSListenAddr *net.TCPAddr // if nil, then it does not listen for HTTPS (DoH)
-	TLSListenAddr   *net.TCPAddr // if nil, then it does not listen for TLS (DoT)
-	TLSConfig       *tls.Config  // necessary for listening for TLS
+	// addresses to listen for plain HTTP (unencrypted DoH, both HTTP/1.1 and h2c).
+	// It is supposed to be used behind a reverse proxy that terminates TLS.
+	HTTPListenAddr []*net.TCPAddr
+
+	// TrustedProxies is a list of IP addresses or CIDRs of the trusted reverse proxies.
+	// The client IP address from the X-Forwarded-For, X-Real-IP and CF-Connecting-IP headers
+	// is only used when the request comes from one of them.
+	TrustedProxies []string
+
+	// ProxyProtocolTrustedNets is a list of IP addresses or CIDRs of the load balancers (i.e. HAProxy or AWS NLB)
+	// that are allowed to send the PROXY protocol (v1 or v2) header. The client address from the header
+	// is used instead of the balancer's address. It is supported by the TCP, TLS and HTTPS listeners.
+	// If empty, the PROXY protocol is disabled.
+	ProxyProtocolTrustedNets []string
+
+	DNSCryptListenAddr   []*net.UDPAddr // addresses to listen for DNSCrypt (the same address is used for both UDP and TCP)
+	DNSCryptProviderName string         // DNSCrypt provider name, e.g. "2.dnscrypt-cert.example.org"
+	DNSCryptResolverCert *dnscrypt.Cert // DNSCrypt resolver certificate, contains the resolver short-term keypair
 
 	Ratelimit          int      // max number of requests per second from a given IP (0 to disable)
 	RatelimitWhitelist []string // a list of whitelisted client IP addresses
 
 	RefuseAny  bool // if true, refuse ANY requests
-	AllServers bool // if true, parallel queries to all configured upstream servers are enabled
+	AllServers bool // if true, parallel queries to all configured upstream servers are enabled (ignored if UpstreamSelector is set)
 
 	// Enable EDNS Client Subnet option
 	// DNS requests to the upstream server will contain an OPT record with Client Subnet option.
@@ -142,24 +200,86 @@ type Config struct {
 
 	DomainsReservedUpstreams map[string][]upstream.Upstream // map of domains and lists of corresponding upstreams
 
-	FindFastestAddr bool // use Fastest Address algorithm
+	FindFastestAddr bool // use Fastest Address algorithm (ignored if UpstreamSelector is set)
+
+	// UpstreamSelector chooses the upstreams to query. If nil, it's chosen according to AllServers and FindFastestAddr,
+	// the latency EWMA selector is used by default (see NewEWMASelector).
+	UpstreamSelector UpstreamSelector
+	// DomainsUpstreamSelectors are the selectors for the DomainsReservedUpstreams by the domain.
+	// The domains that aren't specified here use UpstreamSelector.
+	DomainsUpstreamSelectors map[string]UpstreamSelector
 
 	MaxGoroutines int // maximum number of goroutines processing the DNS requests (important for mobile)
+
+	// TCPIdleTimeout is how long a TCP, TLS or HTTPS client connection may stay idle between the queries.
+	// It is advertised to the TCP and TLS clients that send the edns-tcp-keepalive option (RFC 7828).
+	// If 0, the default value (10 seconds) is used.
+	TCPIdleTimeout time.Duration
+	// TCPReadTimeout is the maximum time to read a query (or the HTTP request headers) once the client started sending it.
+	// If 0, the default value (10 seconds) is used.
+	TCPReadTimeout time.Duration
+	// MaxUDPResponseSize is the maximum size of a UDP response. Larger responses are truncated and the TC bit is set
+	// so that the client could retry over TCP. The client's EDNS UDP payload size (or 512 bytes if the query has
+	// no OPT record) is used if it's lower. If 0, the default value (1232 bytes) is used.
+	MaxUDPResponseSize int
+	// MaxTCPConnections is the maximum number of simultaneously open TCP, TLS, HTTPS and HTTP client connections.
+	// New connections over the limit are closed right away. If 0, there's no limit.
+	MaxTCPConnections int
+
+	// HealthCheckInterval is how often the upstreams (including Fallbacks) are probed in the background.
+	// The upstreams that are down are skipped until they're up again. If 0, the health checking is disabled.
+	HealthCheckInterval time.Duration
+	// HealthCheckDomain is the domain name that is queried (A record) to probe the upstreams.
+	// If empty, "example.org" is used.
+	HealthCheckDomain string
+	// HealthCheckFailures is the number of consecutive failed probes after which the upstream is marked down.
+	// If 0, the default value (3) is used.
+	HealthCheckFailures int
+	// HealthCheckSuccesses is the number of consecutive successful probes after which the upstream is marked up again.
+	// If 0, the default value (2) is used.
+	HealthCheckSuccesses int
+
+	// DNS64 enables synthesizing the AAAA records from the A records (RFC 6147). If DNS64Prefixes aren't set,
+	// the NAT64 prefixes are discovered by resolving ipv4only.arpa through the upstreams (RFC 7050).
+	DNS64 bool
+	// DNS64Prefixes are the static NAT64 prefixes, e.g. "64:ff9b::/96". The prefix length must be 32, 40, 48, 56, 64
+	// or 96 (RFC 6052). The AAAA records are synthesized using each of them. If set, DNS64 is enabled.
+	DNS64Prefixes []string
+	// DNS64ExcludeIPv4 are the IPv4 addresses and CIDRs that aren't mapped to IPv6 by DNS64.
+	DNS64ExcludeIPv4 []string
+	// DNS64ExcludeAAAA are the IPv6 addresses and CIDRs of the AAAA records that DNS64 treats as nonexistent.
+	// If empty, ::ffff:0:0/96 is used (RFC 6147, section 5.1.4).
+	DNS64ExcludeAAAA []string
+	// NAT64DiscoveryInterval is the maximum time after which the NAT64 prefix is discovered again,
+	// it's discovered earlier when the ipv4only.arpa records expire. If 0, the default value (30 minutes) is used.
+	NAT64DiscoveryInterval time.Duration
 }
 
 // DNSContext represents a DNS request message context
 type DNSContext struct {
-	Proto              string              // "udp", "tcp", "tls", "https"
+	Proto              string              // "udp", "tcp", "tls", "https", "http", "quic", "dnscrypt"
 	Req                *dns.Msg            // DNS request
 	Res                *dns.Msg            // DNS response from an upstream
 	Conn               net.Conn            // underlying client connection. Can be null in the case of DOH.
 	Addr               net.Addr            // client address.
 	localIP            net.IP              // local IP address (for UDP socket)
+	writeLock          *sync.Mutex         // serializes the responses written to the same TCP connection (for TCP and TLS only)
+	tcpKeepalive       bool                // the client sent the edns-tcp-keepalive option (for TCP and TLS only)
 	HTTPRequest        *http.Request       // HTTP request (for DOH only)
 	HTTPResponseWriter http.ResponseWriter // HTTP response writer (for DOH only)
+	QUICStream         *quic.Stream        // QUIC stream the query was received from (for DoQ only)
+	QUICConnection     *quic.Conn          // QUIC connection the stream belongs to (for DoQ only)
 	StartTime          time.Time           // processing start time
 	Upstream           upstream.Upstream   // upstream that resolved DNS request
 
+	// Context of the request. The upstream queries are cancelled as soon as it is done,
+	// and its deadline (if any) is used as the upstream queries deadline.
+	// It is set to the HTTP request context for DOH. If nil, context.Background() is used.
+	Context context.Context
+
+	// DNSCrypt response writer (for DNSCrypt only), it encrypts the response
+	DNSCryptResponseWriter dnscrypt.ResponseWriter
+
 	// Upstream servers to use for this request
 	// If set, Resolve() uses it instead of default servers
 	Upstreams []upstream.Upstream
@@ -168,6 +288,14 @@ type DNSContext struct {
 	ecsReqMask uint8  // ECS mask used in request
 }
 
+// context returns the request context or context.Background() if it's not set
+func (d *DNSContext) context() context.Context {
+	if d.Context == nil {
+		return context.Background()
+	}
+	return d.Context
+}
+
 // UpstreamConfig is a wrapper for list of default upstreams and map of reserved domains and corresponding upstreams
 type UpstreamConfig struct {
 	Upstreams               []upstream.Upstream            // list of default upstreams
@@ -182,6 +310,9 @@ type UpstreamConfig struct {
 // So the following config: ["[/host.com/]1.2.3.4", "[/www.host.com/]2.3.4.5", "[/maps.host.com/]#", "3.4.5.6"]
 // will send queries for *.host.com to 1.2.3.4, except for *.www.host.com, which will go to 2.3.4.5 and *.maps.host.com,
 // which will go to default server 3.4.5.6 with all other domains
+// The upstream weight for the weighted round-robin selection is specified with the "weight" query parameter,
+// e.g. "tls://1.1.1.1?weight=3" (see NewWeightedRoundRobinSelector).
+// The other query parameters are the upstream options (see upstream.AddressToUpstream).
 func ParseUpstreamsConfig(upstreamConfig, bootstrapDNS []string, timeout time.Duration) (UpstreamConfig, error) {
 	return ParseUpstreamsConfigEx(upstreamConfig, bootstrapDNS, timeout, func(address string, opts upstream.Options) (upstream.Upstream, error) {
 		return upstream.AddressToUpstream(address, opts)
@@ -193,11 +324,25 @@ type AddressToUpstreamFunction func(address string, opts upstream.Options) (upst
 
 // ParseUpstreamsConfigEx is an extended version of ParseUpstreamsConfig() which has a custom callback function which creates an upstream object
 func ParseUpstreamsConfigEx(upstreamConfig, bootstrapDNS []string, timeout time.Duration, addressToUpstreamFunction AddressToUpstreamFunction) (UpstreamConfig, error) {
+	return parseUpstreamsConfig(upstreamConfig, upstream.Options{Bootstrap: bootstrapDNS, Timeout: timeout}, addressToUpstreamFunction)
+}
+
+// ParseUpstreamsConfigWithOptions is a version of ParseUpstreamsConfig() that creates all the upstreams
+// with the specified options (e.g. with the TLS client certificate).
+// The options specified in the upstream string override them.
+func ParseUpstreamsConfigWithOptions(upstreamConfig []string, opts upstream.Options) (UpstreamConfig, error) {
+	return parseUpstreamsConfig(upstreamConfig, opts, func(address string, opts upstream.Options) (upstream.Upstream, error) {
+		return upstream.AddressToUpstream(address, opts)
+	})
+}
+
+// parseUpstreamsConfig parses the upstreams configuration, opts are passed to addressToUpstreamFunction
+func parseUpstreamsConfig(upstreamConfig []string, opts upstream.Options, addressToUpstreamFunction AddressToUpstreamFunction) (UpstreamConfig, error) {
 	upstreams := []upstream.Upstream{}
 	domainReservedUpstreams := map[string][]upstream.Upstream{}
 
-	if len(bootstrapDNS) > 0 {
-		for i, b := range bootstrapDNS {
+	if len(opts.Bootstrap) > 0 {
+		for i, b := range opts.Bootstrap {
 			log.Info("Bootstrap %d: %s", i, b)
 		}
 	}
@@ -234,10 +379,18 @@ func ParseUpstreamsConfigEx(upstreamConfig, bootstrapDNS []string, timeout time.
 			continue
 		}
 
+		u, weight, err := splitUpstreamWeight(u)
+		if err != nil {
+			return UpstreamConfig{}, err
+		}
+
 		// create an upstream
-		dnsUpstream, err := addressToUpstreamFunction(u, upstream.Options{Bootstrap: bootstrapDNS, Timeout: timeout})
+		dnsUpstream, err := addressToUpstreamFunction(u, opts)
 		if err != nil {
-			return UpstreamConfig{}, fmt.Errorf("cannot prepare the upstream %s (%s): %s", u, bootstrapDNS, err)
+			return UpstreamConfig{}, fmt.Errorf("cannot prepare the upstream %s (%s): %s", u, opts.Bootstrap, err)
+		}
+		if weight > 0 {
+			dnsUpstream = &weightedUpstream{Upstream: dnsUpstream, weight: weight}
 		}
 
 		if len(hosts) > 0 {
@@ -257,6 +410,32 @@ func ParseUpstreamsConfigEx(upstreamConfig, bootstrapDNS []string, timeout time.
 	return UpstreamConfig{Upstreams: upstreams, DomainReservedUpstreams: domainReservedUpstreams}, nil
 }
 
+// splitUpstreamWeight removes the "weight" query parameter from the upstream string
+// Returns the upstream string without it and the weight (0 if it isn't specified)
+func splitUpstreamWeight(u string) (string, int, error) {
+	i := strings.Index(u, "?")
+	if i == -1 {
+		return u, 0, nil
+	}
+
+	query, err := url.ParseQuery(u[i+1:])
+	if err != nil || query.Get("weight") == "" {
+		// Leave it to the upstream constructor
+		return u, 0, nil
+	}
+
+	weight, err := strconv.Atoi(query.Get("weight"))
+	if err != nil || weight <= 0 {
+		return "", 0, fmt.Errorf("invalid upstream weight in %s: must be a positive integer", u)
+	}
+
+	query.Del("weight")
+	if len(query) == 0 {
+		return u[:i], weight, nil
+	}
+	return u[:i] + "?" + query.Encode(), weight, nil
+}
+
 // Init - initializes the proxy structures but does not start it
 func (p *Proxy) Init() {
 	if p.CacheEnabled {
@@ -275,9 +454,27 @@ func (p *Proxy) Init() {
 
 	p.udpOOBSize = udpGetOOBSize()
 
-	if p.FindFastestAddr {
-		log.Printf("Fastest IP is enabled")
-		p.fastestAddr = fastip.NewFastestAddr()
+	// TrustedProxies and ProxyProtocolTrustedNets are checked in validateConfig
+	p.trustedProxies = parseIPNets(p.TrustedProxies)
+	p.proxyProtoTrusted = parseIPNets(p.ProxyProtocolTrustedNets)
+
+	// The DNS64 lists are checked in validateConfig
+	p.dns64ExcludeIPv4 = parseIPNets(p.DNS64ExcludeIPv4)
+	p.dns64ExcludeAAAA = parseIPNets(p.DNS64ExcludeAAAA)
+	if len(p.dns64ExcludeAAAA) == 0 {
+		p.dns64ExcludeAAAA = parseIPNets([]string{defaultDNS64ExcludeAAAA})
+	}
+
+	p.selector = p.UpstreamSelector
+	if p.selector == nil {
+		p.selector = NewEWMASelector()
+		if p.AllServers {
+			p.selector = NewParallelSelector()
+		}
+		if p.FindFastestAddr {
+			log.Printf("Fastest IP is enabled")
+			p.selector = NewFastestAddrSelector(p.selector)
+		}
 	}
 
 	if p.MaxGoroutines > 0 {
@@ -287,6 +484,22 @@ func (p *Proxy) Init() {
 		// nil means there's no limit
 		p.maxGoroutines = nil
 	}
+
+	if p.MaxTCPConnections > 0 {
+		log.Info("MaxTCPConnections is set to %d", p.MaxTCPConnections)
+		p.tcpConns = make(chan bool, p.MaxTCPConnections)
+	} else {
+		p.tcpConns = nil
+	}
+
+	p.idleTimeout = p.TCPIdleTimeout
+	if p.idleTimeout <= 0 {
+		p.idleTimeout = defaultTimeout
+	}
+	p.readTimeout = p.TCPReadTimeout
+	if p.readTimeout <= 0 {
+		p.readTimeout = defaultTimeout
+	}
 }
 
 // Start initializes the proxy server and starts listening
@@ -308,6 +521,18 @@ func (p *Proxy) Start() error {
 		return err
 	}
 
+	if p.HealthCheckInterval > 0 {
+		p.healthChecker = newHealthChecker(&p.Config)
+		p.healthChecker.start()
+	}
+
+	if len(p.DNS64Prefixes) != 0 {
+		p.setNAT64Prefixes(parseIPNets(p.DNS64Prefixes))
+	} else if p.DNS64 {
+		p.nat64Discovery = newNAT64Discovery(p)
+		p.nat64Discovery.start()
+	}
+
 	p.started = true
 	return nil
 }
@@ -316,6 +541,14 @@ func (p *Proxy) Start() error {
 func (p *Proxy) Stop() error {
 	log.Println("Stopping the DNS proxy server")
 
+	// The NAT64 prefix discovery in progress may be waiting for the lock, so it's waited for after the lock is released
+	var discovery *nat64Discovery
+	defer func() {
+		if discovery != nil {
+			discovery.wait()
+		}
+	}()
+
 	p.Lock()
 	defer p.Unlock()
 	if !p.started {
@@ -325,30 +558,32 @@ func (p *Proxy) Stop() error {
 
 	errs := []error{}
 
-	if p.tcpListen != nil {
-		err := p.tcpListen.Close()
-		p.tcpListen = nil
-		if err != nil {
-			errs = append(errs, errorx.Decorate(err, "couldn't close TCP listening socket"))
-		}
+	if p.healthChecker != nil {
+		p.healthChecker.close()
+		p.healthChecker = nil
 	}
 
-	if p.udpListen != nil {
-		err := p.udpListen.Close()
-		p.udpListen = nil
-		if err != nil {
-			errs = append(errs, errorx.Decorate(err, "couldn't close UDP listening socket"))
-		}
+	if p.nat64Discovery != nil {
+		discovery = p.nat64Discovery
+		discovery.close()
+		p.nat64Discovery = nil
 	}
 
-	if p.tlsListen != nil {
-		err := p.tlsListen.Close()
-		p.tlsListen = nil
+	errs = closeListeners(errs, p.tcpListen, "TCP listening socket")
+	p.tcpListen = nil
+
+	for _, l := range p.udpListen {
+		err := l.Close()
 		if err != nil {
-			errs = append(errs, errorx.Decorate(err, "couldn't close TLS listening socket"))
+			errs = append(errs, errorx.Decorate(err, "couldn't close UDP listening socket"))
 		}
 	}
+	p.udpListen = nil
+
+	errs = closeListeners(errs, p.tlsListen, "TLS listening socket")
+	p.tlsListen = nil
 
+	// Closing the server closes all the listeners it serves
 	if p.httpsServer != nil {
 		err := p.httpsServer.Close()
 		p.httpsListen = nil
@@ -358,6 +593,35 @@ func (p *Proxy) Stop() error {
 		}
 	}
 
+	if p.httpServer != nil {
+		err := p.httpServer.Close()
+		p.httpListen = nil
+		p.httpServer = nil
+		if err != nil {
+			errs = append(errs, errorx.Decorate(err, "couldn't close HTTP server"))
+		}
+	}
+
+	for _, l := range p.quicListen {
+		err := l.Close()
+		if err != nil {
+			errs = append(errs, errorx.Decorate(err, "couldn't close QUIC listener"))
+		}
+	}
+	p.quicListen = nil
+
+	for _, l := range p.dnsCryptUDPListen {
+		err := l.Close()
+		if err != nil {
+			errs = append(errs, errorx.Decorate(err, "couldn't close DNSCrypt UDP listening socket"))
+		}
+	}
+	p.dnsCryptUDPListen = nil
+
+	errs = closeListeners(errs, p.dnsCryptTCPListen, "DNSCrypt TCP listening socket")
+	p.dnsCryptTCPListen = nil
+	p.dnsCryptServer = nil
+
 	if p.maxGoroutines != nil {
 		close(p.maxGoroutines)
 	}
@@ -370,35 +634,50 @@ func (p *Proxy) Stop() error {
 	return nil
 }
 
-// Addr returns the listen address for the specified proto or null if the proxy does not listen to it
-// proto must be "tcp", "tls", "https" or "udp"
+// Addr returns the first listen address for the specified proto or null if the proxy does not listen to it
+// proto must be "tcp", "tls", "https", "http", "quic", "dnscrypt" or "udp"
+// For "dnscrypt" the UDP address is returned (TCP listens to the same port)
 func (p *Proxy) Addr(proto string) net.Addr {
+	addrs := p.Addrs(proto)
+	if len(addrs) == 0 {
+		return nil
+	}
+	return addrs[0]
+}
+
+// Addrs returns all the listen addresses for the specified proto or null if the proxy does not listen to it
+// proto must be "tcp", "tls", "https", "http", "quic", "dnscrypt" or "udp"
+// For "dnscrypt" the UDP addresses are returned (TCP listens to the same ports)
+func (p *Proxy) Addrs(proto string) []net.Addr {
 	p.RLock()
 	defer p.RUnlock()
+
+	var addrs []net.Addr
 	switch proto {
 	case ProtoTCP:
-		if p.tcpListen == nil {
-			return nil
-		}
-		return p.tcpListen.Addr()
+		addrs = listenersAddrs(p.tcpListen)
 	case ProtoTLS:
-		if p.tlsListen == nil {
-			return nil
-		}
-		return p.tlsListen.Addr()
+		addrs = listenersAddrs(p.tlsListen)
 	case ProtoHTTPS:
-		if p.httpsListen == nil {
-			return nil
-		}
-		return p.httpsListen.Addr()
+		addrs = listenersAddrs(p.httpsListen)
+	case ProtoHTTP:
+		addrs = listenersAddrs(p.httpListen)
 	case ProtoUDP:
-		if p.udpListen == nil {
-			return nil
+		for _, l := range p.udpListen {
+			addrs = append(addrs, l.LocalAddr())
+		}
+	case ProtoQUIC:
+		for _, l := range p.quicListen {
+			addrs = append(addrs, l.Addr())
+		}
+	case ProtoDNSCrypt:
+		for _, l := range p.dnsCryptUDPListen {
+			addrs = append(addrs, l.LocalAddr())
 		}
-		return p.udpListen.LocalAddr()
 	default:
-		panic("proto must be 'tcp', 'tls', 'https' or 'udp'")
+		panic("proto must be 'tcp', 'tls', 'https', 'http', 'quic', 'dnscrypt' or 'udp'")
 	}
+	return addrs
 }
 
 // getUpstreamsForDomain looks for a domain in reserved domains map and returns a list of corresponding upstreams.
@@ -412,24 +691,50 @@ func (p *Proxy) getUpstreamsForDomain(host string) []upstream.Upstream {
 		return p.Upstreams
 	}
 
+	domain, ok := p.reservedDomain(host)
+	if !ok {
+		return p.Upstreams
+	}
+	return p.DomainsReservedUpstreams[domain]
+}
+
+// getSelectorForDomain returns the upstream selector for the upstreams returned by getUpstreamsForDomain
+func (p *Proxy) getSelectorForDomain(host string) UpstreamSelector {
+	if len(p.DomainsReservedUpstreams) == 0 || len(p.DomainsUpstreamSelectors) == 0 {
+		return p.selector
+	}
+
+	domain, ok := p.reservedDomain(host)
+	if !ok {
+		return p.selector
+	}
+	if s, ok := p.DomainsUpstreamSelectors[domain]; ok {
+		return s
+	}
+	return p.selector
+}
+
+// reservedDomain returns the key of DomainsReservedUpstreams that the host matches
+// Returns false if the default upstreams should be used for the host
+func (p *Proxy) reservedDomain(host string) (string, bool) {
 	dotsCount := strings.Count(host, ".")
 	if dotsCount < 2 {
-		return p.DomainsReservedUpstreams[UnqualifiedNames]
+		return UnqualifiedNames, true
 	}
 
 	for i := 1; i <= dotsCount; i++ {
 		h := strings.SplitAfterN(host, ".", i)
-		name := h[i-1]
-		if u, ok := p.DomainsReservedUpstreams[strings.ToLower(name)]; ok {
+		name := strings.ToLower(h[i-1])
+		if u, ok := p.DomainsReservedUpstreams[name]; ok {
 			if u == nil {
 				// domain was excluded from reserved upstreams querying
-				return p.Upstreams
+				return "", false
 			}
-			return u
+			return name, true
 		}
 	}
 
-	return p.Upstreams
+	return "", false
 }
 
 // Set EDNS Client-Subnet data in DNS request
@@ -489,24 +794,24 @@ func (p *Proxy) Resolve(d *DNSContext) error {
 
 	// Get custom upstreams first -- note that they might be empty
 	upstreams := d.Upstreams
+	selector := p.selector
 	if len(upstreams) == 0 {
 		// get upstreams for the specified hostname
 		upstreams = p.getUpstreamsForDomain(d.Req.Question[0].Name)
+		selector = p.getSelectorForDomain(d.Req.Question[0].Name)
 	}
 
 	// execute the DNS request
 	startTime := time.Now()
-	reply, u, err := p.exchange(d.Req, upstreams)
-	if p.isEmptyAAAAResponse(reply, d.Req) {
-		reply, u, err = p.checkDNS64(d.Req, reply, upstreams)
-	}
+	ctx := d.context()
+	reply, u, err := p.exchangeDNS64(ctx, d, upstreams, selector)
 
 	rtt := int(time.Since(startTime) / time.Millisecond)
 	log.Tracef("RTT: %d ms", rtt)
 
-	if err != nil && p.Fallbacks != nil {
+	if err != nil && p.Fallbacks != nil && ctx.Err() == nil {
 		log.Tracef("Using the fallback upstream due to %s", err)
-		reply, u, err = upstream.ExchangeParallel(p.Fallbacks, d.Req)
+		reply, u, err = upstream.ExchangeParallelContext(ctx, p.healthyUpstreams(p.Fallbacks), d.Req)
 	}
 
 	// set Upstream that resolved DNS request to DNSContext
@@ -533,61 +838,58 @@ func (p *Proxy) Resolve(d *DNSContext) error {
 	return err
 }
 
-func (p *Proxy) exchange(req *dns.Msg, upstreams []upstream.Upstream) (reply *dns.Msg, u upstream.Upstream, err error) {
-	qtype := req.Question[0].Qtype
-	if p.FindFastestAddr && (qtype == dns.TypeA || qtype == dns.TypeAAAA) {
-		reply, u, err = p.fastestAddr.ExchangeFastest(req, upstreams)
-		return
-	}
-
-	if p.AllServers {
-		reply, u, err = upstream.ExchangeParallel(upstreams, req)
-		return
+// exchange sends the request to the upstreams chosen by the selector
+func (p *Proxy) exchange(ctx context.Context, req *dns.Msg, upstreams []upstream.Upstream, selector UpstreamSelector) (*dns.Msg, upstream.Upstream, error) {
+	// The local upstreams (hosts files) are queried first in the specified order,
+	// the others are used for the names they pass through
+	local, upstreams := splitLocalUpstreams(upstreams)
+	for _, u := range local {
+		reply, _, err := exchangeWithUpstream(ctx, u, req)
+		if err != upstream.ErrNotInHosts {
+			return reply, u, err
+		}
 	}
 
-	if len(upstreams) == 1 {
-		u = upstreams[0]
-		reply, _, err = exchangeWithUpstream(u, req)
-		return
+	// Skip the upstreams that are marked down by the health checker
+	upstreams = p.healthyUpstreams(upstreams)
+	if len(upstreams) == 0 {
+		if len(local) != 0 {
+			return nil, nil, upstream.ErrNotInHosts
+		}
+		return nil, nil, errors.New("no upstreams specified")
 	}
 
-	// sort upstreams by rtt from fast to slow
-	sortedUpstreams := p.getSortedUpstreams(upstreams)
+	return selector.Exchange(ctx, req, upstreams)
+}
 
-	errs := []error{}
-	for _, dnsUpstream := range sortedUpstreams {
-		reply, elapsed, err := exchangeWithUpstream(dnsUpstream, req)
-		if err == nil {
-			p.updateRtt(dnsUpstream.Address(), elapsed)
-			return reply, dnsUpstream, err
+// splitLocalUpstreams splits the upstreams into the local ones (see upstream.IsLocal) and the others
+func splitLocalUpstreams(upstreams []upstream.Upstream) ([]upstream.Upstream, []upstream.Upstream) {
+	var local, remote []upstream.Upstream
+	for _, u := range upstreams {
+		if isLocalUpstream(u) {
+			local = append(local, u)
+		} else {
+			remote = append(remote, u)
 		}
-		errs = append(errs, err)
-		p.updateRtt(dnsUpstream.Address(), int(defaultTimeout/time.Millisecond))
 	}
-	return nil, nil, errorx.DecorateMany("all upstreams failed to exchange request", errs...)
+	if len(local) == 0 {
+		return nil, upstreams
+	}
+	return local, remote
 }
 
-func (p *Proxy) getSortedUpstreams(u []upstream.Upstream) []upstream.Upstream {
-	// clone upstreams list to avoid race conditions
-	p.rttLock.Lock()
-	clone := make([]upstream.Upstream, len(u))
-	copy(clone, u)
-
-	sort.Slice(clone, func(i, j int) bool {
-		if p.upstreamRttStats[clone[i].Address()] < p.upstreamRttStats[clone[j].Address()] {
-			return true
-		}
-		return false
-	})
-	p.rttLock.Unlock()
-
-	return clone
+// isLocalUpstream checks if the upstream (possibly with a weight) is a local one
+func isLocalUpstream(u upstream.Upstream) bool {
+	if w, ok := u.(*weightedUpstream); ok {
+		u = w.Upstream
+	}
+	return upstream.IsLocal(u)
 }
 
 // exchangeWithUpstream returns result of Exchange with elapsed time
-func exchangeWithUpstream(u upstream.Upstream, req *dns.Msg) (*dns.Msg, int, error) {
+func exchangeWithUpstream(ctx context.Context, u upstream.Upstream, req *dns.Msg) (*dns.Msg, int, error) {
 	startTime := time.Now()
-	reply, err := u.Exchange(req)
+	reply, err := upstream.ExchangeContext(ctx, u, req)
 	elapsed := int(time.Since(startTime) / time.Millisecond)
 	if err != nil {
 		log.Tracef("upstream %s failed to exchange %s in %d milliseconds. Cause: %s", u.Address(), req.Question[0].String(), elapsed, err)
@@ -597,34 +899,48 @@ func exchangeWithUpstream(u upstream.Upstream, req *dns.Msg) (*dns.Msg, int, err
 	return reply, elapsed, err
 }
 
-// updateRtt updates rtt in upstreamRttStats for given address
-func (p *Proxy) updateRtt(address string, rtt int) {
-	p.rttLock.Lock()
-	if p.upstreamRttStats == nil {
-		p.upstreamRttStats = map[string]int{}
-	}
-	p.upstreamRttStats[address] = (p.upstreamRttStats[address] + rtt) / 2
-	p.rttLock.Unlock()
-}
-
 // validateConfig verifies that the supplied configuration is valid and returns an error if it's not
 func (p *Proxy) validateConfig() error {
 	if p.started {
 		return errors.New("server has been already started")
 	}
 
-	if p.UDPListenAddr == nil && p.TCPListenAddr == nil && p.TLSListenAddr == nil && p.HTTPSListenAddr == nil {
+	if len(p.UDPListenAddr) == 0 && len(p.TCPListenAddr) == 0 && len(p.TLSListenAddr) == 0 &&
+		len(p.HTTPSListenAddr) == 0 && len(p.HTTPListenAddr) == 0 && len(p.QUICListenAddr) == 0 &&
+		len(p.DNSCryptListenAddr) == 0 {
 		return errors.New("no listen address specified")
 	}
 
-	if p.TLSListenAddr != nil && p.TLSConfig == nil {
+	if len(p.TLSListenAddr) != 0 && p.TLSConfig == nil {
 		return errors.New("cannot create a TLS listener without TLS config")
 	}
 
-	if p.HTTPSListenAddr != nil && p.TLSConfig == nil {
+	if len(p.HTTPSListenAddr) != 0 && p.TLSConfig == nil {
 		return errors.New("cannot create an HTTPS listener without TLS config")
 	}
 
+	if len(p.QUICListenAddr) != 0 && p.TLSConfig == nil {
+		return errors.New("cannot create a QUIC listener without TLS config")
+	}
+
+	if len(p.DNSCryptListenAddr) != 0 && (p.DNSCryptProviderName == "" || p.DNSCryptResolverCert == nil) {
+		return errors.New("cannot create a DNSCrypt listener without the provider name and the resolver certificate")
+	}
+
+	for _, s := range p.TrustedProxies {
+		_, err := parseIPOrCIDR(s)
+		if err != nil {
+			return errorx.Decorate(err, "invalid trusted proxy")
+		}
+	}
+
+	for _, s := range p.ProxyProtocolTrustedNets {
+		_, err := parseIPOrCIDR(s)
+		if err != nil {
+			return errorx.Decorate(err, "invalid PROXY protocol trusted network")
+		}
+	}
+
 	if len(p.Upstreams) == 0 {
 		if len(p.DomainsReservedUpstreams) == 0 {
 			return errors.New("no upstreams specified")
@@ -632,6 +948,11 @@ func (p *Proxy) validateConfig() error {
 		return errors.New("no default upstreams specified")
 	}
 
+	err := validateDNS64Config(&p.Config)
+	if err != nil {
+		return err
+	}
+
 	if p.CacheMinTTL > 0 || p.CacheMaxTTL > 0 {
 		log.Info("Cache TTL override is enabled. Min=%d, Max=%d", p.CacheMinTTL, p.CacheMaxTTL)
 	}
@@ -649,69 +970,182 @@ func (p *Proxy) validateConfig() error {
 
 // startListeners configures and starts listener loops
 func (p *Proxy) startListeners() error {
-	if p.UDPListenAddr != nil {
-		err := p.udpCreate()
+	err := p.createListeners()
+	if err != nil {
+		p.closeCreatedListeners()
+		return err
+	}
+
+	for _, l := range p.udpListen {
+		go p.udpPacketLoop(l)
+	}
+
+	for _, l := range p.tcpListen {
+		go p.tcpPacketLoop(l, ProtoTCP)
+	}
+
+	for _, l := range p.tlsListen {
+		go p.tcpPacketLoop(l, ProtoTLS)
+	}
+
+	for _, l := range p.httpsListen {
+		go p.listenHTTPS(l)
+	}
+
+	for _, l := range p.httpListen {
+		go p.listenHTTP(l)
+	}
+
+	for _, l := range p.quicListen {
+		go p.quicPacketLoop(l)
+	}
+
+	for _, l := range p.dnsCryptUDPListen {
+		go p.dnsCryptUDPLoop(l)
+	}
+
+	for _, l := range p.dnsCryptTCPListen {
+		go p.dnsCryptTCPLoop(l)
+	}
+
+	return nil
+}
+
+// createListeners creates the listening sockets for all the configured addresses
+func (p *Proxy) createListeners() error {
+	for _, addr := range p.UDPListenAddr {
+		err := p.udpCreate(addr)
 		if err != nil {
 			return err
 		}
 	}
 
-	if p.TCPListenAddr != nil {
+	for _, addr := range p.TCPListenAddr {
 		log.Printf("Creating the TCP server socket")
-		tcpAddr := p.TCPListenAddr
-		tcpListen, err := net.ListenTCP("tcp", tcpAddr)
+		tcpListen, err := net.ListenTCP("tcp", addr)
 		if err != nil {
 			return errorx.Decorate(err, "couldn't listen to TCP socket")
 		}
-		p.tcpListen = tcpListen
-		log.Printf("Listening to tcp://%s", p.tcpListen.Addr())
+		l := p.withProxyProtocol(p.withConnLimit(tcpListen))
+		p.tcpListen = append(p.tcpListen, l)
+		log.Printf("Listening to tcp://%s", l.Addr())
 	}
 
-	if p.TLSListenAddr != nil {
+	for _, addr := range p.TLSListenAddr {
 		log.Printf("Creating the TLS server socket")
-		tlsAddr := p.TLSListenAddr
-		tcpListen, err := net.ListenTCP("tcp", tlsAddr)
+		tcpListen, err := net.ListenTCP("tcp", addr)
 		if err != nil {
 			return errorx.Decorate(err, "could not start TLS listener")
 		}
-		p.tlsListen = tls.NewListener(tcpListen, p.TLSConfig)
-		log.Printf("Listening to tls://%s", p.tlsListen.Addr())
+		// The PROXY protocol header is sent before the TLS handshake
+		l := tls.NewListener(p.withProxyProtocol(p.withConnLimit(tcpListen)), p.TLSConfig)
+		p.tlsListen = append(p.tlsListen, l)
+		log.Printf("Listening to tls://%s", l.Addr())
 	}
 
-	if p.HTTPSListenAddr != nil {
+	if len(p.HTTPSListenAddr) != 0 {
 		log.Printf("Creating the HTTPS server")
-		tcpListen, err := net.ListenTCP("tcp", p.HTTPSListenAddr)
+		p.httpsServer = &http.Server{
+			Handler:           p,
+			ReadHeaderTimeout: p.readTimeout,
+			WriteTimeout:      defaultTimeout,
+			IdleTimeout:       p.idleTimeout,
+		}
+	}
+
+	for _, addr := range p.HTTPSListenAddr {
+		tcpListen, err := net.ListenTCP("tcp", addr)
 		if err != nil {
 			return errorx.Decorate(err, "could not start HTTPS listener")
 		}
-		p.httpsListen = tls.NewListener(tcpListen, p.TLSConfig)
-		log.Printf("Listening to https://%s", p.httpsListen.Addr())
-		p.httpsServer = &http.Server{
-			Handler:           p,
-			ReadHeaderTimeout: defaultTimeout,
+		l := tls.NewListener(p.withProxyProtocol(p.withConnLimit(tcpListen)), p.TLSConfig)
+		p.httpsListen = append(p.httpsListen, l)
+		log.Printf("Listening to https://%s", l.Addr())
+	}
+
+	if len(p.HTTPListenAddr) != 0 {
+		log.Printf("Creating the HTTP server")
+		p.httpServer = &http.Server{
+			// h2c allows using HTTP/2 without TLS
+			Handler:           h2c.NewHandler(p, &http2.Server{IdleTimeout: p.idleTimeout}),
+			ReadHeaderTimeout: p.readTimeout,
 			WriteTimeout:      defaultTimeout,
+			IdleTimeout:       p.idleTimeout,
 		}
 	}
 
-	if p.udpListen != nil {
-		go p.udpPacketLoop(p.udpListen)
+	for _, addr := range p.HTTPListenAddr {
+		tcpListen, err := net.ListenTCP("tcp", addr)
+		if err != nil {
+			return errorx.Decorate(err, "could not start HTTP listener")
+		}
+		l := p.withConnLimit(tcpListen)
+		p.httpListen = append(p.httpListen, l)
+		log.Printf("Listening to http://%s", l.Addr())
 	}
 
-	if p.tcpListen != nil {
-		go p.tcpPacketLoop(p.tcpListen, ProtoTCP)
+	for _, addr := range p.QUICListenAddr {
+		err := p.quicCreate(addr)
+		if err != nil {
+			return err
+		}
 	}
 
-	if p.tlsListen != nil {
-		go p.tcpPacketLoop(p.tlsListen, ProtoTLS)
+	if len(p.DNSCryptListenAddr) != 0 {
+		p.dnsCryptServer = &dnscrypt.Server{
+			ProviderName: p.DNSCryptProviderName,
+			ResolverCert: p.DNSCryptResolverCert,
+			Handler:      &dnsCryptHandler{proxy: p},
+		}
 	}
 
-	if p.httpsListen != nil {
-		go p.listenHTTPS()
+	for _, addr := range p.DNSCryptListenAddr {
+		err := p.dnsCryptCreate(addr)
+		if err != nil {
+			return err
+		}
 	}
 
 	return nil
 }
 
+// closeCreatedListeners closes the listeners that createListeners has created before it failed
+// so that Start can be retried. Nothing serves them yet, so they're closed directly.
+func (p *Proxy) closeCreatedListeners() {
+	errs := []error{}
+	for _, l := range p.udpListen {
+		err := l.Close()
+		if err != nil {
+			errs = append(errs, errorx.Decorate(err, "couldn't close UDP listening socket"))
+		}
+	}
+	errs = closeListeners(errs, p.tcpListen, "TCP listening socket")
+	errs = closeListeners(errs, p.tlsListen, "TLS listening socket")
+	errs = closeListeners(errs, p.httpsListen, "HTTPS listening socket")
+	errs = closeListeners(errs, p.httpListen, "HTTP listening socket")
+	for _, l := range p.quicListen {
+		err := l.Close()
+		if err != nil {
+			errs = append(errs, errorx.Decorate(err, "couldn't close QUIC listener"))
+		}
+	}
+	for _, l := range p.dnsCryptUDPListen {
+		err := l.Close()
+		if err != nil {
+			errs = append(errs, errorx.Decorate(err, "couldn't close DNSCrypt UDP listening socket"))
+		}
+	}
+	errs = closeListeners(errs, p.dnsCryptTCPListen, "DNSCrypt TCP listening socket")
+	if len(errs) != 0 {
+		log.Printf("%s", errorx.DecorateMany("Failed to close the listeners", errs...))
+	}
+
+	p.udpListen, p.tcpListen, p.tlsListen = nil, nil, nil
+	p.httpsListen, p.httpsServer, p.httpListen, p.httpServer = nil, nil, nil, nil
+	p.quicListen = nil
+	p.dnsCryptUDPListen, p.dnsCryptTCPListen, p.dnsCryptServer = nil, nil, nil
+}
+
 // tcpPacketLoop listens for incoming TCP packets
 // proto is either "tcp" or "tls"
 func (p *Proxy) tcpPacketLoop(l net.Listener, proto string) {
@@ -726,30 +1160,42 @@ func (p *Proxy) tcpPacketLoop(l net.Listener, proto string) {
 			}
 			log.Printf("got error when reading from TCP listen: %s", err)
 		} else {
-			p.guardMaxGoroutines()
-			go func() {
-				p.handleTCPConnection(clientConn, proto)
-				p.freeMaxGoroutines()
-			}()
+			// MaxGoroutines limits the queries handled by the connection, not the connection itself,
+			// otherwise idle connections could take all the slots
+			go p.handleTCPConnection(clientConn, proto)
 		}
 	}
 }
 
 // handleTCPConnection starts a loop that handles an incoming TCP connection
 // proto is either "tcp" or "tls"
+// Queries are read continuously and resolved concurrently, the responses are written
+// as soon as they are ready so they may come out of order (RFC 7766, section 6.2.1.1).
+// No more than maxTCPInFlightQueries queries are processed at once.
 func (p *Proxy) handleTCPConnection(conn net.Conn, proto string) {
 	log.Tracef("Start handling the new %s connection %s", proto, conn.RemoteAddr())
-	defer conn.Close()
+
+	wg := &sync.WaitGroup{}
+	writeLock := &sync.Mutex{}
+	inFlight := make(chan struct{}, maxTCPInFlightQueries)
+
+	defer func() {
+		// Wait for the pending responses before closing the connection
+		wg.Wait()
+		_ = conn.Close()
+	}()
 
 	for {
 		p.RLock()
-		if !p.started {
+		started := p.started
+		p.RUnlock()
+		if !started {
 			return
 		}
-		p.RUnlock()
 
-		conn.SetDeadline(time.Now().Add(defaultTimeout)) //nolint
-		packet, err := readPrefixed(&conn)
+		// The connection is closed if the client does not send the next query within the idle timeout
+		conn.SetReadDeadline(time.Now().Add(p.idleTimeout)) //nolint
+		packet, err := readPrefixed(&conn, p.readTimeout)
 		if err != nil {
 			return
 		}
@@ -762,24 +1208,50 @@ func (p *Proxy) handleTCPConnection(conn net.Conn, proto string) {
 		}
 
 		d := &DNSContext{
-			Proto: proto,
-			Req:   msg,
-			Addr:  conn.RemoteAddr(),
-			Conn:  conn,
+			Proto:     proto,
+			Req:       msg,
+			Addr:      conn.RemoteAddr(),
+			Conn:      conn,
+			writeLock: writeLock,
+			// edns-tcp-keepalive is a hop-by-hop option so it is not passed to the upstream
+			tcpKeepalive: removeTCPKeepalive(msg),
 		}
 
-		err = p.handleDNSRequest(d)
-		if err != nil {
-			log.Tracef("error handling DNS (%s) request: %s", d.Proto, err)
-		}
+		inFlight <- struct{}{}
+		p.guardMaxGoroutines()
+		wg.Add(1)
+		go func() {
+			defer func() {
+				p.freeMaxGoroutines()
+				<-inFlight
+				wg.Done()
+			}()
+
+			err := p.handleDNSRequest(d)
+			if err != nil {
+				log.Tracef("error handling DNS (%s) request: %s", d.Proto, err)
+			}
+		}()
 	}
 }
 
 // Writes a response to the TCP (or TLS) client
+// The responses to the pipelined queries are written concurrently so the write is guarded by d.writeLock
 func (p *Proxy) respondTCP(d *DNSContext) error {
 	resp := d.Res
 	conn := d.Conn
 
+	// The upstream's keepalive option (if any) is not relevant to the client connection.
+	// Our idle timeout is advertised to the clients that asked for it.
+	removeTCPKeepalive(resp)
+	if d.tcpKeepalive {
+		udpSize := uint16(dns.MinMsgSize)
+		if opt := d.Req.IsEdns0(); opt != nil {
+			udpSize = opt.UDPSize()
+		}
+		setTCPKeepalive(resp, p.idleTimeout, udpSize)
+	}
+
 	bytes, err := resp.Pack()
 	if err != nil {
 		return errorx.Decorate(err, "couldn't convert message into wire format: %s", resp.String())
@@ -790,6 +1262,12 @@ func (p *Proxy) respondTCP(d *DNSContext) error {
 		return errorx.Decorate(err, "couldn't add prefix with size")
 	}
 
+	if d.writeLock != nil {
+		d.writeLock.Lock()
+		defer d.writeLock.Unlock()
+	}
+
+	conn.SetWriteDeadline(time.Now().Add(defaultTimeout)) //nolint
 	n, err := conn.Write(bytes)
 	if n == 0 && isConnClosed(err) {
 		return err
@@ -803,10 +1281,10 @@ func (p *Proxy) respondTCP(d *DNSContext) error {
 	return nil
 }
 
-// serveHttps starts the HTTPS server
-func (p *Proxy) listenHTTPS() {
-	log.Printf("Listening to DNS-over-HTTPS on %s", p.httpsListen.Addr())
-	err := p.httpsServer.Serve(p.httpsListen)
+// listenHTTPS serves DNS-over-HTTPS requests received by the listener
+func (p *Proxy) listenHTTPS(l net.Listener) {
+	log.Printf("Listening to DNS-over-HTTPS on %s", l.Addr())
+	err := p.httpsServer.Serve(l)
 
 	if err != http.ErrServerClosed {
 		log.Printf("HTTPS server was closed unexpectedly: %s", err)
@@ -815,7 +1293,21 @@ func (p *Proxy) listenHTTPS() {
 	}
 }
 
+// listenHTTP serves plain DNS-over-HTTP requests received by the listener
+func (p *Proxy) listenHTTP(l net.Listener) {
+	log.Printf("Listening to DNS-over-HTTP on %s", l.Addr())
+	err := p.httpServer.Serve(l)
+
+	if err != http.ErrServerClosed {
+		log.Printf("HTTP server was closed unexpectedly: %s", err)
+	} else {
+		log.Printf("HTTP server was closed")
+	}
+}
+
 // ServeHTTP is the http.RequestHandler implementation that handles DOH queries
+// Both RFC 8484 (application/dns-message) and JSON API (application/dns-json) requests are supported.
+// JSON API requests are GET requests with the "name" parameter, e.g. ?name=example.org&type=AAAA&do=1&cd=1
 // Here is what it returns:
 // http.StatusBadRequest - if there is no DNS request data
 // http.StatusUnsupportedMediaType - if request content type is not application/dns-message
@@ -824,10 +1316,21 @@ func (p *Proxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	log.Tracef("Incoming HTTPS request on %s", r.URL)
 
 	var buf []byte
+	var msg *dns.Msg
 	var err error
 
 	switch r.Method {
 	case http.MethodGet:
+		if isJSONRequest(r) {
+			msg, err = jsonRequestToMsg(r)
+			if err != nil {
+				log.Tracef("Cannot parse DNS JSON request: %s", err)
+				http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+				return
+			}
+			break
+		}
+
 		dnsParam := r.URL.Query().Get("dns")
 		buf, err = base64.RawURLEncoding.DecodeString(dnsParam)
 		if len(buf) == 0 || err != nil {
@@ -856,20 +1359,29 @@ func (p *Proxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	msg := new(dns.Msg)
-	if err = msg.Unpack(buf); err != nil {
-		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
-		return
+	if msg == nil {
+		msg = new(dns.Msg)
+		if err = msg.Unpack(buf); err != nil {
+			http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+			return
+		}
 	}
 
 	addr, _ := p.remoteAddr(r)
 
+	proto := ProtoHTTPS
+	if r.TLS == nil {
+		proto = ProtoHTTP
+	}
+
 	d := &DNSContext{
-		Proto:              ProtoHTTPS,
+		Proto:              proto,
 		Req:                msg,
 		Addr:               addr,
 		HTTPRequest:        r,
 		HTTPResponseWriter: w,
+		// The upstream query is cancelled if the client hangs up
+		Context: r.Context(),
 	}
 
 	err = p.handleDNSRequest(d)
@@ -879,7 +1391,7 @@ func (p *Proxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 }
 
 // Get a client IP address from HTTP headers that proxy servers may set
-func getIPFromHTTPRequest(r *http.Request) net.IP {
+func (p *Proxy) getIPFromHTTPRequest(r *http.Request) net.IP {
 	names := []string{
 		"CF-Connecting-IP", "True-Client-IP", // set by CloudFlare servers
 		"X-Real-IP",
@@ -892,18 +1404,40 @@ func getIPFromHTTPRequest(r *http.Request) net.IP {
 		}
 	}
 
-	s := r.Header.Get("X-Forwarded-For")
-	s = splitNext(&s, ',') // get left-most IP address
-	ip := net.ParseIP(s)
-	if ip != nil {
-		return ip
+	// The proxies append the address they've received the request from, so everything to the left
+	// of the addresses added by the trusted proxies may be forged by the client
+	var ip net.IP
+	forwarded := r.Header.Values("X-Forwarded-For")
+	for i := len(forwarded) - 1; i >= 0; i-- {
+		addrs := strings.Split(forwarded[i], ",")
+		for j := len(addrs) - 1; j >= 0; j-- {
+			ip = net.ParseIP(strings.TrimSpace(addrs[j]))
+			if ip == nil || !p.isTrustedProxy(ip) {
+				return ip
+			}
+		}
 	}
 
-	return nil
+	// All the addresses belong to the trusted proxies
+	return ip
+}
+
+// isTrustedProxy checks if the specified IP address belongs to one of the TrustedProxies
+func (p *Proxy) isTrustedProxy(ip net.IP) bool {
+	for _, ipNet := range p.trustedProxies {
+		if ipNet.Contains(ip) {
+			return true
+		}
+	}
+	return false
 }
 
 // Writes a response to the DOH client
 func (p *Proxy) respondHTTPS(d *DNSContext) error {
+	if isJSONRequest(d.HTTPRequest) {
+		return p.respondHTTPSJSON(d)
+	}
+
 	resp := d.Res
 	w := d.HTTPResponseWriter
 
@@ -930,13 +1464,17 @@ func (p *Proxy) remoteAddr(r *http.Request) (net.Addr, error) {
 		return nil, err
 	}
 
-	ip := getIPFromHTTPRequest(r)
-	if ip != nil {
-		log.Debug("Using IP address from HTTP request: %s", ip)
-	} else {
-		ip = net.ParseIP(host)
-		if ip == nil {
-			return nil, fmt.Errorf("invalid IP: %s", host)
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return nil, fmt.Errorf("invalid IP: %s", host)
+	}
+
+	// Only trusted reverse proxies are allowed to override the client IP address
+	if p.isTrustedProxy(ip) {
+		realIP := p.getIPFromHTTPRequest(r)
+		if realIP != nil {
+			log.Debug("Using IP address from HTTP request: %s", realIP)
+			ip = realIP
 		}
 	}
 
@@ -1037,8 +1575,12 @@ func (p *Proxy) respond(d *DNSContext) {
 		err = p.respondTCP(d)
 	case ProtoTLS:
 		err = p.respondTCP(d)
-	case ProtoHTTPS:
+	case ProtoHTTPS, ProtoHTTP:
 		err = p.respondHTTPS(d)
+	case ProtoQUIC:
+		err = p.respondQUIC(d)
+	case ProtoDNSCrypt:
+		err = p.respondDNSCrypt(d)
 	default:
 		err = fmt.Errorf("SHOULD NOT HAPPEN - unknown protocol: %s", d.Proto)
 	}
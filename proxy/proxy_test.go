@@ -9,18 +9,24 @@ import (
 	"crypto/tls"
 	"crypto/x509"
 	"crypto/x509/pkix"
+	"encoding/json"
 	"encoding/pem"
 	"io/ioutil"
 	"math/big"
 	"net"
 	"net/http"
+	"net/http/httptest"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
 	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/ameshkov/dnscrypt/v2"
 	"github.com/miekg/dns"
+	"github.com/quic-go/quic-go"
 	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/http2"
 )
 
 const (
@@ -142,6 +148,315 @@ func TestTlsProxy(t *testing.T) {
 	}
 }
 
+func TestHttpProxy(t *testing.T) {
+	// Prepare the proxy server
+	dnsProxy := createTestProxy(t, nil)
+	dnsProxy.HTTPListenAddr = []*net.TCPAddr{{Port: 0, IP: net.ParseIP(listenIP)}}
+	dnsProxy.Upstreams = []upstream.Upstream{createTestUpstream8888()}
+
+	var lock sync.Mutex
+	var clientAddr net.Addr
+	var clientProto string
+	dnsProxy.RequestHandler = func(p *Proxy, d *DNSContext) error {
+		lock.Lock()
+		clientAddr = d.Addr
+		clientProto = d.Proto
+		lock.Unlock()
+		return p.Resolve(d)
+	}
+
+	// Start listening
+	err := dnsProxy.Start()
+	if err != nil {
+		t.Fatalf("cannot start the DNS proxy: %s", err)
+	}
+
+	httpAddr := dnsProxy.Addr(ProtoHTTP)
+	dialer := &net.Dialer{Timeout: defaultTimeout}
+
+	clients := map[string]*http.Client{
+		"HTTP/1.1": {Timeout: defaultTimeout},
+		// h2c - HTTP/2 without TLS
+		"HTTP/2.0": {
+			Timeout: defaultTimeout,
+			Transport: &http2.Transport{
+				AllowHTTP: true,
+				DialTLSContext: func(ctx context.Context, network, addr string, _ *tls.Config) (net.Conn, error) {
+					return dialer.DialContext(ctx, network, addr)
+				},
+			},
+		},
+	}
+
+	for proto, client := range clients {
+		buf, err := createTestMessage().Pack()
+		if err != nil {
+			t.Fatalf("couldn't pack DNS request: %s", err)
+		}
+
+		req, err := http.NewRequest("POST", "http://"+httpAddr.String()+"/dns-query", bytes.NewBuffer(buf))
+		if err != nil {
+			t.Fatalf("couldn't create a new HTTP request: %s", err)
+		}
+		req.Header.Set("Content-Type", "application/dns-message")
+		// The proxy is not trusted so this header must be ignored
+		req.Header.Set("X-Forwarded-For", "1.2.3.4")
+
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatalf("couldn't exec the HTTP request: %s", err)
+		}
+		body, err := ioutil.ReadAll(resp.Body)
+		_ = resp.Body.Close()
+		if err != nil {
+			t.Fatalf("couldn't read the response body: %s", err)
+		}
+		assert.Equal(t, proto, resp.Proto)
+
+		reply := &dns.Msg{}
+		err = reply.Unpack(body)
+		if err != nil {
+			t.Fatalf("invalid DNS response: %s", err)
+		}
+		assertResponse(t, reply)
+
+		lock.Lock()
+		assert.Equal(t, ProtoHTTP, clientProto)
+		assert.Equal(t, listenIP, clientAddr.(*net.TCPAddr).IP.String())
+		lock.Unlock()
+	}
+
+	// Stop the proxy
+	err = dnsProxy.Stop()
+	if err != nil {
+		t.Fatalf("cannot stop the DNS proxy: %s", err)
+	}
+}
+
+func TestHttpTrustedProxies(t *testing.T) {
+	dnsProxy := createTestProxy(t, nil)
+
+	testCases := []struct {
+		name           string
+		trustedProxies []string
+		remoteAddr     string
+		header         string
+		value          string
+		expected       string
+	}{{
+		name:       "not_trusted",
+		remoteAddr: "127.0.0.1:12345",
+		header:     "X-Forwarded-For",
+		value:      "1.2.3.4",
+		expected:   "127.0.0.1",
+	}, {
+		name:           "trusted_ip",
+		trustedProxies: []string{"127.0.0.1"},
+		remoteAddr:     "127.0.0.1:12345",
+		header:         "X-Forwarded-For",
+		value:          "1.2.3.4, 127.0.0.1",
+		expected:       "1.2.3.4",
+	}, {
+		// The client's own X-Forwarded-For is kept by the proxy, only the right-most address can be trusted
+		name:           "spoofed_forwarded_for",
+		trustedProxies: []string{"127.0.0.1"},
+		remoteAddr:     "127.0.0.1:12345",
+		header:         "X-Forwarded-For",
+		value:          "5.6.7.8, 1.2.3.4",
+		expected:       "1.2.3.4",
+	}, {
+		name:           "trusted_proxies_chain",
+		trustedProxies: []string{"127.0.0.1", "10.0.0.0/8"},
+		remoteAddr:     "127.0.0.1:12345",
+		header:         "X-Forwarded-For",
+		value:          "5.6.7.8, 1.2.3.4, 10.0.0.1",
+		expected:       "1.2.3.4",
+	}, {
+		name:           "only_trusted_proxies",
+		trustedProxies: []string{"10.0.0.0/8"},
+		remoteAddr:     "10.0.0.2:12345",
+		header:         "X-Forwarded-For",
+		value:          "10.0.0.1",
+		expected:       "10.0.0.1",
+	}, {
+		name:           "trusted_cidr",
+		trustedProxies: []string{"10.0.0.0/8"},
+		remoteAddr:     "10.1.2.3:12345",
+		header:         "X-Real-IP",
+		value:          "1.2.3.4",
+		expected:       "1.2.3.4",
+	}, {
+		name:           "trusted_ipv6",
+		trustedProxies: []string{"::1"},
+		remoteAddr:     "[::1]:12345",
+		header:         "CF-Connecting-IP",
+		value:          "2001:db8::1",
+		expected:       "2001:db8::1",
+	}, {
+		name:           "other_proxy",
+		trustedProxies: []string{"10.0.0.0/8"},
+		remoteAddr:     "192.168.1.1:12345",
+		header:         "CF-Connecting-IP",
+		value:          "1.2.3.4",
+		expected:       "192.168.1.1",
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			dnsProxy.TrustedProxies = tc.trustedProxies
+			assert.Nil(t, dnsProxy.validateConfig())
+			dnsProxy.Init()
+
+			r := httptest.NewRequest(http.MethodGet, "http://test.com/dns-query", nil)
+			r.RemoteAddr = tc.remoteAddr
+			r.Header.Set(tc.header, tc.value)
+
+			addr, err := dnsProxy.remoteAddr(r)
+			assert.Nil(t, err)
+			assert.Equal(t, tc.expected, addr.(*net.TCPAddr).IP.String())
+		})
+	}
+
+	dnsProxy.TrustedProxies = []string{"invalid"}
+	assert.NotNil(t, dnsProxy.validateConfig())
+}
+
+func TestHttpsProxyJSON(t *testing.T) {
+	dnsProxy := createTestProxy(t, nil)
+	dnsProxy.Upstreams = []upstream.Upstream{createTestUpstream8888()}
+	dnsProxy.Init()
+
+	// Valid JSON API request
+	r := httptest.NewRequest(http.MethodGet, "https://test.com/dns-query?name=google-public-dns-a.google.com&type=A&do=1&cd=true", nil)
+	w := httptest.NewRecorder()
+	dnsProxy.ServeHTTP(w, r)
+
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "application/dns-json", w.Header().Get("Content-Type"))
+
+	resp := &jsonResponse{}
+	err := json.Unmarshal(w.Body.Bytes(), resp)
+	if err != nil {
+		t.Fatalf("cannot unmarshal the JSON response: %s", err)
+	}
+	assert.Equal(t, dns.RcodeSuccess, resp.Status)
+	assert.True(t, resp.RD)
+	assert.True(t, resp.CD)
+	assert.Equal(t, []jsonQuestion{{Name: "google-public-dns-a.google.com.", Type: dns.TypeA}}, resp.Question)
+	assert.Equal(t, []jsonRR{{Name: "google-public-dns-a.google.com.", Type: dns.TypeA, TTL: 60, Data: "8.8.8.8"}}, resp.Answer)
+
+	// Type can be specified as a number
+	r = httptest.NewRequest(http.MethodGet, "https://test.com/dns-query?name=google-public-dns-a.google.com&type=28", nil)
+	msg, err := jsonRequestToMsg(r)
+	assert.Nil(t, err)
+	assert.Equal(t, dns.TypeAAAA, msg.Question[0].Qtype)
+	assert.Nil(t, msg.IsEdns0())
+	assert.False(t, msg.CheckingDisabled)
+
+	// Invalid requests
+	for _, q := range []string{"name=google-public-dns-a.google.com&type=WRONG", "name=..invalid"} {
+		r = httptest.NewRequest(http.MethodGet, "https://test.com/dns-query?"+q, nil)
+		w = httptest.NewRecorder()
+		dnsProxy.ServeHTTP(w, r)
+		assert.Equal(t, http.StatusBadRequest, w.Code, q)
+	}
+}
+
+func TestQuicProxy(t *testing.T) {
+	// Prepare the proxy server
+	serverConfig, caPem := createServerTLSConfig(t)
+	dnsProxy := createTestProxy(t, serverConfig)
+	dnsProxy.Upstreams = []upstream.Upstream{createTestUpstream8888()}
+
+	// Start listening
+	err := dnsProxy.Start()
+	if err != nil {
+		t.Fatalf("cannot start the DNS proxy: %s", err)
+	}
+
+	roots := x509.NewCertPool()
+	roots.AppendCertsFromPEM(caPem)
+	tlsConfig := &tls.Config{ServerName: tlsServerName, RootCAs: roots, NextProtos: []string{NextProtoDQ}}
+
+	// Create a DNS-over-QUIC client connection
+	addr := dnsProxy.Addr(ProtoQUIC)
+	conn, err := quic.DialAddr(context.Background(), addr.String(), tlsConfig, nil)
+	if err != nil {
+		t.Fatalf("cannot connect to the proxy: %s", err)
+	}
+
+	// Every query is sent in its own stream
+	for i := 0; i < testMessagesCount; i++ {
+		req := createTestMessage()
+		req.Id = 0 // DNS message ID must be 0 in DoQ
+
+		res := sendQUICMessage(t, conn, req)
+		assertResponse(t, res)
+	}
+
+	_ = conn.CloseWithError(DoQCodeNoError, "")
+
+	// Stop the proxy
+	err = dnsProxy.Stop()
+	if err != nil {
+		t.Fatalf("cannot stop the DNS proxy: %s", err)
+	}
+}
+
+func TestDNSCryptProxy(t *testing.T) {
+	// Generate the DNSCrypt configuration
+	rc, err := dnscrypt.GenerateResolverConfig("example.org", nil)
+	if err != nil {
+		t.Fatalf("cannot generate DNSCrypt config: %s", err)
+	}
+	cert, err := rc.CreateCert()
+	if err != nil {
+		t.Fatalf("cannot create DNSCrypt certificate: %s", err)
+	}
+
+	// Prepare the proxy server
+	dnsProxy := createTestProxy(t, nil)
+	dnsProxy.Upstreams = []upstream.Upstream{createTestUpstream8888()}
+	dnsProxy.DNSCryptListenAddr = []*net.UDPAddr{{Port: 0, IP: net.ParseIP(listenIP)}}
+	dnsProxy.DNSCryptProviderName = rc.ProviderName
+	dnsProxy.DNSCryptResolverCert = cert
+
+	// Start listening
+	err = dnsProxy.Start()
+	if err != nil {
+		t.Fatalf("cannot start the DNS proxy: %s", err)
+	}
+
+	// Create the DNS stamp for this server
+	addr := dnsProxy.Addr(ProtoDNSCrypt)
+	stamp, err := rc.CreateStamp(addr.String())
+	if err != nil {
+		t.Fatalf("cannot create DNS stamp: %s", err)
+	}
+
+	for _, network := range []string{"udp", "tcp"} {
+		client := &dnscrypt.Client{Net: network, Timeout: defaultTimeout}
+		resolverInfo, err := client.DialStamp(stamp)
+		if err != nil {
+			t.Fatalf("cannot fetch DNSCrypt certificate over %s: %s", network, err)
+		}
+
+		for i := 0; i < testMessagesCount; i++ {
+			res, err := client.Exchange(createTestMessage(), resolverInfo)
+			if err != nil {
+				t.Fatalf("cannot exchange DNSCrypt message over %s: %s", network, err)
+			}
+			assertResponse(t, res)
+		}
+	}
+
+	// Stop the proxy
+	err = dnsProxy.Stop()
+	if err != nil {
+		t.Fatalf("cannot stop the DNS proxy: %s", err)
+	}
+}
+
 func TestUdpProxy(t *testing.T) {
 	// Prepare the proxy server
 	dnsProxy := createTestProxy(t, nil)
@@ -218,7 +533,6 @@ func TestGetUpstreamsForDomain(t *testing.T) {
 }
 
 func TestUpstreamsSort(t *testing.T) {
-	testProxy := createTestProxy(t, nil)
 	upstreams := []upstream.Upstream{}
 
 	// there are 4 upstreams in configuration
@@ -231,14 +545,13 @@ func TestUpstreamsSort(t *testing.T) {
 		upstreams = append(upstreams, up)
 	}
 
-	// create upstreamRttStats for 3 upstreams
-	upstreamRttStats := map[string]int{}
-	upstreamRttStats["1.1.1.1:53"] = 10
-	upstreamRttStats["2.3.4.5:53"] = 20
-	upstreamRttStats["1.2.3.4:53"] = 30
-	testProxy.upstreamRttStats = upstreamRttStats
+	// create latency stats for 3 upstreams
+	selector := NewEWMASelector().(*ewmaSelector)
+	selector.stats[upstreams[1].Address()] = &ewmaStats{latency: 10, queried: true}
+	selector.stats[upstreams[2].Address()] = &ewmaStats{latency: 20, queried: true}
+	selector.stats[upstreams[0].Address()] = &ewmaStats{latency: 30, queried: true}
 
-	sortedUpstreams := testProxy.getSortedUpstreams(upstreams)
+	sortedUpstreams := selector.sorted(upstreams)
 
 	// upstream without rtt stats means `zero rtt`; this upstream should be the first one after sorting
 	if sortedUpstreams[0].Address() != "8.8.8.8:53" {
@@ -551,6 +864,348 @@ func TestTcpProxy(t *testing.T) {
 	}
 }
 
+func TestMultipleListenAddrs(t *testing.T) {
+	dnsProxy := createTestProxy(t, nil)
+	dnsProxy.Upstreams = []upstream.Upstream{createTestUpstream8888()}
+	dnsProxy.UDPListenAddr = []*net.UDPAddr{
+		{Port: 0, IP: net.ParseIP(listenIP)},
+		{Port: 0, IP: net.ParseIP("127.0.0.2")},
+	}
+	dnsProxy.TCPListenAddr = []*net.TCPAddr{
+		{Port: 0, IP: net.ParseIP(listenIP)},
+		{Port: 0, IP: net.ParseIP("127.0.0.2")},
+	}
+
+	err := dnsProxy.Start()
+	if err != nil {
+		t.Fatalf("cannot start the DNS proxy: %s", err)
+	}
+
+	for _, proto := range []string{ProtoUDP, ProtoTCP} {
+		addrs := dnsProxy.Addrs(proto)
+		assert.Equal(t, 2, len(addrs))
+		assert.Equal(t, addrs[0], dnsProxy.Addr(proto))
+
+		for _, addr := range addrs {
+			conn, err := dns.Dial(proto, addr.String())
+			if err != nil {
+				t.Fatalf("cannot connect to the proxy: %s", err)
+			}
+			sendTestMessages(t, conn)
+			_ = conn.Close()
+		}
+	}
+
+	err = dnsProxy.Stop()
+	if err != nil {
+		t.Fatalf("cannot stop the DNS proxy: %s", err)
+	}
+
+	assert.Nil(t, dnsProxy.Addr(ProtoUDP))
+	assert.Empty(t, dnsProxy.Addrs(ProtoTCP))
+}
+
+func TestStartFailureClosesListeners(t *testing.T) {
+	// The port of the UDP listener must be the same on both attempts
+	udpConn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.ParseIP(listenIP)})
+	if err != nil {
+		t.Fatalf("cannot listen: %s", err)
+	}
+	udpAddr := udpConn.LocalAddr().(*net.UDPAddr)
+	_ = udpConn.Close()
+
+	// The second TCP address is busy
+	busy, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.ParseIP(listenIP)})
+	if err != nil {
+		t.Fatalf("cannot listen: %s", err)
+	}
+	busyAddr := busy.Addr().(*net.TCPAddr)
+
+	dnsProxy := createTestProxy(t, nil)
+	dnsProxy.Upstreams = []upstream.Upstream{createTestUpstream8888()}
+	dnsProxy.UDPListenAddr = []*net.UDPAddr{udpAddr}
+	dnsProxy.TCPListenAddr = []*net.TCPAddr{{Port: 0, IP: net.ParseIP(listenIP)}, busyAddr}
+
+	err = dnsProxy.Start()
+	assert.NotNil(t, err)
+	assert.Empty(t, dnsProxy.Addrs(ProtoUDP))
+	assert.Empty(t, dnsProxy.Addrs(ProtoTCP))
+
+	// Start succeeds once the address is free
+	_ = busy.Close()
+	err = dnsProxy.Start()
+	if err != nil {
+		t.Fatalf("cannot start the DNS proxy: %s", err)
+	}
+	assert.Equal(t, udpAddr.String(), dnsProxy.Addr(ProtoUDP).String())
+	assert.Equal(t, 2, len(dnsProxy.Addrs(ProtoTCP)))
+
+	err = dnsProxy.Stop()
+	if err != nil {
+		t.Fatalf("cannot stop the DNS proxy: %s", err)
+	}
+}
+
+// TestTcpProxyPipelining checks that the pipelined queries are resolved concurrently
+// and a slow query does not block the responses to the next ones
+func TestTcpProxyPipelining(t *testing.T) {
+	dnsProxy := createTestProxy(t, nil)
+	dnsProxy.Upstreams = []upstream.Upstream{createTestUpstream8888()}
+	dnsProxy.MaxGoroutines = 10
+	dnsProxy.RequestHandler = func(p *Proxy, d *DNSContext) error {
+		if d.Req.Question[0].Name == "slow.example.org." {
+			time.Sleep(500 * time.Millisecond)
+		}
+		return p.Resolve(d)
+	}
+
+	err := dnsProxy.Start()
+	if err != nil {
+		t.Fatalf("cannot start the DNS proxy: %s", err)
+	}
+
+	conn, err := dns.Dial("tcp", dnsProxy.Addr(ProtoTCP).String())
+	if err != nil {
+		t.Fatalf("cannot connect to the proxy: %s", err)
+	}
+
+	slowReq := createHostTestMessage("slow.example.org")
+	err = conn.WriteMsg(slowReq)
+	if err != nil {
+		t.Fatalf("cannot write message: %s", err)
+	}
+
+	reqs := map[uint16]bool{}
+	for i := 0; i < 20; i++ {
+		req := createTestMessage()
+		reqs[req.Id] = true
+		err = conn.WriteMsg(req)
+		if err != nil {
+			t.Fatalf("cannot write message: %s", err)
+		}
+	}
+
+	// All the fast queries must be answered before the slow one
+	for i := 0; i < 20; i++ {
+		res, err := conn.ReadMsg()
+		if err != nil {
+			t.Fatalf("cannot read response to message: %s", err)
+		}
+		assert.True(t, reqs[res.Id], res.String())
+		delete(reqs, res.Id)
+		assertResponse(t, res)
+	}
+
+	res, err := conn.ReadMsg()
+	if err != nil {
+		t.Fatalf("cannot read response to message: %s", err)
+	}
+	assert.Equal(t, slowReq.Id, res.Id)
+
+	_ = conn.Close()
+
+	err = dnsProxy.Stop()
+	if err != nil {
+		t.Fatalf("cannot stop the DNS proxy: %s", err)
+	}
+}
+
+func TestTcpKeepalive(t *testing.T) {
+	dnsProxy := createTestProxy(t, nil)
+	dnsProxy.Upstreams = []upstream.Upstream{createTestUpstream8888()}
+	dnsProxy.TCPIdleTimeout = 500 * time.Millisecond
+
+	err := dnsProxy.Start()
+	if err != nil {
+		t.Fatalf("cannot start the DNS proxy: %s", err)
+	}
+
+	conn, err := dns.Dial("tcp", dnsProxy.Addr(ProtoTCP).String())
+	if err != nil {
+		t.Fatalf("cannot connect to the proxy: %s", err)
+	}
+
+	// No keepalive option in the query -- no option in the response
+	res := sendTestMessage(t, conn, createTestMessage())
+	assert.Nil(t, res.IsEdns0())
+
+	// The idle timeout is advertised in units of 100 milliseconds
+	req := createTestMessage()
+	req.SetEdns0(dns.DefaultMsgSize, false)
+	opt := req.IsEdns0()
+	opt.Option = append(opt.Option, &dns.EDNS0_LOCAL{Code: dns.EDNS0TCPKEEPALIVE})
+	res = sendTestMessage(t, conn, req)
+	opt = res.IsEdns0()
+	if assert.NotNil(t, opt) && assert.Len(t, opt.Option, 1) {
+		keepalive, ok := opt.Option[0].(*dns.EDNS0_LOCAL)
+		assert.True(t, ok)
+		assert.Equal(t, uint16(dns.EDNS0TCPKEEPALIVE), keepalive.Code)
+		assert.Equal(t, []byte{0, 5}, keepalive.Data)
+	}
+
+	// The connection is closed once the idle timeout has passed
+	time.Sleep(time.Second)
+	err = conn.WriteMsg(createTestMessage())
+	if err == nil {
+		_, err = conn.ReadMsg()
+	}
+	assert.NotNil(t, err)
+	_ = conn.Close()
+
+	err = dnsProxy.Stop()
+	if err != nil {
+		t.Fatalf("cannot stop the DNS proxy: %s", err)
+	}
+}
+
+func TestMaxTCPConnections(t *testing.T) {
+	dnsProxy := createTestProxy(t, nil)
+	dnsProxy.Upstreams = []upstream.Upstream{createTestUpstream8888()}
+	dnsProxy.MaxTCPConnections = 1
+
+	err := dnsProxy.Start()
+	if err != nil {
+		t.Fatalf("cannot start the DNS proxy: %s", err)
+	}
+	addr := dnsProxy.Addr(ProtoTCP).String()
+
+	conn, err := dns.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("cannot connect to the proxy: %s", err)
+	}
+	sendTestMessages(t, conn)
+
+	// The second connection is closed right away
+	conn2, err := dns.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("cannot connect to the proxy: %s", err)
+	}
+	_ = conn2.SetDeadline(time.Now().Add(time.Second))
+	err = conn2.WriteMsg(createTestMessage())
+	if err == nil {
+		_, err = conn2.ReadMsg()
+	}
+	assert.NotNil(t, err)
+	_ = conn2.Close()
+
+	// The slot is freed once the first connection is closed
+	_ = conn.Close()
+	ok := false
+	for i := 0; i < 10 && !ok; i++ {
+		time.Sleep(100 * time.Millisecond)
+		conn, err = dns.Dial("tcp", addr)
+		if err != nil {
+			t.Fatalf("cannot connect to the proxy: %s", err)
+		}
+		_ = conn.SetDeadline(time.Now().Add(time.Second))
+		err = conn.WriteMsg(createTestMessage())
+		if err == nil {
+			_, err = conn.ReadMsg()
+		}
+		ok = err == nil
+		_ = conn.Close()
+	}
+	assert.True(t, ok)
+
+	err = dnsProxy.Stop()
+	if err != nil {
+		t.Fatalf("cannot stop the DNS proxy: %s", err)
+	}
+}
+
+func TestUdpTruncation(t *testing.T) {
+	u := createTestUpstream8888()
+	for i := 0; i < 200; i++ {
+		a := &dns.A{
+			Hdr: dns.RR_Header{Name: "google-public-dns-a.google.com.", Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60},
+			A:   net.IP{10, 0, byte(i / 256), byte(i % 256)},
+		}
+		u.aRespArr = append(u.aRespArr, a)
+	}
+
+	testCases := []struct {
+		name      string
+		maxSize   int    // MaxUDPResponseSize
+		ednsSize  uint16 // client's EDNS UDP size, 0 if there's no OPT record
+		truncated bool
+		size      int // expected maximum response size
+	}{{
+		name:      "no_opt",
+		truncated: true,
+		size:      dns.MinMsgSize,
+	}, {
+		name:      "small_opt",
+		ednsSize:  256,
+		truncated: true,
+		size:      dns.MinMsgSize,
+	}, {
+		name:      "default_limit",
+		ednsSize:  4096,
+		truncated: true,
+		size:      defaultMaxUDPResponseSize,
+	}, {
+		name:      "client_limit",
+		maxSize:   4096,
+		ednsSize:  2048,
+		truncated: true,
+		size:      2048,
+	}, {
+		name:     "fits",
+		maxSize:  8192,
+		ednsSize: 8192,
+		size:     8192,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			dnsProxy := createTestProxy(t, nil)
+			dnsProxy.Upstreams = []upstream.Upstream{&ednsTestUpstream{u}}
+			dnsProxy.MaxUDPResponseSize = tc.maxSize
+
+			err := dnsProxy.Start()
+			if err != nil {
+				t.Fatalf("cannot start the DNS proxy: %s", err)
+			}
+
+			conn, err := dns.Dial("udp", dnsProxy.Addr(ProtoUDP).String())
+			if err != nil {
+				t.Fatalf("cannot connect to the proxy: %s", err)
+			}
+			conn.UDPSize = dns.MaxMsgSize
+
+			req := createTestMessage()
+			if tc.ednsSize > 0 {
+				req.SetEdns0(tc.ednsSize, false)
+			}
+			err = conn.WriteMsg(req)
+			if err != nil {
+				t.Fatalf("cannot write message: %s", err)
+			}
+			res, err := conn.ReadMsg()
+			if err != nil {
+				t.Fatalf("cannot read response to message: %s", err)
+			}
+			_ = conn.Close()
+
+			assert.Equal(t, tc.truncated, res.Truncated)
+			assert.Equal(t, req.Question, res.Question)
+			res.Compress = true
+			assert.True(t, res.Len() <= tc.size)
+			if tc.ednsSize > 0 {
+				assert.NotNil(t, res.IsEdns0())
+			}
+			if !tc.truncated {
+				assert.Equal(t, 201, len(res.Answer))
+			}
+
+			err = dnsProxy.Stop()
+			if err != nil {
+				t.Fatalf("cannot stop the DNS proxy: %s", err)
+			}
+		})
+	}
+}
+
 func TestRefuseAny(t *testing.T) {
 	// Prepare the proxy server
 	dnsProxy := createTestProxy(t, nil)
@@ -628,12 +1283,13 @@ func createTestProxy(t *testing.T, tlsConfig *tls.Config) *Proxy {
 	p := Proxy{}
 
 	if tlsConfig != nil {
-		p.TLSListenAddr = &net.TCPAddr{Port: 0, IP: net.ParseIP(listenIP)}
-		p.HTTPSListenAddr = &net.TCPAddr{Port: 0, IP: net.ParseIP(listenIP)}
+		p.TLSListenAddr = []*net.TCPAddr{{Port: 0, IP: net.ParseIP(listenIP)}}
+		p.HTTPSListenAddr = []*net.TCPAddr{{Port: 0, IP: net.ParseIP(listenIP)}}
+		p.QUICListenAddr = []*net.UDPAddr{{Port: 0, IP: net.ParseIP(listenIP)}}
 		p.TLSConfig = tlsConfig
 	} else {
-		p.UDPListenAddr = &net.UDPAddr{Port: 0, IP: net.ParseIP(listenIP)}
-		p.TCPListenAddr = &net.TCPAddr{Port: 0, IP: net.ParseIP(listenIP)}
+		p.UDPListenAddr = []*net.UDPAddr{{Port: 0, IP: net.ParseIP(listenIP)}}
+		p.TCPListenAddr = []*net.TCPAddr{{Port: 0, IP: net.ParseIP(listenIP)}}
 	}
 	upstreams := make([]upstream.Upstream, 0)
 	dnsUpstream, err := upstream.AddressToUpstream(upstreamAddr, upstream.Options{Timeout: defaultTimeout})
@@ -691,6 +1347,62 @@ func sendTestMessages(t *testing.T, conn *dns.Conn) {
 	}
 }
 
+// sendTestMessage sends the DNS query and reads the response
+func sendTestMessage(t *testing.T, conn *dns.Conn, req *dns.Msg) *dns.Msg {
+	err := conn.WriteMsg(req)
+	if err != nil {
+		t.Fatalf("cannot write message: %s", err)
+	}
+
+	res, err := conn.ReadMsg()
+	if err != nil {
+		t.Fatalf("cannot read response to message: %s", err)
+	}
+	assertResponse(t, res)
+	return res
+}
+
+// sendQUICMessage sends the DNS query in a new QUIC stream and reads the response
+func sendQUICMessage(t *testing.T, conn *quic.Conn, req *dns.Msg) *dns.Msg {
+	stream, err := conn.OpenStreamSync(context.Background())
+	if err != nil {
+		t.Fatalf("cannot open a QUIC stream: %s", err)
+	}
+
+	buf, err := req.Pack()
+	if err != nil {
+		t.Fatalf("couldn't pack DNS request: %s", err)
+	}
+	buf, _ = prefixWithSize(buf)
+	_, err = stream.Write(buf)
+	if err != nil {
+		t.Fatalf("cannot write message: %s", err)
+	}
+	// Closing the write direction indicates that the query is complete
+	_ = stream.Close()
+
+	res, err := readQUICMessage(stream)
+	if err != nil {
+		t.Fatalf("cannot read response: %s", err)
+	}
+
+	reply := &dns.Msg{}
+	err = reply.Unpack(res)
+	if err != nil {
+		t.Fatalf("invalid DNS response: %s", err)
+	}
+	return reply
+}
+
+// createTestUpstream8888 creates a test upstream that responds to every query with 8.8.8.8
+func createTestUpstream8888() *testUpstream {
+	u := &testUpstream{}
+	u.aResp = new(dns.A)
+	u.aResp.Hdr = dns.RR_Header{Name: "google-public-dns-a.google.com.", Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60}
+	u.aResp.A = net.IP{8, 8, 8, 8}
+	return u
+}
+
 func createTestMessage() *dns.Msg {
 	return createHostTestMessage("google-public-dns-a.google.com")
 }
@@ -835,6 +1547,8 @@ type testUpstream struct {
 	ecsIP      net.IP
 	ecsReqIP   net.IP
 	ecsReqMask uint8
+
+	sync.Mutex // protects ecsReqIP and ecsReqMask when the upstream is used concurrently
 }
 
 func (u *testUpstream) Exchange(m *dns.Msg) (*dns.Msg, error) {
@@ -851,7 +1565,9 @@ func (u *testUpstream) Exchange(m *dns.Msg) (*dns.Msg, error) {
 		resp.Answer = append(resp.Answer, a)
 	}
 
+	u.Lock()
 	u.ecsReqIP, u.ecsReqMask, _ = parseECS(m)
+	u.Unlock()
 	if u.ecsIP != nil {
 		_, _ = setECS(&resp, u.ecsIP, 24)
 	}
@@ -863,6 +1579,19 @@ func (u *testUpstream) Address() string {
 	return ""
 }
 
+// ednsTestUpstream adds an OPT record to the response if the request has one
+type ednsTestUpstream struct {
+	*testUpstream
+}
+
+func (u *ednsTestUpstream) Exchange(m *dns.Msg) (*dns.Msg, error) {
+	resp, err := u.testUpstream.Exchange(m)
+	if err == nil && m.IsEdns0() != nil {
+		resp.SetEdns0(m.IsEdns0().UDPSize(), false)
+	}
+	return resp, err
+}
+
 // Resolve the same host with the different client subnet values
 func TestECSProxy(t *testing.T) {
 	dnsProxy := createTestProxy(t, nil)
@@ -1004,3 +1733,60 @@ func TestECSProxyCacheMinMaxTTL(t *testing.T) {
 
 	_ = dnsProxy.Stop()
 }
+
+func TestHostsUpstreamTier(t *testing.T) {
+	path := t.TempDir() + "/hosts"
+	err := ioutil.WriteFile(path, []byte("192.168.1.10 router.lan\n10.0.0.1 nas.lan\n"), 0o644)
+	assert.Nil(t, err)
+
+	config, err := ParseUpstreamsConfig([]string{
+		"hosts://" + path + "?fallthrough=1",
+		"[/nas.lan/]hosts://" + path,
+	}, []string{}, time.Second)
+	assert.Nil(t, err)
+
+	u := &healthTestUpstream{addr: "u"}
+	dnsProxy := createTestProxy(t, nil)
+	dnsProxy.Upstreams = append(config.Upstreams, u)
+	dnsProxy.DomainsReservedUpstreams = config.DomainReservedUpstreams
+	dnsProxy.HealthCheckInterval = time.Hour
+
+	err = dnsProxy.Start()
+	if err != nil {
+		t.Fatalf("cannot start the DNS proxy: %s", err)
+	}
+	defer func() {
+		_ = dnsProxy.Stop()
+	}()
+
+	// The hosts upstreams aren't health checked
+	health := dnsProxy.UpstreamsHealth()
+	assert.Equal(t, 1, len(health))
+	assert.Equal(t, u, health[0].Upstream)
+
+	// The names from the hosts file are answered locally
+	d := &DNSContext{Req: createHostTestMessage("router.lan")}
+	err = dnsProxy.Resolve(d)
+	assert.Nil(t, err)
+	assert.Equal(t, config.Upstreams[0], d.Upstream)
+	assert.Equal(t, net.IPv4(192, 168, 1, 10).To4(), d.Res.Answer[0].(*dns.A).A)
+	assert.Equal(t, int32(0), atomic.LoadInt32(&u.queries))
+
+	// The other names pass through to the remote upstreams
+	d = &DNSContext{Req: createHostTestMessage("test.org")}
+	err = dnsProxy.Resolve(d)
+	assert.Nil(t, err)
+	assert.Equal(t, u, d.Upstream)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&u.queries))
+
+	// The domain-specific hosts upstream without fallthrough
+	d = &DNSContext{Req: createHostTestMessage("nas.lan")}
+	err = dnsProxy.Resolve(d)
+	assert.Nil(t, err)
+	assert.Equal(t, net.IPv4(10, 0, 0, 1).To4(), d.Res.Answer[0].(*dns.A).A)
+	d = &DNSContext{Req: createHostTestMessage("sub.nas.lan")}
+	err = dnsProxy.Resolve(d)
+	assert.Nil(t, err)
+	assert.Equal(t, dns.RcodeNameError, d.Res.Rcode)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&u.queries))
+}
@@ -0,0 +1,271 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/AdguardTeam/golibs/log"
+)
+
+// PROXY protocol (see https://www.haproxy.org/download/2.3/doc/proxy-protocol.txt)
+const (
+	// proxyProtoV1Prefix is the prefix of the human-readable header (v1)
+	proxyProtoV1Prefix = "PROXY "
+	// proxyProtoV1MaxLen is the maximum length of the v1 header including CRLF
+	proxyProtoV1MaxLen = 107
+	// proxyProtoV2HeaderLen is the length of the fixed part of the binary header (v2)
+	proxyProtoV2HeaderLen = 16
+)
+
+// proxyProtoV2Signature is the signature of the binary header (v2)
+var proxyProtoV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// proxyProtoListener is a net.Listener that reads the PROXY protocol header
+// from the connections that come from the trusted sources
+type proxyProtoListener struct {
+	net.Listener
+	trusted []*net.IPNet // connections from these networks may start with the PROXY protocol header
+}
+
+// Accept waits for and returns the next connection to the listener.
+// The header is not read here so that a slow client could not block the listener loop,
+// it is read on the first Read or RemoteAddr call instead.
+func (l *proxyProtoListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+
+	if !l.isTrusted(conn.RemoteAddr()) {
+		return conn, nil
+	}
+
+	return &proxyProtoConn{Conn: conn, r: bufio.NewReader(conn)}, nil
+}
+
+// isTrusted checks if the PROXY protocol header is accepted from this address
+func (l *proxyProtoListener) isTrusted(addr net.Addr) bool {
+	tcpAddr, ok := addr.(*net.TCPAddr)
+	if !ok {
+		return false
+	}
+
+	for _, ipNet := range l.trusted {
+		if ipNet.Contains(tcpAddr.IP) {
+			return true
+		}
+	}
+	return false
+}
+
+// proxyProtoConn is a net.Conn that replaces the remote address
+// with the client address from the PROXY protocol header
+type proxyProtoConn struct {
+	net.Conn
+	r *bufio.Reader // buffered reader, it is used to peek at the header
+
+	once       sync.Once
+	remoteAddr net.Addr // client address from the header (nil if there's no header)
+	err        error    // error that occurred while reading the header
+
+	deadlineLock sync.Mutex
+	readDeadline time.Time // read deadline set by the caller, it's restored after the header is read
+}
+
+// SetDeadline sets the read and write deadlines and remembers the read deadline
+func (c *proxyProtoConn) SetDeadline(t time.Time) error {
+	c.deadlineLock.Lock()
+	defer c.deadlineLock.Unlock()
+	c.readDeadline = t
+	return c.Conn.SetDeadline(t)
+}
+
+// SetReadDeadline sets the read deadline and remembers it
+func (c *proxyProtoConn) SetReadDeadline(t time.Time) error {
+	c.deadlineLock.Lock()
+	defer c.deadlineLock.Unlock()
+	c.readDeadline = t
+	return c.Conn.SetReadDeadline(t)
+}
+
+// Read reads data from the connection skipping the PROXY protocol header
+func (c *proxyProtoConn) Read(b []byte) (int, error) {
+	c.once.Do(c.readHeader)
+	if c.err != nil {
+		return 0, c.err
+	}
+	return c.r.Read(b)
+}
+
+// RemoteAddr returns the client address from the PROXY protocol header
+// or the actual remote address if there's no header
+func (c *proxyProtoConn) RemoteAddr() net.Addr {
+	c.once.Do(c.readHeader)
+	if c.remoteAddr != nil {
+		return c.remoteAddr
+	}
+	return c.Conn.RemoteAddr()
+}
+
+// readHeader reads and parses the PROXY protocol header (if any).
+// The header must be received within defaultTimeout or the caller's read deadline if it's earlier.
+func (c *proxyProtoConn) readHeader() {
+	c.deadlineLock.Lock()
+	deadline := time.Now().Add(defaultTimeout)
+	if !c.readDeadline.IsZero() && c.readDeadline.Before(deadline) {
+		deadline = c.readDeadline
+	}
+	_ = c.Conn.SetReadDeadline(deadline)
+	c.deadlineLock.Unlock()
+
+	defer func() {
+		c.deadlineLock.Lock()
+		_ = c.Conn.SetReadDeadline(c.readDeadline)
+		c.deadlineLock.Unlock()
+	}()
+
+	c.remoteAddr, c.err = readProxyProtoHeader(c.r)
+	if c.err != nil {
+		log.Debug("failed to read the PROXY protocol header from %s: %s", c.Conn.RemoteAddr(), c.err)
+	} else if c.remoteAddr != nil {
+		log.Tracef("PROXY protocol: %s is replaced with %s", c.Conn.RemoteAddr(), c.remoteAddr)
+	}
+}
+
+// readProxyProtoHeader reads the PROXY protocol v1 or v2 header and returns the source address.
+// If there's no header, nothing is consumed from the reader and the returned address is nil.
+// It is also nil if the header does not contain the address (UNKNOWN or LOCAL).
+func readProxyProtoHeader(r *bufio.Reader) (net.Addr, error) {
+	b, err := r.Peek(1)
+	if err != nil {
+		return nil, err
+	}
+
+	switch b[0] {
+	case proxyProtoV1Prefix[0]:
+		b, err = r.Peek(len(proxyProtoV1Prefix))
+		if err == nil && string(b) == proxyProtoV1Prefix {
+			return readProxyProtoV1(r)
+		}
+	case proxyProtoV2Signature[0]:
+		b, err = r.Peek(len(proxyProtoV2Signature))
+		if err == nil && bytes.Equal(b, proxyProtoV2Signature) {
+			return readProxyProtoV2(r)
+		}
+	}
+
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+
+	// Not a PROXY protocol header
+	return nil, nil
+}
+
+// readProxyProtoV1 parses the human-readable header:
+// PROXY TCP4 192.0.2.1 192.0.2.2 56324 443\r\n
+func readProxyProtoV1(r *bufio.Reader) (net.Addr, error) {
+	var line []byte
+	for !bytes.HasSuffix(line, []byte("\r\n")) {
+		if len(line) >= proxyProtoV1MaxLen {
+			return nil, errors.New("v1 header is too long")
+		}
+		c, err := r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		line = append(line, c)
+	}
+
+	fields := strings.Fields(string(line))
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, fmt.Errorf("invalid v1 header: %q", line)
+	}
+
+	ip := net.ParseIP(fields[2])
+	if ip == nil || (fields[1] == "TCP4") != (ip.To4() != nil) {
+		return nil, fmt.Errorf("invalid source address in v1 header: %s", fields[2])
+	}
+	port, err := strconv.ParseUint(fields[4], 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("invalid source port in v1 header: %s", fields[4])
+	}
+
+	return &net.TCPAddr{IP: ip, Port: int(port)}, nil
+}
+
+// readProxyProtoV2 parses the binary header
+func readProxyProtoV2(r *bufio.Reader) (net.Addr, error) {
+	hdr := make([]byte, proxyProtoV2HeaderLen)
+	_, err := io.ReadFull(r, hdr)
+	if err != nil {
+		return nil, err
+	}
+
+	verCmd := hdr[12]
+	fam := hdr[13]
+	length := int(binary.BigEndian.Uint16(hdr[14:]))
+
+	if verCmd>>4 != 2 {
+		return nil, fmt.Errorf("unsupported v2 header version: %d", verCmd>>4)
+	}
+
+	payload := make([]byte, length)
+	_, err = io.ReadFull(r, payload)
+	if err != nil {
+		return nil, err
+	}
+
+	switch verCmd & 0x0F {
+	case 0x0:
+		// LOCAL -- the connection was established by the proxy itself (i.e. a health check)
+		return nil, nil
+	case 0x1:
+		// PROXY
+	default:
+		return nil, fmt.Errorf("unsupported v2 command: %d", verCmd&0x0F)
+	}
+
+	switch fam {
+	case 0x11:
+		// TCP over IPv4: src_addr(4), dst_addr(4), src_port(2), dst_port(2)
+		if length < 12 {
+			return nil, errors.New("v2 header is too short for TCP over IPv4")
+		}
+		ip := net.IP(payload[0:4])
+		port := binary.BigEndian.Uint16(payload[8:10])
+		return &net.TCPAddr{IP: ip, Port: int(port)}, nil
+	case 0x21:
+		// TCP over IPv6: src_addr(16), dst_addr(16), src_port(2), dst_port(2)
+		if length < 36 {
+			return nil, errors.New("v2 header is too short for TCP over IPv6")
+		}
+		ip := net.IP(payload[0:16])
+		port := binary.BigEndian.Uint16(payload[32:34])
+		return &net.TCPAddr{IP: ip, Port: int(port)}, nil
+	default:
+		// UNSPEC and other families -- keep the original address
+		return nil, nil
+	}
+}
+
+// withProxyProtocol wraps the listener so that it reads the PROXY protocol header
+// if ProxyProtocolTrustedNets are configured
+func (p *Proxy) withProxyProtocol(l net.Listener) net.Listener {
+	if len(p.proxyProtoTrusted) == 0 {
+		return l
+	}
+	return &proxyProtoListener{Listener: l, trusted: p.proxyProtoTrusted}
+}
@@ -0,0 +1,250 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/binary"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReadProxyProtoHeader(t *testing.T) {
+	testCases := []struct {
+		name     string
+		data     []byte
+		expected string // expected source address, empty if nil
+		wantErr  bool
+		rest     string // what should be left in the reader
+	}{{
+		name:     "v1_tcp4",
+		data:     []byte("PROXY TCP4 1.2.3.4 5.6.7.8 56324 443\r\nhello"),
+		expected: "1.2.3.4:56324",
+		rest:     "hello",
+	}, {
+		name:     "v1_tcp6",
+		data:     []byte("PROXY TCP6 2001:db8::1 2001:db8::2 56324 443\r\nhello"),
+		expected: "[2001:db8::1]:56324",
+		rest:     "hello",
+	}, {
+		name: "v1_unknown",
+		data: []byte("PROXY UNKNOWN\r\nhello"),
+		rest: "hello",
+	}, {
+		name:    "v1_invalid",
+		data:    []byte("PROXY TCP4 1.2.3.4\r\nhello"),
+		wantErr: true,
+	}, {
+		name:    "v1_ip_mismatch",
+		data:    []byte("PROXY TCP4 2001:db8::1 2001:db8::2 56324 443\r\nhello"),
+		wantErr: true,
+	}, {
+		name:    "v1_too_long",
+		data:    append([]byte("PROXY TCP4 "), bytes.Repeat([]byte("1"), 200)...),
+		wantErr: true,
+	}, {
+		name:     "v2_tcp4",
+		data:     append(createProxyProtoV2Header(0x1, 0x11, net.IP{1, 2, 3, 4}, 56324), []byte("hello")...),
+		expected: "1.2.3.4:56324",
+		rest:     "hello",
+	}, {
+		name:     "v2_tcp6",
+		data:     append(createProxyProtoV2Header(0x1, 0x21, net.ParseIP("2001:db8::1"), 56324), []byte("hello")...),
+		expected: "[2001:db8::1]:56324",
+		rest:     "hello",
+	}, {
+		name: "v2_local",
+		data: append(createProxyProtoV2Header(0x0, 0x11, net.IP{1, 2, 3, 4}, 56324), []byte("hello")...),
+		rest: "hello",
+	}, {
+		name:    "v2_invalid_command",
+		data:    append(createProxyProtoV2Header(0x5, 0x11, net.IP{1, 2, 3, 4}, 56324), []byte("hello")...),
+		wantErr: true,
+	}, {
+		name: "no_header",
+		data: []byte("hello"),
+		rest: "hello",
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			r := bufio.NewReader(bytes.NewReader(tc.data))
+			addr, err := readProxyProtoHeader(r)
+			if tc.wantErr {
+				assert.NotNil(t, err)
+				return
+			}
+
+			assert.Nil(t, err)
+			if tc.expected == "" {
+				assert.Nil(t, addr)
+			} else {
+				assert.Equal(t, tc.expected, addr.String())
+			}
+
+			rest := make([]byte, len(tc.rest))
+			_, _ = r.Read(rest)
+			assert.Equal(t, tc.rest, string(rest))
+		})
+	}
+}
+
+func TestTcpProxyProtocol(t *testing.T) {
+	serverConfig, caPem := createServerTLSConfig(t)
+	dnsProxy := createTestProxy(t, serverConfig)
+	dnsProxy.Upstreams = []upstream.Upstream{createTestUpstream8888()}
+	dnsProxy.TCPListenAddr = []*net.TCPAddr{{Port: 0, IP: net.ParseIP(listenIP)}}
+	dnsProxy.ProxyProtocolTrustedNets = []string{"127.0.0.0/8"}
+
+	var lock sync.Mutex
+	var clientAddr net.Addr
+	dnsProxy.RequestHandler = func(p *Proxy, d *DNSContext) error {
+		lock.Lock()
+		clientAddr = d.Addr
+		lock.Unlock()
+		return p.Resolve(d)
+	}
+
+	err := dnsProxy.Start()
+	if err != nil {
+		t.Fatalf("cannot start the DNS proxy: %s", err)
+	}
+
+	roots := x509.NewCertPool()
+	roots.AppendCertsFromPEM(caPem)
+	tlsConfig := &tls.Config{ServerName: tlsServerName, RootCAs: roots}
+
+	for _, proto := range []string{ProtoTCP, ProtoTLS} {
+		conn, err := net.Dial("tcp", dnsProxy.Addr(proto).String())
+		if err != nil {
+			t.Fatalf("cannot connect to the proxy: %s", err)
+		}
+
+		// The header is sent before anything else, including the TLS handshake
+		_, err = conn.Write([]byte("PROXY TCP4 1.2.3.4 5.6.7.8 56324 53\r\n"))
+		if err != nil {
+			t.Fatalf("cannot write the PROXY protocol header: %s", err)
+		}
+		if proto == ProtoTLS {
+			conn = tls.Client(conn, tlsConfig)
+		}
+
+		dnsConn := &dns.Conn{Conn: conn}
+		sendTestMessages(t, dnsConn)
+		_ = dnsConn.Close()
+
+		lock.Lock()
+		assert.Equal(t, "1.2.3.4:56324", clientAddr.String(), proto)
+		lock.Unlock()
+	}
+
+	// Connection without the header from a trusted network is still accepted
+	conn, err := dns.Dial("tcp", dnsProxy.Addr(ProtoTCP).String())
+	if err != nil {
+		t.Fatalf("cannot connect to the proxy: %s", err)
+	}
+	sendTestMessages(t, conn)
+	_ = conn.Close()
+	lock.Lock()
+	assert.Equal(t, listenIP, clientAddr.(*net.TCPAddr).IP.String())
+	lock.Unlock()
+
+	err = dnsProxy.Stop()
+	if err != nil {
+		t.Fatalf("cannot stop the DNS proxy: %s", err)
+	}
+}
+
+func TestTcpProxyProtocolNotTrusted(t *testing.T) {
+	dnsProxy := createTestProxy(t, nil)
+	dnsProxy.Upstreams = []upstream.Upstream{createTestUpstream8888()}
+	dnsProxy.ProxyProtocolTrustedNets = []string{"10.0.0.0/8"}
+
+	err := dnsProxy.Start()
+	if err != nil {
+		t.Fatalf("cannot start the DNS proxy: %s", err)
+	}
+
+	conn, err := net.Dial("tcp", dnsProxy.Addr(ProtoTCP).String())
+	if err != nil {
+		t.Fatalf("cannot connect to the proxy: %s", err)
+	}
+
+	// The header from an untrusted source is not parsed so the query is broken
+	_, _ = conn.Write([]byte("PROXY TCP4 1.2.3.4 5.6.7.8 56324 53\r\n"))
+	_ = conn.SetDeadline(time.Now().Add(time.Second))
+	dnsConn := &dns.Conn{Conn: conn}
+	err = dnsConn.WriteMsg(createTestMessage())
+	assert.Nil(t, err)
+	_, err = dnsConn.ReadMsg()
+	assert.NotNil(t, err)
+	_ = dnsConn.Close()
+
+	err = dnsProxy.Stop()
+	if err != nil {
+		t.Fatalf("cannot stop the DNS proxy: %s", err)
+	}
+}
+
+func TestProxyProtoConnDeadline(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("cannot listen: %s", err)
+	}
+	defer l.Close()
+	pl := &proxyProtoListener{Listener: l, trusted: parseIPNets([]string{"127.0.0.1"})}
+
+	for _, data := range []string{"PROXY TCP4 1.2.3.4 5.6.7.8 56324 53\r\n", ""} {
+		client, err := net.Dial("tcp", l.Addr().String())
+		if err != nil {
+			t.Fatalf("cannot connect: %s", err)
+		}
+		_, _ = client.Write([]byte(data))
+
+		conn, err := pl.Accept()
+		if err != nil {
+			t.Fatalf("cannot accept: %s", err)
+		}
+
+		// The caller's deadline applies both to the header and to the data after it
+		_ = conn.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+		start := time.Now()
+		_, err = conn.Read(make([]byte, 1))
+		if assert.NotNil(t, err) {
+			netErr, ok := err.(net.Error)
+			assert.True(t, ok && netErr.Timeout(), err)
+		}
+		assert.Less(t, time.Since(start), time.Second)
+
+		_ = client.Close()
+		_ = conn.Close()
+	}
+}
+
+// createProxyProtoV2Header creates a PROXY protocol v2 header with the specified source address
+func createProxyProtoV2Header(cmd, fam byte, ip net.IP, port uint16) []byte {
+	var addrs []byte
+	if fam == 0x11 {
+		addrs = append(addrs, ip.To4()...)
+		addrs = append(addrs, net.IP{127, 0, 0, 1}...)
+	} else {
+		addrs = append(addrs, ip.To16()...)
+		addrs = append(addrs, net.IPv6loopback...)
+	}
+	ports := make([]byte, 4)
+	binary.BigEndian.PutUint16(ports, port)
+	binary.BigEndian.PutUint16(ports[2:], 53)
+	addrs = append(addrs, ports...)
+
+	hdr := append([]byte{}, proxyProtoV2Signature...)
+	hdr = append(hdr, 0x20|cmd, fam, 0, 0)
+	binary.BigEndian.PutUint16(hdr[14:], uint16(len(addrs)))
+	return append(hdr, addrs...)
+}
@@ -0,0 +1,551 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"hash/fnv"
+	"math/rand"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/AdguardTeam/dnsproxy/fastip"
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/AdguardTeam/golibs/utils"
+	"github.com/joomcode/errorx"
+	"github.com/miekg/dns"
+)
+
+const (
+	// UpstreamModeEWMA selects the upstream with the lowest latency EWMA out of two random ones (power of two choices)
+	UpstreamModeEWMA = "ewma"
+	// UpstreamModeRoundRobin selects the upstreams using the weighted round-robin
+	UpstreamModeRoundRobin = "round-robin"
+	// UpstreamModeHash selects the upstream by the consistent hash of the queried name
+	UpstreamModeHash = "hash"
+	// UpstreamModeParallel queries all the upstreams in parallel and uses the first response
+	UpstreamModeParallel = "parallel"
+	// UpstreamModeFastestAddr queries all the upstreams and responds with the fastest IP address to A and AAAA queries
+	UpstreamModeFastestAddr = "fastest"
+)
+
+const (
+	ewmaDecay       = 0.3 // weight of the new latency sample in the EWMA
+	hashVirtualNode = 100 // number of the consistent hashing ring points per upstream
+	maxHashRings    = 256 // maximum number of the cached consistent hashing rings
+)
+
+// UpstreamSelector chooses the upstreams to query out of a group and sends the DNS request to them.
+// The upstreams passed to Exchange are not empty and do not include the ones that are marked down.
+type UpstreamSelector interface {
+	// Exchange sends the request to the upstreams chosen out of the specified ones.
+	// It returns the response and the upstream that has answered.
+	Exchange(ctx context.Context, req *dns.Msg, upstreams []upstream.Upstream) (*dns.Msg, upstream.Upstream, error)
+}
+
+// NewUpstreamSelector creates a new built-in upstream selector for the mode (one of the UpstreamMode constants)
+func NewUpstreamSelector(mode string) (UpstreamSelector, error) {
+	switch mode {
+	case UpstreamModeEWMA:
+		return NewEWMASelector(), nil
+	case UpstreamModeRoundRobin:
+		return NewWeightedRoundRobinSelector(), nil
+	case UpstreamModeHash:
+		return NewConsistentHashSelector(), nil
+	case UpstreamModeParallel:
+		return NewParallelSelector(), nil
+	case UpstreamModeFastestAddr:
+		return NewFastestAddrSelector(NewEWMASelector()), nil
+	}
+	return nil, fmt.Errorf("unknown upstream mode: %s", mode)
+}
+
+// ParseUpstreamSelectors parses the upstream modes configuration
+// default mode syntax: <mode>
+// reserved domains mode syntax: [/domain1/../domainN/]<mode>
+// The domains are the same as in the upstreams configuration (see ParseUpstreamsConfig).
+// Returns the selector for the default upstreams (nil if it isn't specified) and the selectors for the reserved domains.
+func ParseUpstreamSelectors(modes []string) (UpstreamSelector, map[string]UpstreamSelector, error) {
+	var selector UpstreamSelector
+	domainSelectors := map[string]UpstreamSelector{}
+
+	for _, m := range modes {
+		hosts := []string{}
+		if strings.HasPrefix(m, "[/") {
+			domainsAndMode := strings.Split(strings.TrimPrefix(m, "[/"), "/]")
+			if len(domainsAndMode) != 2 {
+				return nil, nil, fmt.Errorf("wrong upstream mode specification: %s", m)
+			}
+
+			for _, host := range strings.Split(domainsAndMode[0], "/") {
+				if host != "" {
+					if err := utils.IsValidHostname(host); err != nil {
+						return nil, nil, err
+					}
+					hosts = append(hosts, strings.ToLower(host+"."))
+				} else {
+					hosts = append(hosts, UnqualifiedNames)
+				}
+			}
+			m = domainsAndMode[1]
+		}
+
+		s, err := NewUpstreamSelector(m)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		if len(hosts) == 0 {
+			selector = s
+			continue
+		}
+		// The domains specified together share the selector as they share the upstreams
+		for _, host := range hosts {
+			domainSelectors[host] = s
+		}
+	}
+
+	return selector, domainSelectors, nil
+}
+
+// upstreamTracker is notified about the queries sent by exchangeInOrder
+type upstreamTracker interface {
+	// start is called before the query is sent to the upstream
+	start(u upstream.Upstream)
+	// finish is called with the result of the query, err is ctx.Err() if the query has been cancelled
+	finish(u upstream.Upstream, elapsed int, err error)
+}
+
+// exchangeInOrder tries the upstreams one by one until one of them responds
+// tracker may be nil
+func exchangeInOrder(ctx context.Context, req *dns.Msg, upstreams []upstream.Upstream, tracker upstreamTracker) (*dns.Msg, upstream.Upstream, error) {
+	errs := []error{}
+	for _, u := range upstreams {
+		if tracker != nil {
+			tracker.start(u)
+		}
+		reply, elapsed, err := exchangeWithUpstream(ctx, u, req)
+		if ctx.Err() != nil {
+			// The request is cancelled, that's not the upstream's fault
+			err = ctx.Err()
+		}
+		if tracker != nil {
+			tracker.finish(u, elapsed, err)
+		}
+		if err == nil {
+			return reply, u, nil
+		}
+		if ctx.Err() != nil {
+			return nil, nil, ctx.Err()
+		}
+		errs = append(errs, err)
+	}
+	return nil, nil, errorx.DecorateMany("all upstreams failed to exchange request", errs...)
+}
+
+// upstreamKeys returns the keys the selectors keep the upstreams' state by.
+// The key is the upstream address so that the custom upstreams created for every request (DNSContext.Upstreams)
+// share the state instead of adding new entries. The upstreams with the same address but different options
+// (e.g. "tls://dns.example?ip=1.2.3.4" and "tls://dns.example?ip=5.6.7.8") are told apart by their order in the group.
+func upstreamKeys(upstreams []upstream.Upstream) map[upstream.Upstream]string {
+	keys := make(map[upstream.Upstream]string, len(upstreams))
+	seen := map[string]int{}
+	for _, u := range upstreams {
+		if _, ok := keys[u]; ok {
+			continue
+		}
+		addr := u.Address()
+		seen[addr]++
+		if seen[addr] == 1 {
+			keys[u] = addr
+		} else {
+			keys[u] = fmt.Sprintf("%s#%d", addr, seen[addr])
+		}
+	}
+	return keys
+}
+
+//
+// EWMA
+//
+
+// ewmaSelector chooses the upstream with the lower latency EWMA out of two random ones (power of two choices).
+// Unlike always choosing the fastest one, it does not make all the traffic herd onto a single upstream.
+// The statistics are kept by the upstream keys (see upstreamKeys).
+type ewmaSelector struct {
+	stats map[string]*ewmaStats
+	rand  *rand.Rand
+	lock  sync.Mutex // protects stats and rand
+}
+
+// ewmaStats is the upstream's latency statistics
+type ewmaStats struct {
+	latency  float64 // EWMA of the latency in milliseconds
+	queried  bool    // false if the upstream hasn't answered or failed yet
+	inflight int     // number of the queries in progress
+}
+
+// NewEWMASelector creates a new selector that chooses the upstream with the lower latency EWMA
+// out of two random ones (power of two choices). The other upstreams are tried from the fastest to the slowest if it fails.
+func NewEWMASelector() UpstreamSelector {
+	return &ewmaSelector{
+		stats: map[string]*ewmaStats{},
+		rand:  rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+}
+
+// Exchange implements the UpstreamSelector interface for *ewmaSelector
+func (s *ewmaSelector) Exchange(ctx context.Context, req *dns.Msg, upstreams []upstream.Upstream) (*dns.Msg, upstream.Upstream, error) {
+	keys := upstreamKeys(upstreams)
+	return exchangeInOrder(ctx, req, s.order(upstreams, keys), ewmaTracker{selector: s, keys: keys})
+}
+
+// ewmaTracker updates the statistics of the upstreams queried by a single Exchange
+type ewmaTracker struct {
+	selector *ewmaSelector
+	keys     map[upstream.Upstream]string // the upstream keys (see upstreamKeys)
+}
+
+// start implements the upstreamTracker interface for ewmaTracker
+func (t ewmaTracker) start(u upstream.Upstream) {
+	t.selector.start(t.keys[u])
+}
+
+// finish implements the upstreamTracker interface for ewmaTracker
+func (t ewmaTracker) finish(u upstream.Upstream, elapsed int, err error) {
+	t.selector.finish(t.keys[u], elapsed, err)
+}
+
+// order returns the upstreams in the order they should be tried
+func (s *ewmaSelector) order(upstreams []upstream.Upstream, keys map[upstream.Upstream]string) []upstream.Upstream {
+	sorted := s.sortedByKeys(upstreams, keys)
+	if len(sorted) < 2 {
+		return sorted
+	}
+
+	// Choose the best one out of two random upstreams and try it first
+	s.lock.Lock()
+	i := s.rand.Intn(len(upstreams))
+	j := s.rand.Intn(len(upstreams) - 1)
+	s.lock.Unlock()
+	if j >= i {
+		j++
+	}
+	first := upstreams[i]
+	if s.score(keys[upstreams[j]]) < s.score(keys[first]) {
+		first = upstreams[j]
+	}
+
+	ordered := make([]upstream.Upstream, 0, len(sorted))
+	ordered = append(ordered, first)
+	for _, u := range sorted {
+		if u != first {
+			ordered = append(ordered, u)
+		}
+	}
+	return ordered
+}
+
+// sorted returns a copy of the upstreams sorted from the fastest to the slowest
+func (s *ewmaSelector) sorted(upstreams []upstream.Upstream) []upstream.Upstream {
+	return s.sortedByKeys(upstreams, upstreamKeys(upstreams))
+}
+
+// sortedByKeys is sorted with the upstream keys already known
+func (s *ewmaSelector) sortedByKeys(upstreams []upstream.Upstream, keys map[upstream.Upstream]string) []upstream.Upstream {
+	sorted := make([]upstream.Upstream, len(upstreams))
+	copy(sorted, upstreams)
+
+	scores := map[upstream.Upstream]float64{}
+	for _, u := range sorted {
+		scores[u] = s.score(keys[u])
+	}
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return scores[sorted[i]] < scores[sorted[j]]
+	})
+	return sorted
+}
+
+// score returns the upstream's expected cost, the lower is the better.
+// The latency is multiplied by the number of the queries in progress so that a busy upstream was chosen less often.
+func (s *ewmaSelector) score(key string) float64 {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	st, ok := s.stats[key]
+	if !ok {
+		// The upstreams that haven't been queried yet are tried first
+		return 0
+	}
+	// Add a millisecond so that the busy upstreams were penalized even if their latency is zero
+	return (st.latency + 1) * float64(st.inflight+1)
+}
+
+// start counts the query to the upstream with the key as in progress
+func (s *ewmaSelector) start(key string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	st, ok := s.stats[key]
+	if !ok {
+		st = &ewmaStats{}
+		s.stats[key] = st
+	}
+	st.inflight++
+}
+
+// finish updates the latency EWMA of the upstream with the key, the failures count as the query timeout
+func (s *ewmaSelector) finish(key string, elapsed int, err error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	st := s.stats[key]
+	st.inflight--
+
+	if err == context.Canceled || err == context.DeadlineExceeded {
+		// The query has been cancelled, its latency is unknown
+		return
+	}
+
+	sample := float64(elapsed)
+	if err != nil {
+		sample = float64(defaultTimeout / time.Millisecond)
+	}
+	if !st.queried {
+		st.latency = sample
+		st.queried = true
+		return
+	}
+	st.latency = ewmaDecay*sample + (1-ewmaDecay)*st.latency
+}
+
+//
+// Weighted round-robin
+//
+
+// weightedRoundRobinSelector distributes the queries between the upstreams proportionally to their weights
+// using the smooth weighted round-robin algorithm
+type weightedRoundRobinSelector struct {
+	current map[string]int // current weights by the upstream key (see upstreamKeys)
+	lock    sync.Mutex     // protects current
+}
+
+// NewWeightedRoundRobinSelector creates a new selector that distributes the queries between the upstreams
+// proportionally to their weights. The weight is specified in the upstream configuration (see ParseUpstreamsConfig),
+// a custom upstream may specify it by implementing the "Weight() int" method. The default weight is 1.
+// If the chosen upstream fails, the others are tried from the heaviest to the lightest.
+func NewWeightedRoundRobinSelector() UpstreamSelector {
+	return &weightedRoundRobinSelector{
+		current: map[string]int{},
+	}
+}
+
+// Exchange implements the UpstreamSelector interface for *weightedRoundRobinSelector
+func (s *weightedRoundRobinSelector) Exchange(ctx context.Context, req *dns.Msg, upstreams []upstream.Upstream) (*dns.Msg, upstream.Upstream, error) {
+	first := s.next(upstreams)
+
+	ordered := make([]upstream.Upstream, 0, len(upstreams))
+	ordered = append(ordered, first)
+	for _, u := range upstreams {
+		if u != first {
+			ordered = append(ordered, u)
+		}
+	}
+	sort.SliceStable(ordered[1:], func(i, j int) bool {
+		return upstreamWeight(ordered[i+1]) > upstreamWeight(ordered[j+1])
+	})
+
+	return exchangeInOrder(ctx, req, ordered, nil)
+}
+
+// next chooses the next upstream
+func (s *weightedRoundRobinSelector) next(upstreams []upstream.Upstream) upstream.Upstream {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	keys := upstreamKeys(upstreams)
+	var best upstream.Upstream
+	total := 0
+	for _, u := range upstreams {
+		w := upstreamWeight(u)
+		total += w
+		s.current[keys[u]] += w
+		if best == nil || s.current[keys[u]] > s.current[keys[best]] {
+			best = u
+		}
+	}
+	s.current[keys[best]] -= total
+	return best
+}
+
+// weightedUpstream is an upstream with the weight for the weighted round-robin selection
+type weightedUpstream struct {
+	upstream.Upstream
+	weight int
+}
+
+// Weight returns the upstream weight
+func (u *weightedUpstream) Weight() int {
+	return u.weight
+}
+
+// ExchangeContext implements the upstream.ContextUpstream interface for *weightedUpstream
+func (u *weightedUpstream) ExchangeContext(ctx context.Context, m *dns.Msg) (*dns.Msg, error) {
+	return upstream.ExchangeContext(ctx, u.Upstream, m)
+}
+
+// upstreamWeight returns the upstream's weight, 1 if it isn't specified
+func upstreamWeight(u upstream.Upstream) int {
+	if w, ok := u.(interface{ Weight() int }); ok && w.Weight() > 0 {
+		return w.Weight()
+	}
+	return 1
+}
+
+//
+// Consistent hashing
+//
+
+// consistentHashSelector sends the queries for the same name to the same upstream
+// so that the upstreams' caches were used efficiently
+type consistentHashSelector struct {
+	rings map[string]*hashRing // rings by the upstream keys (see upstreamKeys), at most maxHashRings
+	lock  sync.Mutex           // protects rings
+}
+
+// hashRing is the consistent hashing ring.
+// It refers to the upstreams by their indexes so that it could be shared by the groups with the same keys.
+type hashRing struct {
+	points  []uint32       // sorted ring points
+	indexes map[uint32]int // upstream indexes by the ring points
+}
+
+// NewConsistentHashSelector creates a new selector that chooses the upstream by the consistent hash of the queried name.
+// The queries for the same name go to the same upstream, so the upstreams' caches are used efficiently.
+// If the upstream fails, the next ones on the ring are tried.
+func NewConsistentHashSelector() UpstreamSelector {
+	return &consistentHashSelector{
+		rings: map[string]*hashRing{},
+	}
+}
+
+// Exchange implements the UpstreamSelector interface for *consistentHashSelector
+func (s *consistentHashSelector) Exchange(ctx context.Context, req *dns.Msg, upstreams []upstream.Upstream) (*dns.Msg, upstream.Upstream, error) {
+	ring := s.ring(upstreams)
+	name := strings.ToLower(req.Question[0].Name)
+	return exchangeInOrder(ctx, req, ring.lookup(hashString(name), upstreams), nil)
+}
+
+// ring returns the ring for the upstreams
+// The rings are cached since the same upstream groups are used over and over
+func (s *consistentHashSelector) ring(upstreams []upstream.Upstream) *hashRing {
+	keys := upstreamKeys(upstreams)
+	addrs := make([]string, 0, len(upstreams))
+	for _, u := range upstreams {
+		addrs = append(addrs, keys[u])
+	}
+	key := strings.Join(addrs, " ")
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	ring, ok := s.rings[key]
+	if ok {
+		return ring
+	}
+
+	ring = &hashRing{indexes: map[uint32]int{}}
+	for idx, addr := range addrs {
+		for i := 0; i < hashVirtualNode; i++ {
+			point := hashString(fmt.Sprintf("%s#%d", addr, i))
+			if _, ok := ring.indexes[point]; ok {
+				// Hash collision, this point is already taken
+				continue
+			}
+			ring.indexes[point] = idx
+			ring.points = append(ring.points, point)
+		}
+	}
+	sort.Slice(ring.points, func(i, j int) bool {
+		return ring.points[i] < ring.points[j]
+	})
+
+	// The custom upstreams may come in any combination, so the cache is bounded
+	if len(s.rings) >= maxHashRings {
+		s.rings = map[string]*hashRing{}
+	}
+	s.rings[key] = ring
+	return ring
+}
+
+// lookup returns the upstreams in the order they follow the hash on the ring.
+// upstreams must have the same keys the ring has been built for.
+func (r *hashRing) lookup(hash uint32, upstreams []upstream.Upstream) []upstream.Upstream {
+	res := make([]upstream.Upstream, 0, len(upstreams))
+	seen := map[int]bool{}
+
+	start := sort.Search(len(r.points), func(i int) bool {
+		return r.points[i] >= hash
+	})
+	for i := 0; i < len(r.points) && len(res) < len(upstreams); i++ {
+		idx := r.indexes[r.points[(start+i)%len(r.points)]]
+		if !seen[idx] {
+			seen[idx] = true
+			res = append(res, upstreams[idx])
+		}
+	}
+	return res
+}
+
+// hashString returns the FNV-1a hash of the string
+func hashString(s string) uint32 {
+	h := fnv.New32a()
+	_, _ = h.Write([]byte(s))
+	return h.Sum32()
+}
+
+//
+// Parallel
+//
+
+// parallelSelector queries all the upstreams in parallel
+type parallelSelector struct{}
+
+// NewParallelSelector creates a new selector that queries all the upstreams in parallel and uses the first response
+func NewParallelSelector() UpstreamSelector {
+	return parallelSelector{}
+}
+
+// Exchange implements the UpstreamSelector interface for parallelSelector
+func (parallelSelector) Exchange(ctx context.Context, req *dns.Msg, upstreams []upstream.Upstream) (*dns.Msg, upstream.Upstream, error) {
+	return upstream.ExchangeParallelContext(ctx, upstreams, req)
+}
+
+//
+// Fastest address
+//
+
+// fastestAddrSelector responds to A and AAAA queries with the fastest IP address
+type fastestAddrSelector struct {
+	fastestAddr *fastip.FastestAddr
+	fallback    UpstreamSelector // used for the other queries
+}
+
+// NewFastestAddrSelector creates a new selector that queries all the upstreams and responds to A and AAAA queries
+// with the fastest IP address only (see fastip.FastestAddr). The other queries are sent using the fallback selector.
+func NewFastestAddrSelector(fallback UpstreamSelector) UpstreamSelector {
+	return &fastestAddrSelector{
+		fastestAddr: fastip.NewFastestAddr(),
+		fallback:    fallback,
+	}
+}
+
+// Exchange implements the UpstreamSelector interface for *fastestAddrSelector
+func (s *fastestAddrSelector) Exchange(ctx context.Context, req *dns.Msg, upstreams []upstream.Upstream) (*dns.Msg, upstream.Upstream, error) {
+	qtype := req.Question[0].Qtype
+	if qtype == dns.TypeA || qtype == dns.TypeAAAA {
+		return s.fastestAddr.ExchangeFastestContext(ctx, req, upstreams)
+	}
+	return s.fallback.Exchange(ctx, req, upstreams)
+}
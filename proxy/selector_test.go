@@ -0,0 +1,247 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+// slowTestUpstream is an upstream that responds after the specified delay
+type slowTestUpstream struct {
+	healthTestUpstream
+	delay time.Duration
+}
+
+func (u *slowTestUpstream) Exchange(m *dns.Msg) (*dns.Msg, error) {
+	time.Sleep(u.delay)
+	return u.healthTestUpstream.Exchange(m)
+}
+
+func TestEWMASelector(t *testing.T) {
+	fast := &slowTestUpstream{healthTestUpstream: healthTestUpstream{addr: "fast"}}
+	slow := &slowTestUpstream{healthTestUpstream: healthTestUpstream{addr: "slow"}, delay: 30 * time.Millisecond}
+	upstreams := []upstream.Upstream{slow, fast}
+
+	s := NewEWMASelector()
+	for i := 0; i < 20; i++ {
+		_, _, err := s.Exchange(context.Background(), createHostTestMessage("google.com"), upstreams)
+		assert.Nil(t, err)
+	}
+
+	// Both upstreams are tried first as they haven't been queried yet,
+	// then the faster one is always chosen out of the two
+	assert.True(t, atomic.LoadInt32(&slow.queries) <= 2)
+	assert.True(t, atomic.LoadInt32(&fast.queries) >= 18)
+
+	// The failed upstream is penalized, the next one is tried
+	atomic.StoreInt32(&fast.down, 1)
+	_, u, err := s.Exchange(context.Background(), createHostTestMessage("google.com"), upstreams)
+	assert.Nil(t, err)
+	assert.Equal(t, slow, u)
+	assert.Equal(t, []upstream.Upstream{slow, fast}, s.(*ewmaSelector).sorted(upstreams))
+}
+
+func TestWeightedRoundRobinSelector(t *testing.T) {
+	u1 := &healthTestUpstream{addr: "u1"}
+	u2 := &healthTestUpstream{addr: "u2"}
+	upstreams := []upstream.Upstream{
+		&weightedUpstream{Upstream: u1, weight: 3},
+		u2,
+	}
+
+	s := NewWeightedRoundRobinSelector()
+	for i := 0; i < 40; i++ {
+		_, _, err := s.Exchange(context.Background(), createHostTestMessage("google.com"), upstreams)
+		assert.Nil(t, err)
+	}
+	assert.Equal(t, int32(30), atomic.LoadInt32(&u1.queries))
+	assert.Equal(t, int32(10), atomic.LoadInt32(&u2.queries))
+
+	// The other upstream is used if the chosen one fails
+	atomic.StoreInt32(&u1.down, 1)
+	for i := 0; i < 4; i++ {
+		_, u, err := s.Exchange(context.Background(), createHostTestMessage("google.com"), upstreams)
+		assert.Nil(t, err)
+		assert.Equal(t, u2, u)
+	}
+}
+
+func TestConsistentHashSelector(t *testing.T) {
+	upstreams := []upstream.Upstream{}
+	for i := 0; i < 4; i++ {
+		upstreams = append(upstreams, &healthTestUpstream{addr: fmt.Sprintf("u%d", i)})
+	}
+
+	s := NewConsistentHashSelector()
+	chosen := map[string]upstream.Upstream{}
+	used := map[upstream.Upstream]bool{}
+	for i := 0; i < 50; i++ {
+		host := fmt.Sprintf("host%d.example.org", i)
+		_, u, err := s.Exchange(context.Background(), createHostTestMessage(host), upstreams)
+		assert.Nil(t, err)
+		chosen[host] = u
+		used[u] = true
+	}
+	// The names are distributed between all the upstreams
+	assert.Equal(t, len(upstreams), len(used))
+
+	// The same name always goes to the same upstream
+	for host, expected := range chosen {
+		_, u, err := s.Exchange(context.Background(), createHostTestMessage(host), upstreams)
+		assert.Nil(t, err)
+		assert.Equal(t, expected, u)
+	}
+
+	// If the upstream fails, the name goes to another one,
+	// the names of the other upstreams stay where they were
+	failed := upstreams[0].(*healthTestUpstream)
+	atomic.StoreInt32(&failed.down, 1)
+	for host, expected := range chosen {
+		_, u, err := s.Exchange(context.Background(), createHostTestMessage(host), upstreams)
+		assert.Nil(t, err)
+		if expected == failed {
+			assert.NotEqual(t, failed, u)
+		} else {
+			assert.Equal(t, expected, u)
+		}
+	}
+}
+
+func TestSelectorsCustomUpstreams(t *testing.T) {
+	ewma := NewEWMASelector().(*ewmaSelector)
+	wrr := NewWeightedRoundRobinSelector().(*weightedRoundRobinSelector)
+	hash := NewConsistentHashSelector().(*consistentHashSelector)
+
+	// The custom upstreams are created for every request, the selectors' state must not grow
+	var last []upstream.Upstream
+	for i := 0; i < 10; i++ {
+		last = []upstream.Upstream{&healthTestUpstream{addr: "u1"}, &healthTestUpstream{addr: "u2"}}
+		for _, s := range []UpstreamSelector{ewma, wrr, hash} {
+			_, _, err := s.Exchange(context.Background(), createHostTestMessage("google.com"), last)
+			assert.Nil(t, err)
+		}
+	}
+	assert.Equal(t, 2, len(ewma.stats))
+	assert.Equal(t, 2, len(wrr.current))
+	assert.Equal(t, 1, len(hash.rings))
+
+	// The cached ring returns the current instances
+	_, u, err := hash.Exchange(context.Background(), createHostTestMessage("google.com"), last)
+	assert.Nil(t, err)
+	assert.True(t, u == last[0] || u == last[1])
+
+	// The number of the cached rings is limited
+	for i := 0; i < maxHashRings+10; i++ {
+		hash.ring([]upstream.Upstream{&healthTestUpstream{addr: fmt.Sprintf("u%d", i)}})
+	}
+	assert.True(t, len(hash.rings) <= maxHashRings)
+}
+
+func TestSelectorsSameAddress(t *testing.T) {
+	// The upstreams with the same address but different options, e.g. "tls://dns.example?ip=1.2.3.4"
+	// and "tls://dns.example?ip=5.6.7.8&weight=3"
+	u1 := &healthTestUpstream{addr: "tls://dns.example:853"}
+	u2 := &healthTestUpstream{addr: "tls://dns.example:853"}
+	upstreams := []upstream.Upstream{u1, &weightedUpstream{Upstream: u2, weight: 3}}
+
+	// The weights are counted separately
+	wrr := NewWeightedRoundRobinSelector()
+	for i := 0; i < 40; i++ {
+		_, _, err := wrr.Exchange(context.Background(), createHostTestMessage("google.com"), upstreams)
+		assert.Nil(t, err)
+	}
+	assert.Equal(t, int32(10), atomic.LoadInt32(&u1.queries))
+	assert.Equal(t, int32(30), atomic.LoadInt32(&u2.queries))
+
+	// Both upstreams are on the ring
+	hash := NewConsistentHashSelector()
+	atomic.StoreInt32(&u1.queries, 0)
+	atomic.StoreInt32(&u2.queries, 0)
+	for i := 0; i < 100; i++ {
+		_, _, err := hash.Exchange(context.Background(), createHostTestMessage(fmt.Sprintf("host%d.example", i)), upstreams)
+		assert.Nil(t, err)
+	}
+	assert.True(t, atomic.LoadInt32(&u1.queries) > 0)
+	assert.True(t, atomic.LoadInt32(&u2.queries) > 0)
+
+	// The statistics are kept separately
+	ewma := NewEWMASelector().(*ewmaSelector)
+	_, _, err := ewma.Exchange(context.Background(), createHostTestMessage("google.com"), upstreams)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(ewma.stats))
+	_, _, err = ewma.Exchange(context.Background(), createHostTestMessage("google.com"), upstreams)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(ewma.stats))
+
+	// The other upstream is used if either one fails
+	for _, down := range []*healthTestUpstream{u1, u2} {
+		atomic.StoreInt32(&down.down, 1)
+		for _, s := range []UpstreamSelector{wrr, hash, ewma} {
+			for i := 0; i < 4; i++ {
+				_, u, err := s.Exchange(context.Background(), createHostTestMessage(fmt.Sprintf("host%d.example", i)), upstreams)
+				assert.Nil(t, err)
+				assert.NotNil(t, u)
+			}
+		}
+		atomic.StoreInt32(&down.down, 0)
+	}
+}
+
+func TestParseUpstreamSelectors(t *testing.T) {
+	selector, domainSelectors, err := ParseUpstreamSelectors([]string{"round-robin", "[/google.com/example.org/]hash", "[//]parallel"})
+	assert.Nil(t, err)
+	assert.IsType(t, &weightedRoundRobinSelector{}, selector)
+	assert.Equal(t, 3, len(domainSelectors))
+	assert.IsType(t, &consistentHashSelector{}, domainSelectors["google.com."])
+	assert.Equal(t, domainSelectors["google.com."], domainSelectors["example.org."])
+	assert.IsType(t, parallelSelector{}, domainSelectors[UnqualifiedNames])
+
+	_, _, err = ParseUpstreamSelectors([]string{"random"})
+	assert.NotNil(t, err)
+	_, _, err = ParseUpstreamSelectors([]string{"[/google.com/hash"})
+	assert.NotNil(t, err)
+}
+
+func TestGetSelectorForDomain(t *testing.T) {
+	config := []string{"[/google.com/]1.2.3.4", "[/maps.google.com/]#", "3.4.5.6"}
+	upstreams, err := ParseUpstreamsConfig(config, nil, 1*time.Second)
+	assert.Nil(t, err)
+	hashSelector := NewConsistentHashSelector()
+
+	dnsProxy := Proxy{}
+	dnsProxy.Upstreams = upstreams.Upstreams
+	dnsProxy.DomainsReservedUpstreams = upstreams.DomainReservedUpstreams
+	dnsProxy.DomainsUpstreamSelectors = map[string]UpstreamSelector{"google.com.": hashSelector}
+	dnsProxy.Init()
+
+	assert.Equal(t, hashSelector, dnsProxy.getSelectorForDomain("www.google.com."))
+	assert.IsType(t, &ewmaSelector{}, dnsProxy.getSelectorForDomain("maps.google.com."))
+	assert.IsType(t, &ewmaSelector{}, dnsProxy.getSelectorForDomain("example.org."))
+}
+
+func TestUpstreamWeight(t *testing.T) {
+	config := []string{"tls://1.1.1.1?weight=3", "https://dns.google/dns-query?weight=2&url-foo=bar", "8.8.8.8"}
+	var addresses []string
+	upstreams, err := ParseUpstreamsConfigEx(config, nil, 1*time.Second, func(address string, opts upstream.Options) (upstream.Upstream, error) {
+		addresses = append(addresses, address)
+		return upstream.AddressToUpstream(address, opts)
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"tls://1.1.1.1", "https://dns.google/dns-query?url-foo=bar", "8.8.8.8"}, addresses)
+	assert.Equal(t, 3, upstreamWeight(upstreams.Upstreams[0]))
+	assert.Equal(t, "tls://1.1.1.1:853", upstreams.Upstreams[0].Address())
+	assert.Equal(t, 2, upstreamWeight(upstreams.Upstreams[1]))
+	assert.Equal(t, "https://dns.google:443/dns-query?foo=bar", upstreams.Upstreams[1].Address())
+	assert.Equal(t, 1, upstreamWeight(upstreams.Upstreams[2]))
+
+	_, err = ParseUpstreamsConfig([]string{"tls://1.1.1.1?weight=0"}, nil, 1*time.Second)
+	assert.NotNil(t, err)
+	_, err = ParseUpstreamsConfig([]string{"tls://1.1.1.1?weight=abc"}, nil, 1*time.Second)
+	assert.NotNil(t, err)
+}
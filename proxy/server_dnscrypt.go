@@ -0,0 +1,86 @@
+package proxy
+
+import (
+	"net"
+
+	"github.com/AdguardTeam/golibs/log"
+	"github.com/ameshkov/dnscrypt/v2"
+	"github.com/joomcode/errorx"
+	"github.com/miekg/dns"
+)
+
+// dnsCryptCreate - create the DNSCrypt UDP and TCP listeners for the specified address
+func (p *Proxy) dnsCryptCreate(addr *net.UDPAddr) error {
+	log.Printf("Creating the DNSCrypt server sockets")
+
+	udpListen, err := net.ListenUDP("udp", addr)
+	if err != nil {
+		return errorx.Decorate(err, "couldn't listen to DNSCrypt UDP socket")
+	}
+	p.dnsCryptUDPListen = append(p.dnsCryptUDPListen, udpListen)
+
+	tcpAddr := &net.TCPAddr{IP: addr.IP, Port: udpListen.LocalAddr().(*net.UDPAddr).Port}
+	tcpListen, err := net.ListenTCP("tcp", tcpAddr)
+	if err != nil {
+		return errorx.Decorate(err, "couldn't listen to DNSCrypt TCP socket")
+	}
+	p.dnsCryptTCPListen = append(p.dnsCryptTCPListen, p.withConnLimit(tcpListen))
+
+	log.Printf("Listening to DNSCrypt on udp://%s and tcp://%s", udpListen.LocalAddr(), tcpListen.Addr())
+	return nil
+}
+
+// dnsCryptUDPLoop serves DNSCrypt queries received over UDP
+func (p *Proxy) dnsCryptUDPLoop(l *net.UDPConn) {
+	log.Printf("Entering the DNSCrypt UDP listener loop on %s", l.LocalAddr())
+	err := p.dnsCryptServer.ServeUDP(l)
+	if isConnClosed(err) {
+		log.Printf("DNSCrypt UDP listener has been closed, exiting loop")
+	} else if err != nil {
+		log.Printf("got error when serving DNSCrypt over UDP: %s", err)
+	}
+}
+
+// dnsCryptTCPLoop serves DNSCrypt queries received over TCP
+func (p *Proxy) dnsCryptTCPLoop(l net.Listener) {
+	log.Printf("Entering the DNSCrypt TCP listener loop on %s", l.Addr())
+	err := p.dnsCryptServer.ServeTCP(l)
+	if isConnClosed(err) {
+		log.Printf("DNSCrypt TCP listener has been closed, exiting loop")
+	} else if err != nil {
+		log.Printf("got error when serving DNSCrypt over TCP: %s", err)
+	}
+}
+
+// dnsCryptHandler - dnscrypt.Handler implementation that passes the decrypted
+// DNS queries to the proxy
+type dnsCryptHandler struct {
+	proxy *Proxy
+}
+
+// ServeDNS - implements dnscrypt.Handler
+func (h *dnsCryptHandler) ServeDNS(rw dnscrypt.ResponseWriter, r *dns.Msg) error {
+	d := &DNSContext{
+		Proto:                  ProtoDNSCrypt,
+		Req:                    r,
+		Addr:                   rw.RemoteAddr(),
+		DNSCryptResponseWriter: rw,
+	}
+
+	h.proxy.guardMaxGoroutines()
+	defer h.proxy.freeMaxGoroutines()
+
+	// The response (if any) has already been written by handleDNSRequest
+	// so the error is not passed to the DNSCrypt server
+	err := h.proxy.handleDNSRequest(d)
+	if err != nil {
+		log.Tracef("error handling DNS (%s) request: %s", d.Proto, err)
+	}
+	return nil
+}
+
+// Writes a response to the DNSCrypt client.
+// The response is encrypted by the response writer.
+func (p *Proxy) respondDNSCrypt(d *DNSContext) error {
+	return d.DNSCryptResponseWriter.WriteMsg(d.Res)
+}
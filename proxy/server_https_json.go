@@ -0,0 +1,151 @@
+package proxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/AdguardTeam/golibs/utils"
+	"github.com/joomcode/errorx"
+	"github.com/miekg/dns"
+)
+
+// mimeTypeDNSJSON is the content type of the DNS JSON API responses
+const mimeTypeDNSJSON = "application/dns-json"
+
+// jsonEDNSBufferSize is the EDNS buffer size used for the JSON API requests with the DO bit set
+const jsonEDNSBufferSize = 4096
+
+// jsonResponse is the DNS JSON API response (the format used by Google and Cloudflare)
+type jsonResponse struct {
+	Status    int            `json:"Status"`
+	TC        bool           `json:"TC"`
+	RD        bool           `json:"RD"`
+	RA        bool           `json:"RA"`
+	AD        bool           `json:"AD"`
+	CD        bool           `json:"CD"`
+	Question  []jsonQuestion `json:"Question"`
+	Answer    []jsonRR       `json:"Answer,omitempty"`
+	Authority []jsonRR       `json:"Authority,omitempty"`
+}
+
+// jsonQuestion is a question section entry of the DNS JSON API response
+type jsonQuestion struct {
+	Name string `json:"name"`
+	Type uint16 `json:"type"`
+}
+
+// jsonRR is a resource record of the DNS JSON API response
+type jsonRR struct {
+	Name string `json:"name"`
+	Type uint16 `json:"type"`
+	TTL  uint32 `json:"TTL"`
+	Data string `json:"data"`
+}
+
+// isJSONRequest checks if this is a DNS JSON API request,
+// i.e. a GET request with the "name" parameter instead of "dns"
+func isJSONRequest(r *http.Request) bool {
+	if r.Method != http.MethodGet {
+		return false
+	}
+
+	q := r.URL.Query()
+	return q.Get("dns") == "" && q.Get("name") != ""
+}
+
+// jsonRequestToMsg creates a DNS query from the DNS JSON API request parameters:
+// name -- the domain name (mandatory)
+// type -- RR type, either a name (AAAA) or a number (28). Default: A
+// do -- DNSSEC OK flag (1 or true)
+// cd -- checking disabled flag (1 or true)
+func jsonRequestToMsg(r *http.Request) (*dns.Msg, error) {
+	q := r.URL.Query()
+
+	name := strings.TrimSuffix(q.Get("name"), ".")
+	if err := utils.IsValidHostname(name); err != nil {
+		return nil, fmt.Errorf("invalid name %s: %s", name, err)
+	}
+
+	qtype := dns.TypeA
+	if t := q.Get("type"); t != "" {
+		var ok bool
+		qtype, ok = dns.StringToType[strings.ToUpper(t)]
+		if !ok {
+			v, err := strconv.ParseUint(t, 10, 16)
+			if err != nil {
+				return nil, fmt.Errorf("invalid type %s", t)
+			}
+			qtype = uint16(v)
+		}
+	}
+
+	msg := &dns.Msg{}
+	msg.SetQuestion(dns.Fqdn(name), qtype)
+	msg.RecursionDesired = true
+	msg.CheckingDisabled = isJSONFlagSet(q.Get("cd"))
+	if isJSONFlagSet(q.Get("do")) {
+		msg.SetEdns0(jsonEDNSBufferSize, true)
+	}
+
+	return msg, nil
+}
+
+// isJSONFlagSet checks the value of a boolean DNS JSON API parameter
+func isJSONFlagSet(v string) bool {
+	return v == "1" || strings.EqualFold(v, "true")
+}
+
+// msgToJSON converts the DNS response to the DNS JSON API format
+func msgToJSON(m *dns.Msg) *jsonResponse {
+	resp := &jsonResponse{
+		Status:   m.Rcode,
+		TC:       m.Truncated,
+		RD:       m.RecursionDesired,
+		RA:       m.RecursionAvailable,
+		AD:       m.AuthenticatedData,
+		CD:       m.CheckingDisabled,
+		Question: []jsonQuestion{},
+	}
+
+	for _, q := range m.Question {
+		resp.Question = append(resp.Question, jsonQuestion{Name: q.Name, Type: q.Qtype})
+	}
+	resp.Answer = rrsToJSON(m.Answer)
+	resp.Authority = rrsToJSON(m.Ns)
+
+	return resp
+}
+
+// rrsToJSON converts the resource records to the DNS JSON API format
+func rrsToJSON(rrs []dns.RR) []jsonRR {
+	var res []jsonRR
+	for _, rr := range rrs {
+		hdr := rr.Header()
+		res = append(res, jsonRR{
+			Name: hdr.Name,
+			Type: hdr.Rrtype,
+			TTL:  hdr.Ttl,
+			Data: strings.TrimPrefix(rr.String(), hdr.String()),
+		})
+	}
+	return res
+}
+
+// Writes a DNS JSON API response to the DOH client
+func (p *Proxy) respondHTTPSJSON(d *DNSContext) error {
+	w := d.HTTPResponseWriter
+
+	bytes, err := json.Marshal(msgToJSON(d.Res))
+	if err != nil {
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return errorx.Decorate(err, "couldn't convert message into JSON: %s", d.Res.String())
+	}
+
+	w.Header().Set("Server", "AdGuard DNS")
+	w.Header().Set("Content-Type", mimeTypeDNSJSON)
+	_, err = w.Write(bytes)
+	return err
+}
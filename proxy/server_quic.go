@@ -0,0 +1,194 @@
+package proxy
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"time"
+
+	"github.com/AdguardTeam/golibs/log"
+	"github.com/joomcode/errorx"
+	"github.com/miekg/dns"
+	"github.com/quic-go/quic-go"
+)
+
+// NextProtoDQ is the ALPN token for DNS-over-QUIC (RFC 9250)
+const NextProtoDQ = "doq"
+
+// maxQUICIdleTimeout is the maximum QUIC idle timeout.
+// The client is free to use a lower value, but we don't keep connections longer than that.
+const maxQUICIdleTimeout = 5 * time.Minute
+
+// DoQ error codes (see https://www.rfc-editor.org/rfc/rfc9250.html#section-8.4)
+const (
+	// DoQCodeNoError is used when the connection or stream needs to be closed,
+	// but there is no error to signal
+	DoQCodeNoError = quic.ApplicationErrorCode(0)
+	// DoQCodeInternalError signals that the DoQ implementation encountered
+	// an internal error and is incapable of pursuing the transaction or the connection
+	DoQCodeInternalError = quic.ApplicationErrorCode(1)
+	// DoQCodeProtocolError signals that the DoQ implementation encountered
+	// a protocol error and is forcibly aborting the connection
+	DoQCodeProtocolError = quic.ApplicationErrorCode(2)
+)
+
+// quicCreate - create a QUIC listener
+func (p *Proxy) quicCreate(addr *net.UDPAddr) error {
+	log.Printf("Creating the QUIC server socket")
+	tlsConfig := p.TLSConfig.Clone()
+	tlsConfig.NextProtos = []string{NextProtoDQ}
+
+	quicConfig := &quic.Config{
+		MaxIdleTimeout: maxQUICIdleTimeout,
+	}
+
+	quicListen, err := quic.ListenAddr(addr.String(), tlsConfig, quicConfig)
+	if err != nil {
+		return errorx.Decorate(err, "could not start QUIC listener")
+	}
+
+	p.quicListen = append(p.quicListen, quicListen)
+	log.Printf("Listening to quic://%s", quicListen.Addr())
+	return nil
+}
+
+// quicPacketLoop listens for incoming QUIC connections
+func (p *Proxy) quicPacketLoop(l *quic.Listener) {
+	log.Printf("Entering the DNS-over-QUIC listener loop on %s", l.Addr())
+	for {
+		conn, err := l.Accept(context.Background())
+		if err != nil {
+			if errors.Is(err, quic.ErrServerClosed) {
+				log.Printf("quicListen.Accept() returned because the listener was closed, exiting loop")
+				break
+			}
+			log.Printf("got error when accepting a QUIC connection: %s", err)
+			continue
+		}
+
+		go p.handleQUICConnection(conn)
+	}
+}
+
+// handleQUICConnection starts a loop that handles the incoming QUIC streams.
+// Every stream carries exactly one DNS query and its response.
+func (p *Proxy) handleQUICConnection(conn *quic.Conn) {
+	log.Tracef("Start handling the new QUIC connection %s", conn.RemoteAddr())
+
+	for {
+		p.RLock()
+		started := p.started
+		p.RUnlock()
+		if !started {
+			_ = conn.CloseWithError(DoQCodeNoError, "")
+			return
+		}
+
+		// The stream is accepted until the connection is closed by the client
+		// or its idle timeout is exceeded
+		stream, err := conn.AcceptStream(context.Background())
+		if err != nil {
+			_ = conn.CloseWithError(DoQCodeNoError, "")
+			return
+		}
+
+		p.guardMaxGoroutines()
+		go func() {
+			p.handleQUICStream(stream, conn)
+			p.freeMaxGoroutines()
+		}()
+	}
+}
+
+// handleQUICStream reads the DNS query from the stream, processes it
+// and writes the response back to the same stream
+func (p *Proxy) handleQUICStream(stream *quic.Stream, conn *quic.Conn) {
+	// Closing the write direction of the stream signals the client
+	// that the response is complete (STREAM FIN)
+	defer stream.Close()
+
+	_ = stream.SetDeadline(time.Now().Add(defaultTimeout))
+	packet, err := readQUICMessage(stream)
+	if err != nil {
+		log.Tracef("error reading from the QUIC stream: %s", err)
+		_ = conn.CloseWithError(DoQCodeProtocolError, "")
+		return
+	}
+
+	msg := &dns.Msg{}
+	err = msg.Unpack(packet)
+	if err != nil {
+		log.Printf("error handling QUIC packet: %s", err)
+		_ = conn.CloseWithError(DoQCodeProtocolError, "")
+		return
+	}
+
+	// When sending queries over a QUIC connection, the DNS Message ID MUST be set to 0
+	if msg.Id != 0 {
+		log.Tracef("invalid DNS message ID %d in a QUIC query", msg.Id)
+		_ = conn.CloseWithError(DoQCodeProtocolError, "")
+		return
+	}
+
+	d := &DNSContext{
+		Proto:          ProtoQUIC,
+		Req:            msg,
+		Addr:           conn.RemoteAddr(),
+		QUICStream:     stream,
+		QUICConnection: conn,
+		// The upstream query is cancelled if the client resets the stream
+		Context: stream.Context(),
+	}
+
+	err = p.handleDNSRequest(d)
+	if err != nil {
+		log.Tracef("error handling DNS (%s) request: %s", d.Proto, err)
+	}
+}
+
+// readQUICMessage reads a DNS message prefixed with its length (2 bytes) from the QUIC stream
+func readQUICMessage(stream *quic.Stream) ([]byte, error) {
+	var length uint16
+	err := binary.Read(stream, binary.BigEndian, &length)
+	if err != nil {
+		return nil, err
+	}
+	if length < minDNSPacketSize {
+		return nil, errors.New("packet too short")
+	}
+
+	buf := make([]byte, length)
+	_, err = io.ReadFull(stream, buf)
+	if err != nil {
+		return nil, err
+	}
+	return buf, nil
+}
+
+// Writes a response to the DoQ client
+func (p *Proxy) respondQUIC(d *DNSContext) error {
+	resp := d.Res
+
+	bytes, err := resp.Pack()
+	if err != nil {
+		_ = d.QUICConnection.CloseWithError(DoQCodeInternalError, "")
+		return errorx.Decorate(err, "couldn't convert message into wire format: %s", resp.String())
+	}
+
+	bytes, err = prefixWithSize(bytes)
+	if err != nil {
+		return errorx.Decorate(err, "couldn't add prefix with size")
+	}
+
+	n, err := d.QUICStream.Write(bytes)
+	if err != nil {
+		return errorx.Decorate(err, "stream.Write() returned error")
+	}
+	if n != len(bytes) {
+		return fmt.Errorf("stream.Write() returned with %d != %d", n, len(bytes))
+	}
+	return nil
+}
@@ -10,9 +10,8 @@ import (
 )
 
 // udpCreate - create a UDP listening socket
-func (p *Proxy) udpCreate() error {
+func (p *Proxy) udpCreate(udpAddr *net.UDPAddr) error {
 	log.Printf("Creating the UDP server socket")
-	udpAddr := p.UDPListenAddr
 	udpListen, err := net.ListenUDP("udp", udpAddr)
 	if err != nil {
 		return errorx.Decorate(err, "couldn't listen to UDP socket")
@@ -24,8 +23,8 @@ func (p *Proxy) udpCreate() error {
 		return fmt.Errorf("udpSetOptions: %s", err)
 	}
 
-	p.udpListen = udpListen
-	log.Printf("Listening to udp://%s", p.udpListen.LocalAddr())
+	p.udpListen = append(p.udpListen, udpListen)
+	log.Printf("Listening to udp://%s", udpListen.LocalAddr())
 	return nil
 }
 
@@ -89,8 +88,10 @@ func (p *Proxy) udpHandlePacket(packet []byte, localIP net.IP, remoteAddr *net.U
 }
 
 // Writes a response to the UDP client
+// The response is truncated (TC bit is set) if it does not fit the negotiated UDP payload size
 func (p *Proxy) respondUDP(d *DNSContext) error {
 	resp := d.Res
+	resp.Truncate(p.udpResponseSize(d.Req))
 
 	bytes, err := resp.Pack()
 	if err != nil {
@@ -109,3 +110,22 @@ func (p *Proxy) respondUDP(d *DNSContext) error {
 	}
 	return nil
 }
+
+// udpResponseSize returns the maximum size of the UDP response to the specified request.
+// It is the client's EDNS UDP payload size (512 bytes if there's no OPT record)
+// capped by MaxUDPResponseSize.
+func (p *Proxy) udpResponseSize(req *dns.Msg) int {
+	size := dns.MinMsgSize
+	if opt := req.IsEdns0(); opt != nil && int(opt.UDPSize()) > size {
+		size = int(opt.UDPSize())
+	}
+
+	maxSize := p.MaxUDPResponseSize
+	if maxSize <= 0 {
+		maxSize = defaultMaxUDPResponseSize
+	}
+	if size > maxSize {
+		size = maxSize
+	}
+	return size
+}
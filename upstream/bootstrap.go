@@ -1,9 +1,14 @@
 package upstream
 
 import (
+	"bytes"
 	"context"
+	"crypto/sha256"
 	"crypto/tls"
 	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
 	"fmt"
 	"net"
 	"net/url"
@@ -27,12 +32,35 @@ var RootCAs *x509.CertPool
 // nolint
 var CipherSuites []uint16
 
+const (
+	// defaultBootstrapMinTTL is the default value of Options.BootstrapMinTTL
+	defaultBootstrapMinTTL = 30 * time.Second
+
+	// defaultBootstrapMaxTTL is the default value of Options.BootstrapMaxTTL
+	defaultBootstrapMaxTTL = time.Hour
+)
+
 type bootstrapper struct {
-	address        string        // in form of "tls://one.one.one.one:853"
-	resolvers      []*Resolver   // list of Resolvers to use to resolve hostname, if necessary
-	timeout        time.Duration // resolution duration (shared with the upstream) (0 == infinite timeout)
-	dialContext    dialHandler   // specifies the dial function for creating unencrypted TCP connections.
+	address        string               // in form of "tls://one.one.one.one:853"
+	resolvers      []*Resolver          // list of Resolvers to use to resolve hostname, if necessary
+	timeout        time.Duration        // resolution duration (shared with the upstream) (0 == infinite timeout)
+	dialContext    dialHandler          // specifies the dial function for creating unencrypted TCP connections.
+	dialer         contextDialer        // opens the connections to the resolved addresses (see newDialer)
+	eyeballs       *happyEyeballsDialer // races the connections to the resolved addresses
 	resolvedConfig *tls.Config
+	serverName     string            // TLS server name, overrides the host from address if not empty
+	insecure       bool              // if true, the server certificate isn't verified
+	pins           [][]byte          // SHA-256 hashes the server certificates are pinned to (see Options.Pins)
+	clientCert     *clientCertLoader // TLS client certificate (nil if it isn't used)
+
+	resolved   []string      // the resolved addresses of the hostname (host:port)
+	resolvedAt time.Time     // when the hostname was resolved
+	refreshAt  time.Time     // when the resolved addresses should be refreshed
+	refreshing bool          // true if the addresses are being refreshed in the background
+	minTTL     time.Duration // the minimum time the resolved addresses are used for
+	maxTTL     time.Duration // the maximum time the resolved addresses are used for
+	lookupLock sync.Mutex    // serializes the lookups of the hostname
+
 	sync.RWMutex
 }
 
@@ -41,68 +69,145 @@ type Resolver struct {
 	resolver        *net.Resolver // net.Resolver
 	resolverAddress string        // Resolver's address
 	upstream        Upstream
+	preference      IPPreference // defines the record types to look up and the order of the addresses
 }
 
 // toBootResolved creates a new bootstrapper that already contains resolved config.
-// This can be done only in the case when we already know the resolver IP address.
-// timeout is also used for establishing TCP connections
-func toBootResolved(address string, serverIP net.IP, timeout time.Duration) (*bootstrapper, error) {
+// This can be done only in the case when we already know the resolver IP address (opts.ServerIP).
+// opts.Timeout is also used for establishing TCP connections
+func toBootResolved(address string, opts Options) (*bootstrapper, error) {
 	// get a host without port
 	host, port, err := getAddressHostPort(address)
 	if err != nil {
 		return nil, fmt.Errorf("bootstrapper requires port in address %s", address)
 	}
 
+	clientCert, err := newClientCertLoader(opts.ClientCertFile, opts.ClientKeyFile)
+	if err != nil {
+		return nil, err
+	}
+
+	dialer, err := newDialer(opts)
+	if err != nil {
+		return nil, err
+	}
+
 	// Upgrade lock to protect n.resolved
-	resolverAddress := net.JoinHostPort(serverIP.String(), port)
-
-	return &bootstrapper{
-		address:        address,
-		dialContext:    createDialContext([]string{resolverAddress}, timeout),
-		resolvedConfig: createTLSConfig(host),
-		timeout:        timeout,
-	}, nil
+	resolverAddress := net.JoinHostPort(opts.ServerIP.String(), port)
+
+	n := &bootstrapper{
+		address:    address,
+		dialer:     dialer,
+		eyeballs:   newHappyEyeballsDialer(dialer, opts.IPPreference),
+		timeout:    opts.Timeout,
+		serverName: opts.ServerName,
+		insecure:   opts.InsecureSkipVerify,
+		pins:       opts.Pins,
+		clientCert: clientCert,
+	}
+	n.dialContext = createDialContext([]string{resolverAddress}, n.eyeballs)
+	n.resolvedConfig = n.createTLSConfig(host)
+	return n, nil
 }
 
 // toBoot initializes a new bootstrapper instance
 // address -- original resolver address string (i.e. tls://one.one.one.one:853)
-// bootstrapAddr -- a list of bootstrap DNS resolvers' addresses
-// timeout -- DNS query timeout
-func toBoot(address string, bootstrapAddr []string, timeout time.Duration) *bootstrapper {
+// opts.Bootstrap -- a list of bootstrap DNS resolvers' addresses
+// opts.Timeout -- DNS query timeout
+func toBoot(address string, opts Options) (*bootstrapper, error) {
+	clientCert, err := newClientCertLoader(opts.ClientCertFile, opts.ClientKeyFile)
+	if err != nil {
+		return nil, err
+	}
+
+	dialer, err := newDialer(opts)
+	if err != nil {
+		return nil, err
+	}
+
+	// The bootstrap DNS queries are sent through the same proxy and from the same address
+	bootOpts := Options{
+		Timeout:           opts.Timeout,
+		Proxy:             opts.Proxy,
+		OutboundAddr:      opts.OutboundAddr,
+		OutboundInterface: opts.OutboundInterface,
+		IPPreference:      opts.IPPreference,
+	}
 	resolvers := []*Resolver{}
-	if bootstrapAddr != nil && len(bootstrapAddr) != 0 {
+	if len(opts.Bootstrap) != 0 {
 		// Create a list of resolvers for parallel lookup
-		for _, boot := range bootstrapAddr {
-			r := NewResolver(boot, timeout)
+		for _, boot := range opts.Bootstrap {
+			r := newResolver(boot, bootOpts, dialer)
 			resolvers = append(resolvers, r)
 		}
 	} else {
 		// nil resolver if the default one
-		resolvers = append(resolvers, NewResolver("", timeout))
+		resolvers = append(resolvers, newResolver("", bootOpts, dialer))
 	}
 
-	return &bootstrapper{
-		address:   address,
-		resolvers: resolvers,
-		timeout:   timeout,
+	n := &bootstrapper{
+		address:    address,
+		resolvers:  resolvers,
+		dialer:     dialer,
+		eyeballs:   newHappyEyeballsDialer(dialer, opts.IPPreference),
+		timeout:    opts.Timeout,
+		serverName: opts.ServerName,
+		insecure:   opts.InsecureSkipVerify,
+		pins:       opts.Pins,
+		clientCert: clientCert,
+		minTTL:     opts.BootstrapMinTTL,
+		maxTTL:     opts.BootstrapMaxTTL,
+	}
+	if n.minTTL <= 0 {
+		n.minTTL = defaultBootstrapMinTTL
+	}
+	if n.maxTTL <= 0 {
+		n.maxTTL = defaultBootstrapMaxTTL
 	}
+	if n.maxTTL < n.minTTL {
+		n.maxTTL = n.minTTL
+	}
+	return n, nil
 }
 
 // NewResolver creates an instance of Resolver structure with defined net.Resolver and it's address
 // resolverAddress is address of net.Resolver
 // The host in the address parameter of Dial func will always be a literal IP address (from documentation)
 func NewResolver(resolverAddress string, timeout time.Duration) *Resolver {
-	r := &Resolver{}
+	return newResolver(resolverAddress, Options{Timeout: timeout}, &net.Dialer{Timeout: timeout})
+}
+
+// newResolver creates an instance of Resolver with the specified upstream options
+// If opts.Proxy is set, the plain DNS resolvers (including the system one unless it's a loopback one)
+// are queried over TCP through the proxy.
+// dialer is used to connect to the system resolver if either the proxy or the outbound address or interface is set.
+func newResolver(resolverAddress string, opts Options, dialer contextDialer) *Resolver {
+	r := &Resolver{preference: opts.IPPreference}
 
 	// set default net.Resolver as a resolver if resolverAddress is empty
 	if resolverAddress == "" {
 		r.resolver = &net.Resolver{}
+		if opts.Proxy != nil {
+			direct, err := newDirectDialer(opts)
+			if err != nil {
+				log.Error("newDirectDialer: %s", err)
+				direct = &directDialer{timeout: opts.Timeout}
+			}
+			r.resolver = &net.Resolver{PreferGo: true, Dial: systemResolverDial(dialer, direct)}
+		} else if opts.OutboundAddr != nil || opts.OutboundInterface != "" {
+			r.resolver = &net.Resolver{
+				PreferGo: true,
+				Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+					return dialer.DialContext(ctx, network, address)
+				},
+			}
+		}
 		return r
 	}
 
 	r.resolverAddress = resolverAddress
-	opts := Options{
-		Timeout: timeout,
+	if opts.Proxy != nil {
+		resolverAddress = plainDNSOverTCP(resolverAddress)
 	}
 	var err error
 	r.upstream, err = AddressToUpstream(resolverAddress, opts)
@@ -121,12 +226,39 @@ func NewResolver(resolverAddress string, timeout time.Duration) *Resolver {
 	return r
 }
 
+// systemResolverDial returns the Dial func of the system resolver that sends the queries through the proxy.
+// The loopback resolvers (e.g. systemd-resolved on 127.0.0.53) are local to this host and not to the proxy,
+// so they're connected to directly.
+func systemResolverDial(proxyDialer, direct contextDialer) func(ctx context.Context, network, address string) (net.Conn, error) {
+	return func(ctx context.Context, network, address string) (net.Conn, error) {
+		host, _, err := net.SplitHostPort(address)
+		if err == nil && net.ParseIP(host).IsLoopback() {
+			return direct.DialContext(ctx, network, address)
+		}
+		// The resolver uses the DNS-over-TCP framing if the connection is not a net.PacketConn
+		return proxyDialer.DialContext(ctx, "tcp", address)
+	}
+}
+
+// plainDNSOverTCP converts the plain DNS resolver address to the tcp:// one
+// The other addresses are returned as is
+func plainDNSOverTCP(address string) string {
+	if strings.HasPrefix(address, "udp://") || strings.HasPrefix(address, "dns://") {
+		return "tcp://" + address[len("udp://"):]
+	}
+	if !strings.Contains(address, "://") {
+		return "tcp://" + address
+	}
+	return address
+}
+
 // isResolverValidBootstrap checks if the upstream is eligible to be a bootstrap DNS server
 // DNSCrypt and plain DNS resolvers are okay
-// DOH and DOT are okay only in the case if an IP address is used in the IP address
+// DOH, DOT and DOQ are okay only in the case if an IP address is used in the IP address
 func isResolverValidBootstrap(upstream Upstream) bool {
-	if u, ok := upstream.(*dnsOverTLS); ok {
-		urlAddr, err := url.Parse(u.Address())
+	switch upstream.(type) {
+	case *dnsOverTLS, *dnsOverQUIC:
+		urlAddr, err := url.Parse(upstream.Address())
 		if err != nil {
 			return false
 		}
@@ -165,7 +297,7 @@ type resultError struct {
 	err  error
 }
 
-func (r *Resolver) resolve(host string, qtype uint16, ch chan *resultError) {
+func (r *Resolver) resolve(ctx context.Context, host string, qtype uint16, ch chan *resultError) {
 	req := dns.Msg{}
 	req.Id = dns.Id()
 	req.RecursionDesired = true
@@ -176,31 +308,59 @@ func (r *Resolver) resolve(host string, qtype uint16, ch chan *resultError) {
 			Qclass: dns.ClassINET,
 		},
 	}
-	resp, err := r.upstream.Exchange(&req)
+	resp, err := ExchangeContext(ctx, r.upstream, &req)
 	ch <- &resultError{resp, err}
 }
 
 // LookupIPAddr returns result of LookupIPAddr method of Resolver's net.Resolver
 func (r *Resolver) LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error) {
+	ipAddrs, _, err := r.lookupIPAddrTTL(ctx, host)
+	return ipAddrs, err
+}
+
+// lookupIPAddrTTL looks up the IP addresses of the host and returns them along with the lowest TTL of the records
+// The TTL is negative if it's unknown (the system resolver is used).
+func (r *Resolver) lookupIPAddrTTL(ctx context.Context, host string) ([]net.IPAddr, time.Duration, error) {
 	if r.resolver != nil {
 		// use system resolver
-		return r.resolver.LookupIPAddr(ctx, host)
+		if r.preference == IPv4Only {
+			ips, err := r.resolver.LookupIP(ctx, "ip4", host)
+			ipAddrs := make([]net.IPAddr, 0, len(ips))
+			for _, ip := range ips {
+				ipAddrs = append(ipAddrs, net.IPAddr{IP: ip})
+			}
+			return ipAddrs, -1, err
+		}
+		ipAddrs, err := r.resolver.LookupIPAddr(ctx, host)
+		return sortIPAddrs(ipAddrs, r.preference), -1, err
 	}
 
 	if r.upstream == nil || len(host) == 0 {
-		return []net.IPAddr{}, nil
+		return []net.IPAddr{}, -1, nil
 	}
 
 	if host[:1] != "." {
 		host += "."
 	}
 
-	ch := make(chan *resultError)
-	go r.resolve(host, dns.TypeA, ch)
-	go r.resolve(host, dns.TypeAAAA, ch)
+	// Cancels the query that is still in progress when we return
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	qtypes := []uint16{dns.TypeA, dns.TypeAAAA}
+	if r.preference == IPv4Only {
+		qtypes = qtypes[:1]
+	}
+
+	// Buffered so that resolve never blocks if we've already returned
+	ch := make(chan *resultError, len(qtypes))
+	for _, qtype := range qtypes {
+		go r.resolve(ctx, host, qtype, ch)
+	}
 
 	var ipAddrs []net.IPAddr
 	var errs []error
+	ttl := time.Duration(-1)
 	n := 0
 wait:
 	for {
@@ -211,19 +371,49 @@ wait:
 				errs = append(errs, re.err)
 			} else {
 				proxyutil.AppendIPAddrs(&ipAddrs, re.resp.Answer)
+				for _, rr := range re.resp.Answer {
+					rrTTL := time.Duration(rr.Header().Ttl) * time.Second
+					if ttl < 0 || rrTTL < ttl {
+						ttl = rrTTL
+					}
+				}
 			}
 			n++
-			if n == 2 {
+			if n == len(qtypes) {
 				break wait
 			}
+		case <-ctx.Done():
+			return []net.IPAddr{}, -1, ctx.Err()
 		}
 	}
 
 	if len(ipAddrs) == 0 && len(errs) != 0 {
-		return []net.IPAddr{}, errs[0]
+		return []net.IPAddr{}, -1, errs[0]
 	}
 
-	return proxyutil.SortIPAddrs(ipAddrs), nil
+	return sortIPAddrs(ipAddrs, r.preference), ttl, nil
+}
+
+// sortIPAddrs sorts the IP addresses according to the preference
+// IPv4 addresses go first unless IPv6 is preferred.
+func sortIPAddrs(ipAddrs []net.IPAddr, preference IPPreference) []net.IPAddr {
+	ipAddrs = proxyutil.SortIPAddrs(ipAddrs)
+	if preference != PreferIPv6 {
+		return ipAddrs
+	}
+
+	sorted := make([]net.IPAddr, 0, len(ipAddrs))
+	for _, addr := range ipAddrs {
+		if addr.IP.To4() == nil {
+			sorted = append(sorted, addr)
+		}
+	}
+	for _, addr := range ipAddrs {
+		if addr.IP.To4() != nil {
+			sorted = append(sorted, addr)
+		}
+	}
+	return sorted
 }
 
 // dialHandler specifies the dial function for creating unencrypted TCP connections.
@@ -260,9 +450,9 @@ func (n *bootstrapper) get() (*tls.Config, dialHandler, error) {
 		n.Lock()
 		defer n.Unlock()
 
-		dialContext := createDialContext([]string{resolverAddress}, n.timeout)
+		dialContext := createDialContext([]string{resolverAddress}, n.eyeballs)
 		n.dialContext = dialContext
-		config := createTLSConfig(host)
+		config := n.createTLSConfig(host)
 		n.resolvedConfig = config
 		return config, n.dialContext, nil
 	}
@@ -276,21 +466,51 @@ func (n *bootstrapper) get() (*tls.Config, dialHandler, error) {
 	// if it's a hostname
 	//
 
-	var ctx context.Context
+	_, err = n.lookup(context.Background(), time.Time{})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	n.Lock()
+	defer n.Unlock()
+
+	if n.dialContext == nil {
+		n.dialContext = n.dialResolved
+		n.resolvedConfig = n.createTLSConfig(host)
+	}
+	return n.resolvedConfig, n.dialContext, nil
+}
+
+// lookup resolves the hostname of the upstream and saves the addresses and their TTL
+// If the hostname has been resolved after since (by a concurrent call), these addresses are returned instead.
+func (n *bootstrapper) lookup(ctx context.Context, since time.Time) ([]string, error) {
+	n.lookupLock.Lock()
+	defer n.lookupLock.Unlock()
+
+	n.RLock()
+	resolved, resolvedAt := n.resolved, n.resolvedAt
+	n.RUnlock()
+	if len(resolved) != 0 && resolvedAt.After(since) {
+		return resolved, nil
+	}
+
+	host, port, err := getAddressHostPort(n.address)
+	if err != nil {
+		return nil, fmt.Errorf("bootstrapper requires port in address %s", n.address)
+	}
+
 	if n.timeout > 0 {
-		ctxWithTimeout, cancel := context.WithTimeout(context.TODO(), n.timeout)
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, n.timeout)
 		defer cancel() // important to avoid a resource leak
-		ctx = ctxWithTimeout
-	} else {
-		ctx = context.Background()
 	}
 
-	addrs, err := LookupParallel(ctx, n.resolvers, host)
+	addrs, ttl, err := lookupParallelTTL(ctx, n.resolvers, host)
 	if err != nil {
-		return nil, nil, errorx.Decorate(err, "failed to lookup %s", host)
+		return nil, errorx.Decorate(err, "failed to lookup %s", host)
 	}
 
-	resolved := []string{}
+	resolved = []string{}
 	for _, addr := range addrs {
 		if addr.IP.To4() == nil && addr.IP.To16() == nil {
 			continue
@@ -301,44 +521,95 @@ func (n *bootstrapper) get() (*tls.Config, dialHandler, error) {
 
 	if len(resolved) == 0 {
 		// couldn't find any suitable IP address
-		return nil, nil, fmt.Errorf("couldn't find any suitable IP address for host %s", host)
+		return nil, fmt.Errorf("couldn't find any suitable IP address for host %s", host)
+	}
+
+	if ttl < 0 || ttl > n.maxTTL {
+		ttl = n.maxTTL
+	} else if ttl < n.minTTL {
+		ttl = n.minTTL
 	}
+	log.Debug("bootstrap: %s is resolved to %v for %s", host, resolved, ttl)
 
+	now := time.Now()
 	n.Lock()
-	defer n.Unlock()
+	n.resolved = resolved
+	n.resolvedAt = now
+	// Refresh the addresses a bit earlier so that they never expire while in use
+	n.refreshAt = now.Add(ttl - ttl/10)
+	n.Unlock()
+	return resolved, nil
+}
 
-	dialContext := createDialContext(resolved, n.timeout)
-	n.dialContext = dialContext
-	n.resolvedConfig = createTLSConfig(host)
-	return n.resolvedConfig, n.dialContext, nil
+// dialResolved connects to the resolved addresses of the hostname one by one.
+// The addresses are refreshed in the background when their TTL is about to expire,
+// the hostname is re-resolved right away if none of them is reachable.
+func (n *bootstrapper) dialResolved(ctx context.Context, network, addr string) (net.Conn, error) {
+	start := time.Now()
+
+	n.Lock()
+	resolved := n.resolved
+	refresh := !n.refreshing && start.After(n.refreshAt)
+	if refresh {
+		n.refreshing = true
+	}
+	n.Unlock()
+
+	if refresh {
+		go n.refresh(start)
+	}
+
+	conn, err := createDialContext(resolved, n.eyeballs)(ctx, network, addr)
+	if err == nil || ctx.Err() != nil {
+		return conn, err
+	}
+
+	log.Debug("bootstrap: failed to connect to %v, resolving %s again", resolved, n.address)
+	updated, lookupErr := n.lookup(ctx, start)
+	if lookupErr != nil {
+		log.Debug("bootstrap: %s", lookupErr)
+		return nil, err
+	}
+	if equalAddresses(resolved, updated) {
+		return nil, err
+	}
+	return createDialContext(updated, n.eyeballs)(ctx, network, addr)
 }
 
-// createDialContext returns dialContext function that tries to establish connection with all given addresses one by one
-func createDialContext(addresses []string, timeout time.Duration) (dialContext dialHandler) {
-	dialer := &net.Dialer{
-		Timeout:   timeout,
-		DualStack: true,
+// refresh resolves the hostname again in the background
+// The old addresses are used until it's done or if it fails.
+func (n *bootstrapper) refresh(since time.Time) {
+	_, err := n.lookup(context.Background(), since)
+
+	n.Lock()
+	defer n.Unlock()
+	n.refreshing = false
+	if err != nil {
+		log.Debug("bootstrap: failed to refresh the addresses: %s", err)
+		// Try again later
+		n.refreshAt = time.Now().Add(n.minTTL)
 	}
+}
 
-	dialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
-		errs := []error{}
-
-		// Return first connection without error
-		// Note that we're using bootstrapped resolverAddress instead of what's passed to the function
-		for _, resolverAddress := range addresses {
-			log.Tracef("Dialing to %s", resolverAddress)
-			start := time.Now()
-			con, err := dialer.DialContext(ctx, network, resolverAddress)
-			elapsed := time.Since(start) / time.Millisecond
-
-			if err == nil {
-				log.Tracef("dialer has successfully initialized connection to %s in %d milliseconds", resolverAddress, elapsed)
-				return con, err
-			}
-			errs = append(errs, err)
-			log.Tracef("dialer failed to initialize connection to %s, in %d milliseconds, cause: %s", resolverAddress, elapsed, err)
+// equalAddresses checks if the lists of addresses are the same
+func equalAddresses(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
 		}
-		return nil, errorx.DecorateMany("all dialers failed to initialize connection: ", errs...)
+	}
+	return true
+}
+
+// createDialContext returns dialContext function that tries to establish connection with the given addresses
+// The IPv4 and IPv6 addresses are raced by eyeballs (see happyEyeballsDialer).
+func createDialContext(addresses []string, eyeballs *happyEyeballsDialer) (dialContext dialHandler) {
+	dialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		// Note that we're using bootstrapped addresses instead of what's passed to the function
+		return eyeballs.dial(ctx, network, addresses)
 	}
 	return
 }
@@ -350,7 +621,90 @@ func createTLSConfig(host string) *tls.Config {
 		RootCAs:      RootCAs,
 		CipherSuites: CipherSuites,
 		MinVersion:   tls.VersionTLS12,
+		// Resume the TLS sessions when new connections are opened
+		ClientSessionCache: tls.NewLRUClientSessionCache(0),
+	}
+}
+
+// createTLSConfig creates the client TLS config for the upstream with the server name and verification overrides
+func (n *bootstrapper) createTLSConfig(host string) *tls.Config {
+	config := createTLSConfig(host)
+	if n.serverName != "" {
+		config.ServerName = n.serverName
+	}
+	config.InsecureSkipVerify = n.insecure // nolint
+	if len(n.pins) > 0 {
+		config.VerifyPeerCertificate = verifyPins(n.pins, n.insecure)
+	}
+	if n.clientCert != nil {
+		config.GetClientCertificate = n.clientCert.getClientCertificate
+	}
+	return config
+}
+
+// verifyPins returns the VerifyPeerCertificate callback that checks that one of the certificates
+// in the server's chain matches one of the pins (see Options.Pins).
+// It's called after the normal verification, so only the verified chains are checked: the server may send
+// any other certificates along with its own. If the verification is disabled, only the leaf certificate is checked.
+func verifyPins(pins [][]byte, insecure bool) func(rawCerts [][]byte, verifiedChains [][]*x509.Certificate) error {
+	return func(rawCerts [][]byte, verifiedChains [][]*x509.Certificate) error {
+		certs := []*x509.Certificate{}
+		if insecure {
+			if len(rawCerts) == 0 {
+				return errors.New("the server has no certificate")
+			}
+			cert, err := x509.ParseCertificate(rawCerts[0])
+			if err != nil {
+				return errorx.Decorate(err, "failed to parse the server certificate")
+			}
+			certs = append(certs, cert)
+		}
+		// The verified chains may include the root certificate that the server doesn't send
+		for _, chain := range verifiedChains {
+			certs = append(certs, chain...)
+		}
+
+		keys := []string{}
+		seen := map[string]bool{}
+		for _, cert := range certs {
+			spki := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+			tbs := sha256.Sum256(cert.RawTBSCertificate)
+			for _, pin := range pins {
+				if bytes.Equal(pin, spki[:]) || bytes.Equal(pin, tbs[:]) {
+					return nil
+				}
+			}
+
+			key := fmt.Sprintf("%s (%s)", base64.StdEncoding.EncodeToString(spki[:]), cert.Subject.CommonName)
+			if !seen[key] {
+				seen[key] = true
+				keys = append(keys, key)
+			}
+		}
+
+		return fmt.Errorf("certificate pin mismatch: none of the server keys %s matches the pinned ones", strings.Join(keys, ", "))
+	}
+}
+
+// parsePin parses the SHA-256 hash encoded with base64 (standard or URL) or hex
+func parsePin(s string) ([]byte, error) {
+	// "+" is decoded as a space in the query string
+	s = strings.ReplaceAll(s, " ", "+")
+
+	decoders := []func(string) ([]byte, error){
+		hex.DecodeString,
+		base64.StdEncoding.DecodeString,
+		base64.RawStdEncoding.DecodeString,
+		base64.URLEncoding.DecodeString,
+		base64.RawURLEncoding.DecodeString,
+	}
+	for _, decode := range decoders {
+		pin, err := decode(s)
+		if err == nil && len(pin) == sha256.Size {
+			return pin, nil
+		}
 	}
+	return nil, fmt.Errorf("%q is not a base64 or hex encoded SHA-256 hash", s)
 }
 
 // getAddressHostPort splits resolver address into host and port
@@ -2,9 +2,13 @@ package upstream
 
 import (
 	"context"
+	"net"
+	"runtime"
+	"sync"
 	"testing"
 	"time"
 
+	"github.com/miekg/dns"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -69,3 +73,192 @@ func TestNewResolverIsValid(t *testing.T) {
 	assert.Nil(t, err)
 	assert.True(t, len(addrs) == 0)
 }
+
+func TestBootstrapTTL(t *testing.T) {
+	bootstrap := startTestBootstrapServer(t, net.IPv4(127, 0, 0, 1), 600)
+	u, err := AddressToUpstream("tls://dns.example", Options{Timeout: timeout, Bootstrap: []string{bootstrap.address}})
+	assert.Nil(t, err)
+	n := u.(*dnsOverTLS).boot
+
+	// The record TTL is used
+	_, _, err = n.get()
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"127.0.0.1:853"}, n.resolved)
+	assert.InDelta(t, float64(540*time.Second), float64(time.Until(n.refreshAt)), float64(time.Second))
+
+	// It's limited by the maximum TTL
+	n, err = toBoot("tls://dns.example:853", Options{Timeout: timeout, Bootstrap: []string{bootstrap.address}, BootstrapMaxTTL: time.Minute})
+	assert.Nil(t, err)
+	_, _, err = n.get()
+	assert.Nil(t, err)
+	assert.InDelta(t, float64(54*time.Second), float64(time.Until(n.refreshAt)), float64(time.Second))
+
+	// And by the minimum TTL
+	bootstrap.set(net.IPv4(127, 0, 0, 1), 0)
+	n, err = toBoot("tls://dns.example:853", Options{Timeout: timeout, Bootstrap: []string{bootstrap.address}})
+	assert.Nil(t, err)
+	_, _, err = n.get()
+	assert.Nil(t, err)
+	assert.InDelta(t, float64(27*time.Second), float64(time.Until(n.refreshAt)), float64(time.Second))
+}
+
+func TestBootstrapRefresh(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("listening on 127.0.0.2 requires the whole 127.0.0.0/8 on the loopback interface")
+	}
+	port, accepted1, accepted2 := startTestBootstrapTargets(t)
+
+	bootstrap := startTestBootstrapServer(t, net.IPv4(127, 0, 0, 1), 0)
+	n, err := toBoot("tls://dns.example:"+port, Options{Timeout: timeout, Bootstrap: []string{bootstrap.address}, BootstrapMinTTL: 100 * time.Millisecond})
+	assert.Nil(t, err)
+	_, dialContext, err := n.get()
+	assert.Nil(t, err)
+
+	conn, err := dialContext(context.Background(), "tcp", "")
+	assert.Nil(t, err)
+	_ = conn.Close()
+	accepted1.waitFor(t, 1)
+
+	// The addresses are refreshed in the background when the TTL expires,
+	// the old ones are used in the meantime
+	bootstrap.set(net.IPv4(127, 0, 0, 2), 0)
+	time.Sleep(150 * time.Millisecond)
+	conn, err = dialContext(context.Background(), "tcp", "")
+	assert.Nil(t, err)
+	_ = conn.Close()
+	accepted1.waitFor(t, 2)
+
+	assert.Eventually(t, func() bool {
+		n.RLock()
+		defer n.RUnlock()
+		return n.resolved[0] == net.JoinHostPort("127.0.0.2", port)
+	}, time.Second, 10*time.Millisecond)
+
+	conn, err = dialContext(context.Background(), "tcp", "")
+	assert.Nil(t, err)
+	_ = conn.Close()
+	accepted2.waitFor(t, 1)
+}
+
+func TestBootstrapReResolve(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("listening on 127.0.0.2 requires the whole 127.0.0.0/8 on the loopback interface")
+	}
+	port, accepted1, accepted2 := startTestBootstrapTargets(t)
+
+	bootstrap := startTestBootstrapServer(t, net.IPv4(127, 0, 0, 1), 600)
+	n, err := toBoot("tls://dns.example:"+port, Options{Timeout: timeout, Bootstrap: []string{bootstrap.address}})
+	assert.Nil(t, err)
+	_, dialContext, err := n.get()
+	assert.Nil(t, err)
+
+	conn, err := dialContext(context.Background(), "tcp", "")
+	assert.Nil(t, err)
+	_ = conn.Close()
+	accepted1.waitFor(t, 1)
+
+	// The server moves to another address, the hostname is resolved again right away
+	_ = accepted1.listener.Close()
+	bootstrap.set(net.IPv4(127, 0, 0, 2), 600)
+	conn, err = dialContext(context.Background(), "tcp", "")
+	assert.Nil(t, err)
+	_ = conn.Close()
+	accepted2.waitFor(t, 1)
+
+	// No addresses are reachable
+	_ = accepted2.listener.Close()
+	_, err = dialContext(context.Background(), "tcp", "")
+	assert.NotNil(t, err)
+}
+
+// testBootstrapServer is a DNS-over-TCP server that resolves every name to the specified address
+type testBootstrapServer struct {
+	address string // tcp://host:port
+	ip      net.IP
+	ttl     uint32
+	lock    sync.Mutex
+}
+
+// set changes the address and the TTL of the records
+func (s *testBootstrapServer) set(ip net.IP, ttl uint32) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.ip, s.ttl = ip, ttl
+}
+
+// startTestBootstrapServer starts a new testBootstrapServer
+func startTestBootstrapServer(t *testing.T, ip net.IP, ttl uint32) *testBootstrapServer {
+	s := &testBootstrapServer{ip: ip, ttl: ttl}
+	addr, _ := startPipelineTestServer(t, func(c *dns.Conn) {
+		for {
+			q, err := c.ReadMsg()
+			if err != nil {
+				return
+			}
+			resp := &dns.Msg{}
+			resp.SetReply(q)
+			if q.Question[0].Qtype == dns.TypeA {
+				s.lock.Lock()
+				resp.Answer = append(resp.Answer, &dns.A{
+					Hdr: dns.RR_Header{Name: q.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: s.ttl},
+					A:   s.ip,
+				})
+				s.lock.Unlock()
+			}
+			_ = c.WriteMsg(resp)
+		}
+	})
+	s.address = "tcp://" + addr
+	return s
+}
+
+// testAcceptor counts the accepted connections
+type testAcceptor struct {
+	listener net.Listener
+	accepted int
+	lock     sync.Mutex
+}
+
+// count returns the number of the accepted connections
+func (a *testAcceptor) count() int {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	return a.accepted
+}
+
+// waitFor waits until the number of the accepted connections is n
+func (a *testAcceptor) waitFor(t *testing.T, n int) {
+	assert.Eventually(t, func() bool { return a.count() == n }, time.Second, time.Millisecond)
+}
+
+// startTestBootstrapTargets starts listening on 127.0.0.1 and 127.0.0.2 on the same port
+func startTestBootstrapTargets(t *testing.T) (string, *testAcceptor, *testAcceptor) {
+	l1, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("cannot listen: %s", err)
+	}
+	_, port, _ := net.SplitHostPort(l1.Addr().String())
+	l2, err := net.Listen("tcp", net.JoinHostPort("127.0.0.2", port))
+	if err != nil {
+		t.Fatalf("cannot listen: %s", err)
+	}
+
+	acceptors := []*testAcceptor{{listener: l1}, {listener: l2}}
+	for _, a := range acceptors {
+		a := a
+		t.Cleanup(func() { _ = a.listener.Close() })
+		go func() {
+			for {
+				conn, err := a.listener.Accept()
+				if err != nil {
+					return
+				}
+				a.lock.Lock()
+				a.accepted++
+				a.lock.Unlock()
+				_ = conn.Close()
+			}
+		}()
+	}
+	return port, acceptors[0], acceptors[1]
+}
@@ -0,0 +1,90 @@
+package upstream
+
+import (
+	"crypto/tls"
+	"errors"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/AdguardTeam/golibs/log"
+	"github.com/joomcode/errorx"
+)
+
+// clientCertLoader loads the TLS client certificate from the PEM files
+// and reloads it when the files are changed
+type clientCertLoader struct {
+	certFile string // path to the PEM-encoded certificate (chain)
+	keyFile  string // path to the PEM-encoded private key
+
+	cert    *tls.Certificate // the last successfully loaded certificate
+	certMod time.Time        // modification time of certFile when cert was loaded
+	keyMod  time.Time        // modification time of keyFile when cert was loaded
+	lock    sync.Mutex       // protects cert, certMod and keyMod
+}
+
+// newClientCertLoader creates a new clientCertLoader and loads the certificate
+// Returns nil if neither of the files is specified
+func newClientCertLoader(certFile, keyFile string) (*clientCertLoader, error) {
+	if certFile == "" && keyFile == "" {
+		return nil, nil
+	}
+	if certFile == "" || keyFile == "" {
+		return nil, errors.New("both the client certificate and the private key must be specified")
+	}
+
+	l := &clientCertLoader{certFile: certFile, keyFile: keyFile}
+	_, err := l.get()
+	if err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+// get returns the client certificate, it's reloaded if the files have been modified since it was loaded.
+// If the reload fails, the previous certificate is used.
+func (l *clientCertLoader) get() (*tls.Certificate, error) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	certMod, keyMod, err := l.modTimes()
+	if err == nil && l.cert != nil && certMod.Equal(l.certMod) && keyMod.Equal(l.keyMod) {
+		return l.cert, nil
+	}
+
+	if err == nil {
+		var cert tls.Certificate
+		cert, err = tls.LoadX509KeyPair(l.certFile, l.keyFile)
+		if err == nil {
+			if l.cert != nil {
+				log.Printf("Reloaded the client certificate from %s", l.certFile)
+			}
+			l.cert, l.certMod, l.keyMod = &cert, certMod, keyMod
+			return l.cert, nil
+		}
+	}
+
+	if l.cert == nil {
+		return nil, errorx.Decorate(err, "failed to load the client certificate %s", l.certFile)
+	}
+	log.Error("failed to reload the client certificate %s, using the previous one: %s", l.certFile, err)
+	return l.cert, nil
+}
+
+// modTimes returns the modification times of the certificate and the key files
+func (l *clientCertLoader) modTimes() (time.Time, time.Time, error) {
+	certInfo, err := os.Stat(l.certFile)
+	if err != nil {
+		return time.Time{}, time.Time{}, err
+	}
+	keyInfo, err := os.Stat(l.keyFile)
+	if err != nil {
+		return time.Time{}, time.Time{}, err
+	}
+	return certInfo.ModTime(), keyInfo.ModTime(), nil
+}
+
+// getClientCertificate implements the tls.Config.GetClientCertificate callback
+func (l *clientCertLoader) getClientCertificate(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+	return l.get()
+}
@@ -0,0 +1,154 @@
+package upstream
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestUpstreamClientCert(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile, clientCert := writeTestClientCert(t, dir, "client")
+
+	// DoT server that requires the client certificate
+	serverConfig, roots := createServerTLSConfig(t)
+	oldRootCAs := RootCAs
+	RootCAs = roots
+	t.Cleanup(func() { RootCAs = oldRootCAs })
+
+	clientCAs := x509.NewCertPool()
+	clientCAs.AddCert(clientCert)
+	serverConfig.ClientAuth = tls.RequireAndVerifyClientCert
+	serverConfig.ClientCAs = clientCAs
+
+	l, err := tls.Listen("tcp", "127.0.0.1:0", serverConfig)
+	if err != nil {
+		t.Fatalf("cannot listen: %s", err)
+	}
+	srv := &dns.Server{Listener: l, Net: "tcp-tls", Handler: dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+		resp := &dns.Msg{}
+		resp.SetReply(req)
+		resp.Answer = append(resp.Answer, &dns.A{
+			Hdr: dns.RR_Header{Name: req.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60},
+			A:   net.IPv4(8, 8, 8, 8),
+		})
+		_ = w.WriteMsg(resp)
+	})}
+	go func() {
+		_ = srv.ActivateAndServe()
+	}()
+	defer func() {
+		_ = srv.Shutdown()
+	}()
+
+	_, port, _ := net.SplitHostPort(l.Addr().String())
+	address := "tls://" + net.JoinHostPort(tlsServerName, port)
+
+	// The global client certificate
+	u, err := AddressToUpstream(address, Options{Timeout: timeout, ServerIP: net.IPv4(127, 0, 0, 1), ClientCertFile: certFile, ClientKeyFile: keyFile})
+	assert.Nil(t, err)
+	checkUpstream(t, u, address)
+
+	// The upstream's own client certificate
+	u, err = AddressToUpstream(address+"?ip=127.0.0.1&cert="+certFile+"&key="+keyFile, Options{Timeout: timeout})
+	assert.Nil(t, err)
+	checkUpstream(t, u, address)
+
+	// No client certificate
+	u, err = AddressToUpstream(address+"?ip=127.0.0.1", Options{Timeout: timeout})
+	assert.Nil(t, err)
+	_, err = u.Exchange(createTestMessage())
+	assert.NotNil(t, err)
+
+	// Invalid settings
+	_, err = AddressToUpstream(address+"?cert="+certFile, Options{})
+	assert.NotNil(t, err)
+	_, err = AddressToUpstream(address+"?cert="+certFile+"&key="+filepath.Join(dir, "nonexistent.key"), Options{})
+	assert.NotNil(t, err)
+}
+
+func TestClientCertReload(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile, cert1 := writeTestClientCert(t, dir, "client1")
+
+	l, err := newClientCertLoader(certFile, keyFile)
+	assert.Nil(t, err)
+	cert, err := l.get()
+	assert.Nil(t, err)
+	assert.Equal(t, cert1.Raw, cert.Certificate[0])
+
+	// The files are replaced
+	_, _, cert2 := writeTestClientCert(t, dir, "client2")
+	future := time.Now().Add(time.Minute)
+	assert.Nil(t, os.Chtimes(certFile, future, future))
+	assert.Nil(t, os.Chtimes(keyFile, future, future))
+
+	cert, err = l.get()
+	assert.Nil(t, err)
+	assert.Equal(t, cert2.Raw, cert.Certificate[0])
+
+	// The broken files are ignored, the previous certificate is used
+	assert.Nil(t, ioutil.WriteFile(keyFile, []byte("broken"), 0600))
+	future = future.Add(time.Minute)
+	assert.Nil(t, os.Chtimes(keyFile, future, future))
+
+	cert, err = l.get()
+	assert.Nil(t, err)
+	assert.Equal(t, cert2.Raw, cert.Certificate[0])
+}
+
+// writeTestClientCert creates a self-signed client certificate and writes it to client.crt and client.key in dir
+func writeTestClientCert(t *testing.T, dir, commonName string) (string, string, *x509.Certificate) {
+	privateKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("cannot generate the key: %s", err)
+	}
+
+	template := x509.Certificate{
+		SerialNumber:          big.NewInt(2),
+		Subject:               pkix.Name{CommonName: commonName, Organization: []string{"AdGuard Tests"}},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(24 * time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+	}
+	derBytes, err := x509.CreateCertificate(rand.Reader, &template, &template, &privateKey.PublicKey, privateKey)
+	if err != nil {
+		t.Fatalf("failed to create certificate: %s", err)
+	}
+	cert, err := x509.ParseCertificate(derBytes)
+	if err != nil {
+		t.Fatalf("failed to parse certificate: %s", err)
+	}
+	keyBytes, err := x509.MarshalECPrivateKey(privateKey)
+	if err != nil {
+		t.Fatalf("failed to marshal the key: %s", err)
+	}
+
+	certFile := filepath.Join(dir, "client.crt")
+	keyFile := filepath.Join(dir, "client.key")
+	err = ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: derBytes}), 0600)
+	if err != nil {
+		t.Fatalf("failed to write the certificate: %s", err)
+	}
+	err = ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyBytes}), 0600)
+	if err != nil {
+		t.Fatalf("failed to write the key: %s", err)
+	}
+	return certFile, keyFile, cert
+}
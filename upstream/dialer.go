@@ -0,0 +1,390 @@
+package upstream
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/AdguardTeam/golibs/log"
+	"github.com/joomcode/errorx"
+	"golang.org/x/net/proxy"
+)
+
+// contextDialer opens the network connections to the upstreams
+type contextDialer interface {
+	DialContext(ctx context.Context, network, address string) (net.Conn, error)
+}
+
+// newDialer creates the dialer for the upstream connections
+// The connections are bound to opts.OutboundAddr and opts.OutboundInterface
+// and are sent through opts.Proxy if they're specified.
+func newDialer(opts Options) (contextDialer, error) {
+	dialer, err := newDirectDialer(opts)
+	if err != nil {
+		return nil, err
+	}
+	if opts.Proxy == nil {
+		return dialer, nil
+	}
+	return newProxyDialer(opts.Proxy, dialer.netDialer("tcp"), opts.Timeout)
+}
+
+// directDialer opens the connections directly from the outbound address and interface (if any)
+type directDialer struct {
+	timeout  time.Duration // maximum time to connect (0 == infinite)
+	localIP  net.IP        // the source address (nil means any)
+	iface    string        // the network interface the sockets are bound to (empty means any)
+	bindFunc controlFunc   // binds the sockets to iface
+}
+
+// controlFunc is the net.Dialer.Control callback
+type controlFunc func(network, address string, c syscall.RawConn) error
+
+// newDirectDialer creates a new directDialer with the specified options
+func newDirectDialer(opts Options) (*directDialer, error) {
+	d := &directDialer{timeout: opts.Timeout, localIP: opts.OutboundAddr, iface: opts.OutboundInterface}
+	if d.iface != "" {
+		_, err := net.InterfaceByName(d.iface)
+		if err != nil {
+			return nil, errorx.Decorate(err, "invalid outbound interface %s", d.iface)
+		}
+		d.bindFunc, err = bindToDevice(d.iface)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return d, nil
+}
+
+// netDialer returns the net.Dialer for the specified network ("udp" or "tcp")
+func (d *directDialer) netDialer(network string) *net.Dialer {
+	dialer := &net.Dialer{Timeout: d.timeout}
+	if d.localIP != nil {
+		if strings.HasPrefix(network, "udp") {
+			dialer.LocalAddr = &net.UDPAddr{IP: d.localIP}
+		} else {
+			dialer.LocalAddr = &net.TCPAddr{IP: d.localIP}
+		}
+	}
+	if d.bindFunc != nil {
+		dialer.Control = d.bindFunc
+	}
+	return dialer
+}
+
+// listenUDP opens the unconnected UDP socket on the outbound address and interface (if any)
+func (d *directDialer) listenUDP(ctx context.Context) (net.PacketConn, error) {
+	lc := &net.ListenConfig{}
+	if d.bindFunc != nil {
+		lc.Control = d.bindFunc
+	}
+	host := ""
+	if d.localIP != nil {
+		host = d.localIP.String()
+	}
+	return lc.ListenPacket(ctx, "udp", net.JoinHostPort(host, "0"))
+}
+
+// DialContext implements the contextDialer interface for *directDialer
+func (d *directDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	return d.netDialer(network).DialContext(ctx, network, address)
+}
+
+// proxyDialer opens the TCP connections through a SOCKS5 or HTTP CONNECT proxy
+type proxyDialer struct {
+	proxyURL *url.URL      // proxy address (for logging)
+	dialer   contextDialer // dials through the proxy
+	timeout  time.Duration // maximum time to connect through the proxy (0 == infinite)
+}
+
+// newProxyDialer creates a new dialer that connects through the proxy
+// Supported schemes: socks5://[user:pass@]host:port and http://[user:pass@]host:port
+func newProxyDialer(proxyURL *url.URL, forward *net.Dialer, timeout time.Duration) (*proxyDialer, error) {
+	d := &proxyDialer{proxyURL: proxyURL, timeout: timeout}
+
+	switch proxyURL.Scheme {
+	case "socks5", "socks5h":
+		var auth *proxy.Auth
+		if proxyURL.User != nil {
+			auth = &proxy.Auth{User: proxyURL.User.Username()}
+			auth.Password, _ = proxyURL.User.Password()
+		}
+		socks, err := proxy.SOCKS5("tcp", hostWithDefaultPort(proxyURL, "1080"), auth, forward)
+		if err != nil {
+			return nil, errorx.Decorate(err, "failed to create the SOCKS5 dialer for %s", proxyURL.Redacted())
+		}
+		d.dialer = socks.(proxy.ContextDialer)
+	case "http":
+		d.dialer = &httpConnectDialer{
+			address: hostWithDefaultPort(proxyURL, "80"),
+			user:    proxyURL.User,
+			forward: forward,
+		}
+	default:
+		return nil, fmt.Errorf("unsupported proxy %s: the scheme must be socks5 or http", proxyURL.Redacted())
+	}
+
+	return d, nil
+}
+
+// DialContext implements the contextDialer interface for *proxyDialer
+func (d *proxyDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	if !strings.HasPrefix(network, "tcp") {
+		return nil, fmt.Errorf("%s connections to %s can't be sent through the proxy %s", network, address, d.proxyURL.Redacted())
+	}
+
+	if d.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, d.timeout)
+		defer cancel()
+	}
+
+	conn, err := d.dialer.DialContext(ctx, network, address)
+	if err != nil {
+		return nil, errorx.Decorate(err, "failed to connect to %s through the proxy %s", address, d.proxyURL.Redacted())
+	}
+	return conn, nil
+}
+
+// httpConnectDialer opens the TCP connections through an HTTP proxy using the CONNECT method
+type httpConnectDialer struct {
+	address string        // proxy host:port
+	user    *url.Userinfo // proxy credentials (nil if there are none)
+	forward *net.Dialer   // dials the proxy
+}
+
+// DialContext implements the contextDialer interface for *httpConnectDialer
+func (d *httpConnectDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	conn, err := d.forward.DialContext(ctx, network, d.address)
+	if err != nil {
+		return nil, err
+	}
+
+	stop := closeOnDone(ctx, conn)
+	br, err := d.connect(conn, address)
+	if !stop() {
+		// The connection has been closed
+		return nil, ctx.Err()
+	}
+	if err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+
+	if br.Buffered() > 0 {
+		// The data sent by the server after the response must not be lost
+		return &bufferedConn{Conn: conn, r: br}, nil
+	}
+	return conn, nil
+}
+
+// connect sends the CONNECT request and reads the response
+func (d *httpConnectDialer) connect(conn net.Conn, address string) (*bufio.Reader, error) {
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: address},
+		Host:   address,
+		Header: http.Header{},
+	}
+	if d.user != nil {
+		password, _ := d.user.Password()
+		credentials := base64.StdEncoding.EncodeToString([]byte(d.user.Username() + ":" + password))
+		req.Header.Set("Proxy-Authorization", "Basic "+credentials)
+	}
+
+	err := req.Write(conn)
+	if err != nil {
+		return nil, errorx.Decorate(err, "failed to send the CONNECT request")
+	}
+
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, req)
+	if err != nil {
+		return nil, errorx.Decorate(err, "failed to read the CONNECT response")
+	}
+	_ = resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("the proxy refused to connect to %s: %s", address, resp.Status)
+	}
+	return br, nil
+}
+
+// bufferedConn is a net.Conn that reads the data buffered by the reader first
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+// Read implements the net.Conn interface for *bufferedConn
+func (c *bufferedConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+// hostWithDefaultPort returns the URL's host:port, the default port is used if it isn't specified
+func hostWithDefaultPort(u *url.URL, defaultPort string) string {
+	if u.Port() == "" {
+		return net.JoinHostPort(u.Hostname(), defaultPort)
+	}
+	return u.Host
+}
+
+// connectionAttemptDelay is the time to wait for a connection attempt before starting the next one (RFC 8305)
+const connectionAttemptDelay = 250 * time.Millisecond
+
+// happyEyeballsDialer connects to the first reachable address of a list racing the IPv4 and IPv6 ones (RFC 8305)
+// The attempts are staggered by connectionAttemptDelay, a failed attempt starts the next one right away.
+type happyEyeballsDialer struct {
+	dialer     contextDialer // opens the connections
+	preference IPPreference  // the address family preference
+	delay      time.Duration // the Connection Attempt Delay
+	lastFamily int32         // the family of the last successful connection, 4 or 6 (0 if none), accessed atomically
+}
+
+// newHappyEyeballsDialer creates a new happyEyeballsDialer
+func newHappyEyeballsDialer(dialer contextDialer, preference IPPreference) *happyEyeballsDialer {
+	return &happyEyeballsDialer{dialer: dialer, preference: preference, delay: connectionAttemptDelay}
+}
+
+// dialResult is the result of a connection attempt
+type dialResult struct {
+	conn    net.Conn
+	address string
+	err     error
+}
+
+// dial connects to the first reachable address
+func (h *happyEyeballsDialer) dial(ctx context.Context, network string, addresses []string) (net.Conn, error) {
+	addresses = h.sort(addresses)
+	if len(addresses) == 0 {
+		return nil, fmt.Errorf("no suitable addresses to connect to (%s)", h.preference)
+	}
+
+	// Cancels the attempts that are still in progress when we return
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	// Buffered so that the attempts never block if we've already returned
+	results := make(chan dialResult, len(addresses))
+	next := 0
+	startNext := func() <-chan time.Time {
+		address := addresses[next]
+		next++
+		go func() {
+			log.Tracef("Dialing to %s", address)
+			start := time.Now()
+			conn, err := h.dialer.DialContext(ctx, network, address)
+			elapsed := time.Since(start) / time.Millisecond
+			if err == nil {
+				log.Tracef("dialer has successfully initialized connection to %s in %d milliseconds", address, elapsed)
+			} else {
+				log.Tracef("dialer failed to initialize connection to %s, in %d milliseconds, cause: %s", address, elapsed, err)
+			}
+			results <- dialResult{conn: conn, address: address, err: err}
+		}()
+
+		if next == len(addresses) {
+			// No more attempts to start
+			return nil
+		}
+		return time.After(h.delay)
+	}
+
+	errs := []error{}
+	delay := startNext()
+	for pending := 1; pending > 0; {
+		select {
+		case r := <-results:
+			pending--
+			if r.err == nil {
+				h.remember(r.address)
+				go closeLateConns(results, pending)
+				return r.conn, nil
+			}
+			errs = append(errs, r.err)
+			if next < len(addresses) {
+				delay = startNext()
+				pending++
+			}
+		case <-delay:
+			delay = startNext()
+			pending++
+		}
+	}
+	return nil, errorx.DecorateMany("all dialers failed to initialize connection: ", errs...)
+}
+
+// closeLateConns closes the connections of the n attempts that have finished after the winning one
+func closeLateConns(results chan dialResult, n int) {
+	for i := 0; i < n; i++ {
+		r := <-results
+		if r.conn != nil {
+			_ = r.conn.Close()
+		}
+	}
+}
+
+// sort orders the addresses for the connection attempts interleaving the address families,
+// the preferred family (or the one of the last successful connection) goes first.
+// The IPv6 addresses are removed if only IPv4 can be used.
+func (h *happyEyeballsDialer) sort(addresses []string) []string {
+	var ipv4, ipv6 []string
+	for _, address := range addresses {
+		if addressFamily(address) == 6 {
+			ipv6 = append(ipv6, address)
+		} else {
+			ipv4 = append(ipv4, address)
+		}
+	}
+
+	first, second := ipv4, ipv6
+	switch h.preference {
+	case IPv4Only:
+		return ipv4
+	case PreferIPv4:
+	case PreferIPv6:
+		first, second = ipv6, ipv4
+	default:
+		lastFamily := atomic.LoadInt32(&h.lastFamily)
+		if lastFamily == 6 || (lastFamily == 0 && len(addresses) > 0 && addressFamily(addresses[0]) == 6) {
+			first, second = ipv6, ipv4
+		}
+	}
+
+	sorted := make([]string, 0, len(addresses))
+	for i := 0; i < len(first) || i < len(second); i++ {
+		if i < len(first) {
+			sorted = append(sorted, first[i])
+		}
+		if i < len(second) {
+			sorted = append(sorted, second[i])
+		}
+	}
+	return sorted
+}
+
+// remember saves the family of the address the connection has been established to
+func (h *happyEyeballsDialer) remember(address string) {
+	atomic.StoreInt32(&h.lastFamily, int32(addressFamily(address)))
+}
+
+// addressFamily returns the family of the host:port address, 4 or 6
+func addressFamily(address string) int {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		host = address
+	}
+	ip := net.ParseIP(host)
+	if ip != nil && ip.To4() == nil {
+		return 6
+	}
+	return 4
+}
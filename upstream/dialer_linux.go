@@ -0,0 +1,28 @@
+//go:build linux
+// +build linux
+
+package upstream
+
+import (
+	"syscall"
+
+	"github.com/joomcode/errorx"
+	"golang.org/x/sys/unix"
+)
+
+// bindToDevice returns the net.Dialer.Control callback that binds the sockets to the network interface (SO_BINDTODEVICE)
+func bindToDevice(iface string) (controlFunc, error) {
+	return func(_, _ string, c syscall.RawConn) error {
+		var opErr error
+		err := c.Control(func(fd uintptr) {
+			opErr = unix.SetsockoptString(int(fd), unix.SOL_SOCKET, unix.SO_BINDTODEVICE, iface)
+		})
+		if err != nil {
+			return err
+		}
+		if opErr != nil {
+			return errorx.Decorate(opErr, "failed to bind the socket to %s", iface)
+		}
+		return nil
+	}, nil
+}
@@ -0,0 +1,13 @@
+//go:build !linux
+// +build !linux
+
+package upstream
+
+import (
+	"fmt"
+)
+
+// bindToDevice returns an error, binding the sockets to the network interface is supported on Linux only
+func bindToDevice(iface string) (controlFunc, error) {
+	return nil, fmt.Errorf("cannot bind to the interface %s: only supported on Linux", iface)
+}
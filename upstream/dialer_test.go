@@ -0,0 +1,652 @@
+package upstream
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"runtime"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/ameshkov/dnscrypt/v2"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestUpstreamProxy(t *testing.T) {
+	// DNS-over-TCP server that answers every query
+	addr, _ := startPipelineTestServer(t, func(c *dns.Conn) {
+		for {
+			q, err := c.ReadMsg()
+			if err != nil {
+				return
+			}
+			_ = c.WriteMsg(pipelineTestReply(q))
+		}
+	})
+
+	socksAddr, socksConns := startTestSOCKS5Proxy(t, "user", "pass")
+	httpAddr, httpConns := startTestHTTPProxy(t, "user", "pass")
+
+	proxies := []struct {
+		proxyURL string
+		conns    *int32
+	}{
+		{proxyURL: "socks5://user:pass@" + socksAddr, conns: socksConns},
+		{proxyURL: "http://user:pass@" + httpAddr, conns: httpConns},
+	}
+
+	for _, test := range proxies {
+		t.Run(test.proxyURL, func(t *testing.T) {
+			proxyURL, _ := url.Parse(test.proxyURL)
+			u, err := AddressToUpstream("tcp://"+addr, Options{Timeout: timeout, Proxy: proxyURL})
+			assert.Nil(t, err)
+
+			reply, err := u.Exchange(createHostTestMessage("example.org"))
+			assert.Nil(t, err)
+			assert.NotNil(t, reply)
+			assert.Equal(t, int32(1), atomic.LoadInt32(test.conns))
+
+			// Wrong credentials
+			proxyURL.User = url.UserPassword("user", "wrong")
+			u, err = AddressToUpstream("tcp://"+addr, Options{Timeout: timeout, Proxy: proxyURL})
+			assert.Nil(t, err)
+			_, err = u.Exchange(createHostTestMessage("example.org"))
+			assert.NotNil(t, err)
+		})
+	}
+}
+
+func TestUpstreamProxyBootstrap(t *testing.T) {
+	// DNS-over-TCP server that resolves every name to 127.0.0.1
+	addr, _ := startPipelineTestServer(t, func(c *dns.Conn) {
+		for {
+			q, err := c.ReadMsg()
+			if err != nil {
+				return
+			}
+			resp := &dns.Msg{}
+			resp.SetReply(q)
+			if q.Question[0].Qtype == dns.TypeA {
+				resp.Answer = append(resp.Answer, &dns.A{
+					Hdr: dns.RR_Header{Name: q.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60},
+					A:   net.IPv4(127, 0, 0, 1),
+				})
+			}
+			_ = c.WriteMsg(resp)
+		}
+	})
+
+	socksAddr, socksConns := startTestSOCKS5Proxy(t, "", "")
+	proxyURL, _ := url.Parse("socks5://" + socksAddr)
+
+	// The plain bootstrap DNS server is queried over TCP through the proxy
+	r := newResolver(addr, Options{Timeout: timeout, Proxy: proxyURL}, nil)
+	assert.Equal(t, "tcp://"+addr, r.upstream.Address())
+
+	addrs, err := r.LookupIPAddr(context.Background(), "dns.example")
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(addrs))
+	assert.True(t, atomic.LoadInt32(socksConns) > 0)
+}
+
+// recordingDialer records the addresses it's asked to connect to and fails
+type recordingDialer struct {
+	addrs []string
+}
+
+func (d *recordingDialer) DialContext(_ context.Context, _, address string) (net.Conn, error) {
+	d.addrs = append(d.addrs, address)
+	return nil, errors.New("dialing is not allowed")
+}
+
+func TestSystemResolverDialLoopback(t *testing.T) {
+	proxyDialer := &recordingDialer{}
+	dial := systemResolverDial(proxyDialer, &directDialer{timeout: timeout})
+
+	// The loopback system resolver is connected to directly
+	l, err := net.ListenPacket("udp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	defer l.Close()
+	conn, err := dial(context.Background(), "udp", l.LocalAddr().String())
+	assert.Nil(t, err)
+	_ = conn.Close()
+	assert.Equal(t, 0, len(proxyDialer.addrs))
+
+	// The other ones are sent through the proxy
+	_, err = dial(context.Background(), "udp", "192.0.2.1:53")
+	assert.NotNil(t, err)
+	assert.Equal(t, []string{"192.0.2.1:53"}, proxyDialer.addrs)
+}
+
+func TestUpstreamProxyUnsupported(t *testing.T) {
+	proxyURL, _ := url.Parse("socks5://127.0.0.1:1080")
+
+	addresses := []string{
+		"8.8.8.8",
+		"udp://8.8.8.8",
+		"quic://dns.adguard.com",
+		// AdGuard DNS (DNSCrypt)
+		"sdns://AQIAAAAAAAAAFDE3Ni4xMDMuMTMwLjEzMDo1NDQzINErR_JS3PLCu_iZEIbq95zkSV2LFsigxDIuUso_OQhzIjIuZG5zY3J5cHQuZGVmYXVsdC5uczEuYWRndWFyZC5jb20",
+	}
+	for _, address := range addresses {
+		_, err := AddressToUpstream(address, Options{Proxy: proxyURL})
+		assert.NotNil(t, err, address)
+	}
+
+	proxyURL, _ = url.Parse("ftp://127.0.0.1")
+	_, err := AddressToUpstream("tcp://8.8.8.8", Options{Proxy: proxyURL})
+	assert.NotNil(t, err)
+}
+
+func TestUpstreamOutboundAddr(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("binding to 127.0.0.2 requires the whole 127.0.0.0/8 on the loopback interface")
+	}
+	outbound := net.IPv4(127, 0, 0, 2)
+
+	// Plain DNS server that remembers the clients' addresses
+	var lock sync.Mutex
+	var clients []string
+	handler := dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+		host, _, _ := net.SplitHostPort(w.RemoteAddr().String())
+		lock.Lock()
+		clients = append(clients, host)
+		lock.Unlock()
+		_ = w.WriteMsg(pipelineTestReply(req))
+	})
+	udpConn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("cannot listen: %s", err)
+	}
+	tcpListener, err := net.Listen("tcp", udpConn.LocalAddr().String())
+	if err != nil {
+		t.Fatalf("cannot listen: %s", err)
+	}
+	udpSrv := &dns.Server{PacketConn: udpConn, Handler: handler}
+	tcpSrv := &dns.Server{Listener: tcpListener, Handler: handler}
+	go func() { _ = udpSrv.ActivateAndServe() }()
+	go func() { _ = tcpSrv.ActivateAndServe() }()
+	t.Cleanup(func() {
+		_ = udpSrv.Shutdown()
+		_ = tcpSrv.Shutdown()
+	})
+
+	addr := udpConn.LocalAddr().String()
+	for _, address := range []string{addr, "tcp://" + addr} {
+		u, err := AddressToUpstream(address, Options{Timeout: timeout, OutboundAddr: outbound})
+		assert.Nil(t, err)
+		_, err = u.Exchange(createHostTestMessage("example.org"))
+		assert.Nil(t, err, address)
+	}
+
+	lock.Lock()
+	defer lock.Unlock()
+	assert.Equal(t, []string{"127.0.0.2", "127.0.0.2"}, clients)
+}
+
+func TestUpstreamOutboundAddrDNSCrypt(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("binding to 127.0.0.2 requires the whole 127.0.0.0/8 on the loopback interface")
+	}
+
+	rc, err := dnscrypt.GenerateResolverConfig("example.org", nil)
+	if err != nil {
+		t.Fatalf("cannot generate DNSCrypt config: %s", err)
+	}
+	cert, err := rc.CreateCert()
+	if err != nil {
+		t.Fatalf("cannot create DNSCrypt certificate: %s", err)
+	}
+
+	// DNSCrypt server that answers with the client's address
+	srv := &dnscrypt.Server{ProviderName: rc.ProviderName, ResolverCert: cert, Handler: dnsCryptTestHandler{}}
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("cannot listen: %s", err)
+	}
+	go func() { _ = srv.ServeUDP(conn) }()
+	t.Cleanup(func() { _ = srv.Shutdown(context.Background()) })
+
+	stamp, err := rc.CreateStamp(conn.LocalAddr().String())
+	if err != nil {
+		t.Fatalf("cannot create DNS stamp: %s", err)
+	}
+
+	u, err := AddressToUpstream(stamp.String(), Options{Timeout: timeout, OutboundAddr: net.IPv4(127, 0, 0, 2)})
+	assert.Nil(t, err)
+	reply, err := u.Exchange(createHostTestMessage("example.org"))
+	assert.Nil(t, err)
+	if assert.NotNil(t, reply) && assert.Equal(t, 1, len(reply.Answer)) {
+		assert.Equal(t, "127.0.0.2", reply.Answer[0].(*dns.A).A.String())
+	}
+}
+
+func TestDNSCryptCertTCPFallback(t *testing.T) {
+	rc, err := dnscrypt.GenerateResolverConfig("example.org", nil)
+	if err != nil {
+		t.Fatalf("cannot generate DNSCrypt config: %s", err)
+	}
+	cert, err := rc.CreateCert()
+	if err != nil {
+		t.Fatalf("cannot create DNSCrypt certificate: %s", err)
+	}
+
+	// DNSCrypt server that is only available over TCP
+	srv := &dnscrypt.Server{ProviderName: rc.ProviderName, ResolverCert: cert, Handler: dnsCryptTestHandler{}}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("cannot listen: %s", err)
+	}
+	go func() { _ = srv.ServeTCP(l) }()
+	t.Cleanup(func() { _ = srv.Shutdown(context.Background()) })
+
+	// The certificate requests over UDP get the truncated responses
+	udpConn, err := net.ListenPacket("udp", l.Addr().String())
+	if err != nil {
+		t.Fatalf("cannot listen: %s", err)
+	}
+	defer udpConn.Close()
+	go func() {
+		buf := make([]byte, dns.MaxMsgSize)
+		for {
+			n, addr, err := udpConn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			req := &dns.Msg{}
+			if req.Unpack(buf[:n]) != nil {
+				continue
+			}
+			resp := &dns.Msg{}
+			resp.SetReply(req)
+			resp.Truncated = true
+			packed, _ := resp.Pack()
+			_, _ = udpConn.WriteTo(packed, addr)
+		}
+	}()
+
+	stamp, err := rc.CreateStamp(l.Addr().String())
+	if err != nil {
+		t.Fatalf("cannot create DNS stamp: %s", err)
+	}
+	u, err := AddressToUpstream(stamp.String(), Options{Timeout: timeout})
+	assert.Nil(t, err)
+
+	resolverInfo, err := u.(*dnsCrypt).fetchResolverInfo(context.Background())
+	assert.Nil(t, err)
+	if assert.NotNil(t, resolverInfo) {
+		assert.Equal(t, cert.Serial, resolverInfo.ResolverCert.Serial)
+		assert.Equal(t, l.Addr().String(), resolverInfo.ServerAddress)
+	}
+}
+
+func TestUpstreamOutboundAddrDOQ(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("binding to 127.0.0.2 requires the whole 127.0.0.0/8 on the loopback interface")
+	}
+
+	srv := startTestQUICServer(t, false)
+	defer srv.close()
+
+	address := "quic://" + net.JoinHostPort(tlsServerName, srv.port())
+	opts := Options{Timeout: timeout, ServerIP: net.IPv4(127, 0, 0, 1), OutboundAddr: net.IPv4(127, 0, 0, 2)}
+	u, err := AddressToUpstream(address, opts)
+	assert.Nil(t, err)
+	checkUpstream(t, u, address)
+
+	host, _, _ := net.SplitHostPort(srv.client.Load().(net.Addr).String())
+	assert.Equal(t, "127.0.0.2", host)
+}
+
+func TestUpstreamOutboundInterface(t *testing.T) {
+	_, err := AddressToUpstream("8.8.8.8", Options{OutboundInterface: "nonexistent0"})
+	assert.NotNil(t, err)
+	_, err = AddressToUpstream("tls://1.1.1.1", Options{OutboundInterface: "nonexistent0"})
+	assert.NotNil(t, err)
+
+	if runtime.GOOS != "linux" {
+		_, err = AddressToUpstream("8.8.8.8", Options{OutboundInterface: "lo0"})
+		assert.NotNil(t, err)
+	}
+}
+
+// dnsCryptTestHandler answers the A queries with the client's address
+type dnsCryptTestHandler struct{}
+
+// ServeDNS implements the dnscrypt.Handler interface for dnsCryptTestHandler
+func (dnsCryptTestHandler) ServeDNS(rw dnscrypt.ResponseWriter, r *dns.Msg) error {
+	host, _, _ := net.SplitHostPort(rw.RemoteAddr().String())
+	resp := &dns.Msg{}
+	resp.SetReply(r)
+	resp.Answer = append(resp.Answer, &dns.A{
+		Hdr: dns.RR_Header{Name: r.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60},
+		A:   net.ParseIP(host),
+	})
+	return rw.WriteMsg(resp)
+}
+
+func TestHappyEyeballsSort(t *testing.T) {
+	addresses := []string{"1.1.1.1:853", "1.0.0.1:853", "[2606:4700:4700::1111]:853", "[2606:4700:4700::1001]:853"}
+
+	h := newHappyEyeballsDialer(nil, NoIPPreference)
+	assert.Equal(t, []string{"1.1.1.1:853", "[2606:4700:4700::1111]:853", "1.0.0.1:853", "[2606:4700:4700::1001]:853"}, h.sort(addresses))
+
+	// The family of the last successful connection goes first
+	h.remember("[2606:4700:4700::1001]:853")
+	assert.Equal(t, []string{"[2606:4700:4700::1111]:853", "1.1.1.1:853", "[2606:4700:4700::1001]:853", "1.0.0.1:853"}, h.sort(addresses))
+
+	// The preference is always respected
+	h.preference = PreferIPv4
+	assert.Equal(t, []string{"1.1.1.1:853", "[2606:4700:4700::1111]:853", "1.0.0.1:853", "[2606:4700:4700::1001]:853"}, h.sort(addresses))
+	h.preference = PreferIPv6
+	h.remember("1.1.1.1:853")
+	assert.Equal(t, []string{"[2606:4700:4700::1111]:853", "1.1.1.1:853", "[2606:4700:4700::1001]:853", "1.0.0.1:853"}, h.sort(addresses))
+	h.preference = IPv4Only
+	assert.Equal(t, []string{"1.1.1.1:853", "1.0.0.1:853"}, h.sort(addresses))
+}
+
+func TestHappyEyeballsDial(t *testing.T) {
+	// IPv6 is broken: the connections hang until they're cancelled
+	d := &testFamilyDialer{}
+	h := newHappyEyeballsDialer(d, NoIPPreference)
+	h.delay = 50 * time.Millisecond
+	h.remember("[2001:db8::1]:853")
+	addresses := []string{"[2001:db8::1]:853", "192.0.2.1:853"}
+
+	start := time.Now()
+	conn, err := h.dial(context.Background(), "tcp", addresses)
+	assert.Nil(t, err)
+	assert.True(t, time.Since(start) < time.Second)
+	assert.Equal(t, "192.0.2.1:853", conn.RemoteAddr().String())
+	_ = conn.Close()
+
+	// IPv4 is tried first now
+	assert.Equal(t, []string{"192.0.2.1:853", "[2001:db8::1]:853"}, h.sort(addresses))
+	conn, err = h.dial(context.Background(), "tcp", addresses)
+	assert.Nil(t, err)
+	_ = conn.Close()
+	assert.Equal(t, int32(3), atomic.LoadInt32(&d.attempts))
+
+	// A failed attempt starts the next one right away
+	h.delay = time.Hour
+	d.refuse = true
+	_, err = h.dial(context.Background(), "tcp", []string{"192.0.2.1:853", "192.0.2.2:853"})
+	assert.NotNil(t, err)
+
+	// No suitable addresses
+	h.preference = IPv4Only
+	_, err = h.dial(context.Background(), "tcp", []string{"[2001:db8::1]:853"})
+	assert.NotNil(t, err)
+}
+
+func TestResolverIPPreference(t *testing.T) {
+	var queriesAAAA int32
+	addr, _ := startPipelineTestServer(t, func(c *dns.Conn) {
+		for {
+			q, err := c.ReadMsg()
+			if err != nil {
+				return
+			}
+			resp := &dns.Msg{}
+			resp.SetReply(q)
+			hdr := dns.RR_Header{Name: q.Question[0].Name, Rrtype: q.Question[0].Qtype, Class: dns.ClassINET, Ttl: 60}
+			if q.Question[0].Qtype == dns.TypeA {
+				resp.Answer = append(resp.Answer, &dns.A{Hdr: hdr, A: net.IPv4(192, 0, 2, 1)})
+			} else {
+				atomic.AddInt32(&queriesAAAA, 1)
+				resp.Answer = append(resp.Answer, &dns.AAAA{Hdr: hdr, AAAA: net.ParseIP("2001:db8::1")})
+			}
+			_ = c.WriteMsg(resp)
+		}
+	})
+
+	r := newResolver("tcp://"+addr, Options{Timeout: timeout}, nil)
+	addrs, err := r.LookupIPAddr(context.Background(), "dns.example")
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"192.0.2.1", "2001:db8::1"}, ipAddrsToStrings(addrs))
+
+	r = newResolver("tcp://"+addr, Options{Timeout: timeout, IPPreference: PreferIPv6}, nil)
+	addrs, err = r.LookupIPAddr(context.Background(), "dns.example")
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"2001:db8::1", "192.0.2.1"}, ipAddrsToStrings(addrs))
+	assert.Equal(t, int32(2), atomic.LoadInt32(&queriesAAAA))
+
+	// AAAA records aren't requested at all
+	r = newResolver("tcp://"+addr, Options{Timeout: timeout, IPPreference: IPv4Only}, nil)
+	addrs, err = r.LookupIPAddr(context.Background(), "dns.example")
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"192.0.2.1"}, ipAddrsToStrings(addrs))
+	assert.Equal(t, int32(2), atomic.LoadInt32(&queriesAAAA))
+}
+
+// ipAddrsToStrings converts the addresses to strings
+func ipAddrsToStrings(addrs []net.IPAddr) []string {
+	var s []string
+	for _, addr := range addrs {
+		s = append(s, addr.String())
+	}
+	return s
+}
+
+// testFamilyDialer connects to the IPv4 addresses only, the IPv6 connections hang until the context is done
+type testFamilyDialer struct {
+	attempts int32 // the number of the connection attempts
+	refuse   bool  // if true, the IPv4 connections are refused
+}
+
+// DialContext implements the contextDialer interface for *testFamilyDialer
+func (d *testFamilyDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	atomic.AddInt32(&d.attempts, 1)
+	if addressFamily(address) == 6 {
+		<-ctx.Done()
+		return nil, ctx.Err()
+	}
+	if d.refuse {
+		return nil, fmt.Errorf("connection to %s refused", address)
+	}
+
+	tcpAddr, err := net.ResolveTCPAddr(network, address)
+	if err != nil {
+		return nil, err
+	}
+	client, server := net.Pipe()
+	_ = server.Close()
+	return &testAddrConn{Conn: client, remote: tcpAddr}, nil
+}
+
+// testAddrConn is a net.Conn with the specified remote address
+type testAddrConn struct {
+	net.Conn
+	remote net.Addr
+}
+
+// RemoteAddr implements the net.Conn interface for *testAddrConn
+func (c *testAddrConn) RemoteAddr() net.Addr {
+	return c.remote
+}
+
+// startTestSOCKS5Proxy starts a SOCKS5 proxy that supports the CONNECT command only
+// If user is not empty, the username/password authentication is required.
+// Returns the proxy address and the number of the proxied connections.
+func startTestSOCKS5Proxy(t *testing.T, user, pass string) (string, *int32) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("cannot listen: %s", err)
+	}
+	t.Cleanup(func() {
+		_ = l.Close()
+	})
+
+	var conns int32
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				target, err := socks5Handshake(conn, user, pass)
+				if err != nil {
+					return
+				}
+				atomic.AddInt32(&conns, 1)
+				pipe(conn, target)
+			}()
+		}
+	}()
+
+	return l.Addr().String(), &conns
+}
+
+// socks5Handshake authenticates the client and connects to the requested address
+func socks5Handshake(conn net.Conn, user, pass string) (net.Conn, error) {
+	buf := make([]byte, 256)
+
+	// Version and methods
+	if _, err := io.ReadFull(conn, buf[:2]); err != nil {
+		return nil, err
+	}
+	if _, err := io.ReadFull(conn, buf[:buf[1]]); err != nil {
+		return nil, err
+	}
+
+	if user == "" {
+		_, _ = conn.Write([]byte{5, 0})
+	} else {
+		_, _ = conn.Write([]byte{5, 2})
+
+		// Username/password subnegotiation (RFC 1929)
+		if _, err := io.ReadFull(conn, buf[:2]); err != nil {
+			return nil, err
+		}
+		u := make([]byte, buf[1])
+		if _, err := io.ReadFull(conn, u); err != nil {
+			return nil, err
+		}
+		if _, err := io.ReadFull(conn, buf[:1]); err != nil {
+			return nil, err
+		}
+		p := make([]byte, buf[0])
+		if _, err := io.ReadFull(conn, p); err != nil {
+			return nil, err
+		}
+		if string(u) != user || string(p) != pass {
+			_, _ = conn.Write([]byte{1, 1})
+			return nil, io.EOF
+		}
+		_, _ = conn.Write([]byte{1, 0})
+	}
+
+	// Request
+	if _, err := io.ReadFull(conn, buf[:4]); err != nil {
+		return nil, err
+	}
+	var host string
+	switch buf[3] {
+	case 1:
+		if _, err := io.ReadFull(conn, buf[:4]); err != nil {
+			return nil, err
+		}
+		host = net.IP(buf[:4]).String()
+	case 3:
+		if _, err := io.ReadFull(conn, buf[:1]); err != nil {
+			return nil, err
+		}
+		name := make([]byte, buf[0])
+		if _, err := io.ReadFull(conn, name); err != nil {
+			return nil, err
+		}
+		host = string(name)
+	case 4:
+		if _, err := io.ReadFull(conn, buf[:16]); err != nil {
+			return nil, err
+		}
+		host = net.IP(buf[:16]).String()
+	}
+	if _, err := io.ReadFull(conn, buf[:2]); err != nil {
+		return nil, err
+	}
+	port := binary.BigEndian.Uint16(buf[:2])
+
+	target, err := net.Dial("tcp", net.JoinHostPort(host, strconv.Itoa(int(port))))
+	if err != nil {
+		_, _ = conn.Write([]byte{5, 5, 0, 1, 0, 0, 0, 0, 0, 0})
+		return nil, err
+	}
+	_, _ = conn.Write([]byte{5, 0, 0, 1, 0, 0, 0, 0, 0, 0})
+	return target, nil
+}
+
+// startTestHTTPProxy starts an HTTP proxy that supports the CONNECT method only
+// If user is not empty, the basic authentication is required.
+// Returns the proxy address and the number of the proxied connections.
+func startTestHTTPProxy(t *testing.T, user, pass string) (string, *int32) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("cannot listen: %s", err)
+	}
+
+	var conns int32
+	credentials := "Basic " + base64.StdEncoding.EncodeToString([]byte(user+":"+pass))
+	srv := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodConnect {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		if user != "" && r.Header.Get("Proxy-Authorization") != credentials {
+			w.WriteHeader(http.StatusProxyAuthRequired)
+			return
+		}
+
+		target, err := net.Dial("tcp", r.Host)
+		if err != nil {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		conn, _, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			_ = target.Close()
+			return
+		}
+		defer conn.Close()
+
+		atomic.AddInt32(&conns, 1)
+		_, _ = conn.Write([]byte("HTTP/1.1 200 Connection established\r\n\r\n"))
+		pipe(conn, target)
+	})}
+	go func() {
+		_ = srv.Serve(l)
+	}()
+	t.Cleanup(func() {
+		_ = srv.Close()
+	})
+
+	return l.Addr().String(), &conns
+}
+
+// pipe copies the data between the connections until one of them is closed
+func pipe(conn, target net.Conn) {
+	defer target.Close()
+
+	done := make(chan struct{}, 2)
+	go func() {
+		_, _ = io.Copy(target, conn)
+		done <- struct{}{}
+	}()
+	go func() {
+		_, _ = io.Copy(conn, target)
+		done <- struct{}{}
+	}()
+	<-done
+}
@@ -0,0 +1,245 @@
+package upstream
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/AdguardTeam/golibs/log"
+	"github.com/ameshkov/dnscrypt/v2"
+	"github.com/ameshkov/dnsstamps"
+	"github.com/joomcode/errorx"
+	"github.com/miekg/dns"
+)
+
+const (
+	// relayStampProto is the protocol identifier of the Anonymized DNSCrypt relay stamps
+	relayStampProto = 0x81
+
+	// defaultRelayPort is the port of the relay if the stamp doesn't specify one
+	defaultRelayPort = "443"
+)
+
+// relayMagic starts the queries sent through the Anonymized DNSCrypt relays
+// (https://github.com/DNSCrypt/dnscrypt-protocol/blob/master/ANONYMIZED-DNSCRYPT.txt)
+var relayMagic = []byte{0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0x00, 0x00}
+
+// dnsCryptRelays sends the DNSCrypt queries through the Anonymized DNSCrypt relays so that
+// the resolver doesn't see the client's address. The relay sees the address, but not the content of the queries.
+// The relays are tried in turn starting with the one that has worked last time.
+type dnsCryptRelays struct {
+	addrs   []string      // relay addresses (ip:port)
+	header  []byte        // relayMagic followed by the server's address
+	dialer  contextDialer // dialer for the relay connections
+	timeout time.Duration // timeout of a single relay exchange
+	current int32         // index of the relay that has worked last time
+}
+
+// newDNSCryptRelays parses the relay stamps and creates the relays for the DNSCrypt server with the specified address
+func newDNSCryptRelays(stamps []string, serverAddr string, dialer contextDialer, timeout time.Duration) (*dnsCryptRelays, error) {
+	header, err := relayHeader(serverAddr)
+	if err != nil {
+		return nil, err
+	}
+
+	r := &dnsCryptRelays{header: header, dialer: dialer, timeout: timeout}
+	for _, stamp := range stamps {
+		addr, err := parseRelayStamp(stamp)
+		if err != nil {
+			return nil, errorx.Decorate(err, "invalid relay %s", stamp)
+		}
+		r.addrs = append(r.addrs, addr)
+	}
+	return r, nil
+}
+
+// parseRelayStamp returns the address of the relay from its stamp (sdns://g...).
+// The DNSCrypt server stamps are accepted as well since the DNSCrypt servers may also work as relays.
+func parseRelayStamp(stamp string) (string, error) {
+	if !strings.HasPrefix(stamp, "sdns://") {
+		return "", fmt.Errorf("the relay must be a DNS stamp")
+	}
+	bin, err := base64.RawURLEncoding.DecodeString(stamp[len("sdns://"):])
+	if err != nil || len(bin) == 0 {
+		return "", fmt.Errorf("failed to decode the stamp: %v", err)
+	}
+
+	var addr string
+	switch bin[0] {
+	case relayStampProto:
+		// 0x81 || LP(addr)
+		if len(bin) < 2 || len(bin) < 2+int(bin[1]) {
+			return "", fmt.Errorf("the relay stamp is too short")
+		}
+		addr = string(bin[2 : 2+int(bin[1])])
+	case byte(dnsstamps.StampProtoTypeDNSCrypt):
+		serverStamp, err := dnsstamps.NewServerStampFromString(stamp)
+		if err != nil {
+			return "", err
+		}
+		addr = serverStamp.ServerAddrStr
+	default:
+		return "", fmt.Errorf("unsupported stamp protocol 0x%02x", bin[0])
+	}
+
+	// The address is either ip, [ipv6] or ip:port
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		host, port = strings.TrimSuffix(strings.TrimPrefix(addr, "["), "]"), defaultRelayPort
+	}
+	if net.ParseIP(host) == nil {
+		return "", fmt.Errorf("invalid relay address %s", addr)
+	}
+	return net.JoinHostPort(host, port), nil
+}
+
+// relayHeader returns the header of the relayed queries: relayMagic, server IPv6 (or IPv4-mapped) address
+// and server port
+func relayHeader(serverAddr string) ([]byte, error) {
+	host, port, err := net.SplitHostPort(serverAddr)
+	if err != nil {
+		host, port = serverAddr, defaultRelayPort
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return nil, fmt.Errorf("the relays require the IP address of the DNSCrypt server, got %s", serverAddr)
+	}
+	portNum, err := strconv.ParseUint(port, 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("invalid port of the DNSCrypt server %s", serverAddr)
+	}
+
+	header := append([]byte{}, relayMagic...)
+	header = append(header, ip.To16()...)
+	return binary.BigEndian.AppendUint16(header, uint16(portNum)), nil
+}
+
+// roundTrip sends the packet to the server through the relays and returns the response.
+// The next relay is tried if one fails, the error of the last one is returned if all of them fail.
+func (r *dnsCryptRelays) roundTrip(ctx context.Context, network string, packet []byte) ([]byte, error) {
+	start := int(atomic.LoadInt32(&r.current))
+	var err error
+	for i := 0; i < len(r.addrs); i++ {
+		idx := (start + i) % len(r.addrs)
+		var resp []byte
+		resp, err = r.roundTripRelay(ctx, network, r.addrs[idx], packet)
+		if err == nil {
+			atomic.StoreInt32(&r.current, int32(idx))
+			return resp, nil
+		}
+		if ctx.Err() != nil {
+			break
+		}
+		log.Debug("DNSCrypt relay %s failed: %s", r.addrs[idx], err)
+	}
+	return nil, err
+}
+
+// roundTripRelay sends the packet through the relay, the connection is closed as soon as ctx is done
+func (r *dnsCryptRelays) roundTripRelay(ctx context.Context, network, addr string, packet []byte) ([]byte, error) {
+	conn, err := r.dialer.DialContext(ctx, network, addr)
+	if err != nil {
+		return nil, contextError(ctx, err)
+	}
+	defer conn.Close()
+
+	stop := closeOnDone(ctx, conn)
+	defer stop()
+
+	if timeout := contextTimeout(ctx, r.timeout); timeout > 0 {
+		_ = conn.SetDeadline(time.Now().Add(timeout))
+	}
+
+	query := append(append([]byte{}, r.header...), packet...)
+	if network == "tcp" {
+		l := make([]byte, 2)
+		binary.BigEndian.PutUint16(l, uint16(len(query)))
+		_, err = (&net.Buffers{l, query}).WriteTo(conn)
+		if err != nil {
+			return nil, contextError(ctx, err)
+		}
+
+		_, err = io.ReadFull(conn, l)
+		if err != nil {
+			return nil, contextError(ctx, err)
+		}
+		resp := make([]byte, binary.BigEndian.Uint16(l))
+		_, err = io.ReadFull(conn, resp)
+		return resp, contextError(ctx, err)
+	}
+
+	_, err = conn.Write(query)
+	if err != nil {
+		return nil, contextError(ctx, err)
+	}
+	resp := make([]byte, dns.MaxMsgSize)
+	n, err := conn.Read(resp)
+	if err != nil {
+		return nil, contextError(ctx, err)
+	}
+	return resp[:n], nil
+}
+
+// exchange encrypts the DNS query and sends it through the relays
+func (r *dnsCryptRelays) exchange(ctx context.Context, network string, m *dns.Msg, resolverInfo *dnscrypt.ResolverInfo) (*dns.Msg, error) {
+	packet, err := m.Pack()
+	if err != nil {
+		return nil, err
+	}
+
+	q := dnscrypt.EncryptedQuery{
+		EsVersion:   resolverInfo.ResolverCert.EsVersion,
+		ClientMagic: resolverInfo.ResolverCert.ClientMagic,
+		ClientPk:    resolverInfo.PublicKey,
+	}
+	query, err := q.Encrypt(packet, resolverInfo.SharedKey)
+	if err != nil {
+		return nil, err
+	}
+
+	b, err := r.roundTrip(ctx, network, query)
+	if err != nil {
+		return nil, err
+	}
+
+	resp := dnscrypt.EncryptedResponse{EsVersion: resolverInfo.ResolverCert.EsVersion}
+	packet, err = resp.Decrypt(b, resolverInfo.SharedKey)
+	if err != nil {
+		return nil, err
+	}
+
+	reply := &dns.Msg{}
+	err = reply.Unpack(packet)
+	if err != nil {
+		return nil, err
+	}
+	return reply, nil
+}
+
+// exchangePlain sends the unencrypted DNS query (the certificate request) through the relays
+// over the specified network ("udp" or "tcp")
+func (r *dnsCryptRelays) exchangePlain(ctx context.Context, network string, m *dns.Msg) (*dns.Msg, error) {
+	packet, err := m.Pack()
+	if err != nil {
+		return nil, err
+	}
+
+	b, err := r.roundTrip(ctx, network, packet)
+	if err != nil {
+		return nil, err
+	}
+
+	reply := &dns.Msg{}
+	err = reply.Unpack(b)
+	if err != nil {
+		return nil, err
+	}
+	return reply, nil
+}
@@ -0,0 +1,274 @@
+package upstream
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/binary"
+	"io"
+	"net"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/ameshkov/dnscrypt/v2"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+// testRelay is the Anonymized DNSCrypt relay that counts the relayed queries
+type testRelay struct {
+	udpConn     net.PacketConn
+	tcpListener net.Listener
+	queries     int32
+}
+
+// startTestRelay starts the relay listening on both UDP and TCP
+func startTestRelay(t *testing.T) *testRelay {
+	udpConn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("cannot listen: %s", err)
+	}
+	tcpListener, err := net.Listen("tcp", udpConn.LocalAddr().String())
+	if err != nil {
+		t.Fatalf("cannot listen: %s", err)
+	}
+	r := &testRelay{udpConn: udpConn, tcpListener: tcpListener}
+	t.Cleanup(func() {
+		_ = udpConn.Close()
+		_ = tcpListener.Close()
+	})
+
+	go r.serveUDP()
+	go r.serveTCP()
+	return r
+}
+
+// stamp returns the relay stamp of the relay
+func (r *testRelay) stamp() string {
+	addr := r.udpConn.LocalAddr().String()
+	bin := append([]byte{relayStampProto, byte(len(addr))}, addr...)
+	return "sdns://" + base64.RawURLEncoding.EncodeToString(bin)
+}
+
+// target validates the relayed query and returns the server address and the query itself
+func (r *testRelay) target(b []byte) (string, []byte, bool) {
+	if len(b) < len(relayMagic)+18 || !bytes.Equal(b[:len(relayMagic)], relayMagic) {
+		return "", nil, false
+	}
+	ip := net.IP(b[len(relayMagic) : len(relayMagic)+16])
+	port := binary.BigEndian.Uint16(b[len(relayMagic)+16:])
+	atomic.AddInt32(&r.queries, 1)
+	return net.JoinHostPort(ip.String(), strconv.Itoa(int(port))), b[len(relayMagic)+18:], true
+}
+
+func (r *testRelay) serveUDP() {
+	buf := make([]byte, dns.MaxMsgSize)
+	for {
+		n, addr, err := r.udpConn.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		server, query, ok := r.target(buf[:n])
+		if !ok {
+			continue
+		}
+
+		conn, err := net.Dial("udp", server)
+		if err != nil {
+			continue
+		}
+		_ = conn.SetDeadline(time.Now().Add(timeout))
+		resp := make([]byte, dns.MaxMsgSize)
+		if _, err = conn.Write(query); err == nil {
+			if n, err = conn.Read(resp); err == nil {
+				_, _ = r.udpConn.WriteTo(resp[:n], addr)
+			}
+		}
+		_ = conn.Close()
+	}
+}
+
+func (r *testRelay) serveTCP() {
+	for {
+		clientConn, err := r.tcpListener.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			defer clientConn.Close()
+			query, err := readTCPMsg(clientConn)
+			if err != nil {
+				return
+			}
+			server, query, ok := r.target(query)
+			if !ok {
+				return
+			}
+
+			conn, err := net.Dial("tcp", server)
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+			_ = conn.SetDeadline(time.Now().Add(timeout))
+			if writeTCPMsg(conn, query) != nil {
+				return
+			}
+			resp, err := readTCPMsg(conn)
+			if err == nil {
+				_ = writeTCPMsg(clientConn, resp)
+			}
+		}()
+	}
+}
+
+// readTCPMsg reads the length-prefixed message
+func readTCPMsg(conn net.Conn) ([]byte, error) {
+	l := make([]byte, 2)
+	if _, err := io.ReadFull(conn, l); err != nil {
+		return nil, err
+	}
+	b := make([]byte, binary.BigEndian.Uint16(l))
+	_, err := io.ReadFull(conn, b)
+	return b, err
+}
+
+// writeTCPMsg writes the length-prefixed message
+func writeTCPMsg(conn net.Conn, b []byte) error {
+	_, err := conn.Write(append(binary.BigEndian.AppendUint16(nil, uint16(len(b))), b...))
+	return err
+}
+
+// startDNSCryptTestServer starts the DNSCrypt server on both UDP and TCP and returns its stamp
+func startDNSCryptTestServer(t *testing.T) string {
+	rc, err := dnscrypt.GenerateResolverConfig("example.org", nil)
+	if err != nil {
+		t.Fatalf("cannot generate DNSCrypt config: %s", err)
+	}
+	cert, err := rc.CreateCert()
+	if err != nil {
+		t.Fatalf("cannot create DNSCrypt certificate: %s", err)
+	}
+
+	srv := &dnscrypt.Server{ProviderName: rc.ProviderName, ResolverCert: cert, Handler: dnsCryptTestHandler{}}
+	udpConn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("cannot listen: %s", err)
+	}
+	tcpListener, err := net.Listen("tcp", udpConn.LocalAddr().String())
+	if err != nil {
+		t.Fatalf("cannot listen: %s", err)
+	}
+	go func() { _ = srv.ServeUDP(udpConn) }()
+	go func() { _ = srv.ServeTCP(tcpListener) }()
+	t.Cleanup(func() { _ = srv.Shutdown(context.Background()) })
+
+	stamp, err := rc.CreateStamp(udpConn.LocalAddr().String())
+	if err != nil {
+		t.Fatalf("cannot create DNS stamp: %s", err)
+	}
+	return stamp.String()
+}
+
+func TestDNSCryptRelay(t *testing.T) {
+	stamp := startDNSCryptTestServer(t)
+	relay := startTestRelay(t)
+
+	u, err := AddressToUpstream(stamp+"?relay="+relay.stamp(), Options{Timeout: timeout})
+	assert.Nil(t, err)
+	reply, err := u.Exchange(createHostTestMessage("example.org"))
+	assert.Nil(t, err)
+	if assert.NotNil(t, reply) {
+		assert.Equal(t, 1, len(reply.Answer))
+	}
+	// the certificate request and the query itself
+	assert.Equal(t, int32(2), atomic.LoadInt32(&relay.queries))
+
+	// TCP is relayed as well
+	p := u.(*dnsCrypt)
+	req := createHostTestMessage("example.org")
+	reply, err = p.exchangeNet(context.Background(), "tcp", req, p.resolverInfo)
+	assert.Nil(t, err)
+	if assert.NotNil(t, reply) {
+		assert.Equal(t, req.Id, reply.Id)
+		assert.Equal(t, 1, len(reply.Answer))
+	}
+	assert.Equal(t, int32(3), atomic.LoadInt32(&relay.queries))
+}
+
+func TestDNSCryptRelayFailover(t *testing.T) {
+	stamp := startDNSCryptTestServer(t)
+	relay := startTestRelay(t)
+
+	// the relay that doesn't respond
+	deadConn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("cannot listen: %s", err)
+	}
+	t.Cleanup(func() { _ = deadConn.Close() })
+	deadAddr := deadConn.LocalAddr().String()
+	deadStamp := "sdns://" + base64.RawURLEncoding.EncodeToString(append([]byte{relayStampProto, byte(len(deadAddr))}, deadAddr...))
+
+	u, err := AddressToUpstream(stamp+"?relay="+deadStamp+"&relay="+relay.stamp(), Options{Timeout: 500 * time.Millisecond})
+	assert.Nil(t, err)
+	for i := 0; i < 3; i++ {
+		reply, err := u.Exchange(createHostTestMessage("example.org"))
+		assert.Nil(t, err)
+		if assert.NotNil(t, reply) {
+			assert.Equal(t, 1, len(reply.Answer))
+		}
+	}
+	assert.Equal(t, int32(4), atomic.LoadInt32(&relay.queries))
+
+	// the working relay is remembered
+	assert.Equal(t, int32(1), atomic.LoadInt32(&u.(*dnsCrypt).relays.current))
+}
+
+func TestDNSCryptRelayInvalid(t *testing.T) {
+	stamp := startDNSCryptTestServer(t)
+
+	invalid := []string{
+		"8.8.8.8",
+		"sdns://",
+		"sdns://!!!",
+		// 0x81 with a truncated address
+		"sdns://" + base64.RawURLEncoding.EncodeToString([]byte{relayStampProto, 10, '1'}),
+		// 0x81 with a hostname instead of IP
+		"sdns://" + base64.RawURLEncoding.EncodeToString(append([]byte{relayStampProto, 11}, "relay.local"...)),
+		// DoH stamp
+		"sdns://AgcAAAAAAAAABzEuMC4wLjEAEmRucy5jbG91ZGZsYXJlLmNvbQovZG5zLXF1ZXJ5",
+	}
+	for _, relay := range invalid {
+		_, err := AddressToUpstream(stamp+"?relay="+relay, Options{})
+		assert.NotNil(t, err, relay)
+	}
+
+	// the relays can't be used with the other upstreams
+	relay := "sdns://" + base64.RawURLEncoding.EncodeToString(append([]byte{relayStampProto, 9}, "127.0.0.1"...))
+	for _, address := range []string{"8.8.8.8", "tls://1.1.1.1", "sdns://AgcAAAAAAAAABzEuMC4wLjEAEmRucy5jbG91ZGZsYXJlLmNvbQovZG5zLXF1ZXJ5"} {
+		_, err := AddressToUpstream(address+"?relay="+relay, Options{})
+		assert.NotNil(t, err, address)
+	}
+}
+
+func TestParseRelayStamp(t *testing.T) {
+	addr, err := parseRelayStamp("sdns://" + base64.RawURLEncoding.EncodeToString(append([]byte{relayStampProto, 9}, "127.0.0.1"...)))
+	assert.Nil(t, err)
+	assert.Equal(t, "127.0.0.1:443", addr)
+
+	addr, err = parseRelayStamp("sdns://" + base64.RawURLEncoding.EncodeToString(append([]byte{relayStampProto, 16}, "[2001:db8::1]:53"...)))
+	assert.Nil(t, err)
+	assert.Equal(t, "[2001:db8::1]:53", addr)
+
+	// the DNSCrypt server stamp
+	addr, err = parseRelayStamp("sdns://AQIAAAAAAAAAFDE3Ni4xMDMuMTMwLjEzMDo1NDQzINErR_JS3PLCu_iZEIbq95zkSV2LFsigxDIuUso_OQhzIjIuZG5zY3J5cHQuZGVmYXVsdC5uczEuYWRndWFyZC5jb20")
+	assert.Nil(t, err)
+	assert.Equal(t, "176.103.130.130:5443", addr)
+
+	header, err := relayHeader("1.2.3.4:5443")
+	assert.Nil(t, err)
+	expected := append(append([]byte{}, relayMagic...), 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0xff, 0xff, 1, 2, 3, 4, 0x15, 0x43)
+	assert.Equal(t, expected, header)
+}
@@ -22,6 +22,12 @@ type exchangeResult struct {
 // First answer without error will be returned
 // We will return nil and error if count of errors equals count of upstreams
 func ExchangeParallel(u []Upstream, req *dns.Msg) (*dns.Msg, Upstream, error) {
+	return ExchangeParallelContext(context.Background(), u, req)
+}
+
+// ExchangeParallelContext is ExchangeParallel that honors ctx cancellation and deadline
+// The queries to the other upstreams are cancelled as soon as the first answer is received
+func ExchangeParallelContext(ctx context.Context, u []Upstream, req *dns.Msg) (*dns.Msg, Upstream, error) {
 	size := len(u)
 
 	if size == 0 {
@@ -29,16 +35,20 @@ func ExchangeParallel(u []Upstream, req *dns.Msg) (*dns.Msg, Upstream, error) {
 	}
 
 	if size == 1 {
-		reply, err := exchange(u[0], req)
+		reply, err := exchange(ctx, u[0], req)
 		return reply, u[0], err
 	}
 
+	// Cancels the queries that are still in progress when we return
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
 	// Size of channel must accommodate results of exchangeAsync from all upstreams
 	// Otherwise sending in channel will be locked
 	ch := make(chan *exchangeResult, size)
 
 	for _, f := range u {
-		go exchangeAsync(f, req, ch)
+		go exchangeAsync(ctx, f, req, ch)
 	}
 
 	errs := []error{}
@@ -58,6 +68,8 @@ func ExchangeParallel(u []Upstream, req *dns.Msg) (*dns.Msg, Upstream, error) {
 			if reply != nil && err == nil {
 				return reply, rep.upstream, nil
 			}
+		case <-ctx.Done():
+			return nil, nil, ctx.Err()
 		}
 	}
 }
@@ -70,12 +82,18 @@ type ExchangeAllResult struct {
 
 // ExchangeAll - receive responses from all upstream servers and return the results
 func ExchangeAll(upstreams []Upstream, req *dns.Msg) ([]ExchangeAllResult, error) {
+	return ExchangeAllContext(context.Background(), upstreams, req)
+}
+
+// ExchangeAllContext is ExchangeAll that honors ctx cancellation and deadline
+// The replies received before ctx is done are returned along with ctx.Err()
+func ExchangeAllContext(ctx context.Context, upstreams []Upstream, req *dns.Msg) ([]ExchangeAllResult, error) {
 	replies := []ExchangeAllResult{}
 
 	if len(upstreams) == 0 {
 		return replies, errors.New("no upstream specified")
 	} else if len(upstreams) == 1 {
-		reply, err := exchange(upstreams[0], req)
+		reply, err := exchange(ctx, upstreams[0], req)
 		res := ExchangeAllResult{
 			Resp:     reply,
 			Upstream: upstreams[0],
@@ -84,12 +102,16 @@ func ExchangeAll(upstreams []Upstream, req *dns.Msg) ([]ExchangeAllResult, error
 		return replies, err
 	}
 
+	// Cancels the queries that are still in progress when we return
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
 	errs := []error{}
 	ch := make(chan *exchangeResult, len(upstreams))
 
 	// schedule async exchanges
 	for _, f := range upstreams {
-		go exchangeAsync(f, req, ch)
+		go exchangeAsync(ctx, f, req, ch)
 	}
 
 	// wait for all exchanges to finish
@@ -105,6 +127,8 @@ func ExchangeAll(upstreams []Upstream, req *dns.Msg) ([]ExchangeAllResult, error
 				}
 				replies = append(replies, res)
 			}
+		case <-ctx.Done():
+			return replies, ctx.Err()
 		}
 	}
 
@@ -116,8 +140,8 @@ func ExchangeAll(upstreams []Upstream, req *dns.Msg) ([]ExchangeAllResult, error
 }
 
 // exchangeAsync tries to resolve DNS request with one upstream and send result to resp channel
-func exchangeAsync(u Upstream, req *dns.Msg, resp chan *exchangeResult) {
-	reply, err := u.Exchange(req)
+func exchangeAsync(ctx context.Context, u Upstream, req *dns.Msg, resp chan *exchangeResult) {
+	reply, err := exchange(ctx, u, req)
 	resp <- &exchangeResult{
 		reply:    reply,
 		upstream: u,
@@ -125,9 +149,9 @@ func exchangeAsync(u Upstream, req *dns.Msg, resp chan *exchangeResult) {
 	}
 }
 
-func exchange(u Upstream, req *dns.Msg) (*dns.Msg, error) {
+func exchange(ctx context.Context, u Upstream, req *dns.Msg) (*dns.Msg, error) {
 	start := time.Now()
-	reply, err := u.Exchange(req)
+	reply, err := ExchangeContext(ctx, u, req)
 	elapsed := time.Since(start) / time.Millisecond
 	if err == nil {
 		log.Tracef("upstream %s successfully finished exchange of %s. Elapsed %d ms.", u.Address(), req.Question[0].String(), elapsed)
@@ -139,24 +163,34 @@ func exchange(u Upstream, req *dns.Msg) (*dns.Msg, error) {
 
 // lookupResult is a structure that represents result of lookup
 type lookupResult struct {
-	address []net.IPAddr // List of IP addresses
-	err     error        // Error
+	address []net.IPAddr  // List of IP addresses
+	ttl     time.Duration // The lowest TTL of the records (negative if unknown)
+	err     error         // Error
 }
 
 // LookupParallel starts parallel lookup for host ip with many Resolvers
 // First answer without error will be returned
 // Return nil and error if count of errors equals count of resolvers
 func LookupParallel(ctx context.Context, resolvers []*Resolver, host string) ([]net.IPAddr, error) {
+	address, _, err := lookupParallelTTL(ctx, resolvers, host)
+	return address, err
+}
+
+// lookupParallelTTL is LookupParallel that also returns the TTL of the addresses (negative if unknown)
+func lookupParallelTTL(ctx context.Context, resolvers []*Resolver, host string) ([]net.IPAddr, time.Duration, error) {
 	size := len(resolvers)
 
 	if size == 0 {
-		return nil, errors.New("no resolvers specified")
+		return nil, -1, errors.New("no resolvers specified")
 	}
 	if size == 1 {
-		address, err := lookup(ctx, resolvers[0], host)
-		return address, err
+		return lookup(ctx, resolvers[0], host)
 	}
 
+	// Cancels the lookups that are still in progress when we return
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
 	// Size of channel must accommodate results of lookups from all resolvers
 	// Otherwise sending in channel will be locked
 	ch := make(chan *lookupResult, size)
@@ -177,32 +211,35 @@ func LookupParallel(ctx context.Context, resolvers []*Resolver, host string) ([]
 				break
 			}
 
-			return result.address, nil
+			return result.address, result.ttl, nil
+		case <-ctx.Done():
+			return nil, -1, ctx.Err()
 		}
 
 		if n == size {
-			return nil, errorx.DecorateMany("all resolvers failed to lookup", errs...)
+			return nil, -1, errorx.DecorateMany("all resolvers failed to lookup", errs...)
 		}
 	}
 }
 
 // lookupAsync tries to lookup for host ip with one Resolver and sends lookupResult to res channel
 func lookupAsync(ctx context.Context, r *Resolver, host string, res chan *lookupResult) {
-	address, err := lookup(ctx, r, host)
+	address, ttl, err := lookup(ctx, r, host)
 	res <- &lookupResult{
 		err:     err,
 		address: address,
+		ttl:     ttl,
 	}
 }
 
-func lookup(ctx context.Context, r *Resolver, host string) ([]net.IPAddr, error) {
+func lookup(ctx context.Context, r *Resolver, host string) ([]net.IPAddr, time.Duration, error) {
 	start := time.Now()
-	address, err := r.LookupIPAddr(ctx, host)
+	address, ttl, err := r.lookupIPAddrTTL(ctx, host)
 	elapsed := time.Since(start) / time.Millisecond
 	if err != nil {
 		log.Tracef("failed to lookup for %s in %d milliseconds using %s: %s", host, elapsed, r.resolverAddress, err)
 	} else {
 		log.Tracef("successfully finished lookup for %s in %d milliseconds using %s. Result : %s", host, elapsed, r.resolverAddress, address)
 	}
-	return address, err
+	return address, ttl, err
 }
@@ -139,3 +139,99 @@ func TestExchangeAll(t *testing.T) {
 	a = res[1].Resp.Answer[0].(*dns.A)
 	assert.True(t, a.A.To4().Equal(net.ParseIP("1.1.1.1").To4()))
 }
+
+// ctxTestUpstream is a ContextUpstream that waits until ctx is done and reports the context error
+type ctxTestUpstream struct {
+	testUpstream
+	done chan error
+}
+
+func (u *ctxTestUpstream) ExchangeContext(ctx context.Context, req *dns.Msg) (*dns.Msg, error) {
+	select {
+	case <-ctx.Done():
+		u.done <- ctx.Err()
+		return nil, ctx.Err()
+	case <-time.After(timeout):
+		u.done <- nil
+		return u.Exchange(req)
+	}
+}
+
+func TestExchangeParallelCancel(t *testing.T) {
+	slow := &ctxTestUpstream{done: make(chan error, 1)}
+	fast := &testUpstream{a: net.ParseIP("1.1.1.1")}
+
+	start := time.Now()
+	resp, u, err := ExchangeParallel([]Upstream{slow, fast}, createHostTestMessage("test.org"))
+	assert.Nil(t, err)
+	assert.Equal(t, fast, u)
+	assert.NotNil(t, resp)
+
+	// The loser is cancelled as soon as the winner is found
+	select {
+	case err = <-slow.done:
+		assert.Equal(t, context.Canceled, err)
+	case <-time.After(time.Second):
+		t.Fatalf("the slow upstream hasn't been cancelled")
+	}
+	assert.True(t, time.Since(start) < time.Second)
+}
+
+func TestExchangeAllDeadline(t *testing.T) {
+	slow := &ctxTestUpstream{done: make(chan error, 1)}
+	fast := &testUpstream{a: net.ParseIP("1.1.1.1")}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	res, err := ExchangeAllContext(ctx, []Upstream{slow, fast}, createHostTestMessage("test.org"))
+	assert.Equal(t, context.DeadlineExceeded, err)
+	assert.Equal(t, 1, len(res))
+	assert.Equal(t, context.DeadlineExceeded, <-slow.done)
+	assert.True(t, time.Since(start) < time.Second)
+}
+
+func TestExchangeContextAdapter(t *testing.T) {
+	// testUpstream does not implement ContextUpstream
+	u := &testUpstream{a: net.ParseIP("1.1.1.1"), sleep: timeout}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	_, err := ExchangeContext(ctx, u, createHostTestMessage("test.org"))
+	assert.Equal(t, context.DeadlineExceeded, err)
+	assert.True(t, time.Since(start) < time.Second)
+}
+
+func TestExchangeContextPlainDeadline(t *testing.T) {
+	// This UDP socket never responds
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("cannot listen: %s", err)
+	}
+	defer conn.Close()
+
+	u, err := AddressToUpstream(conn.LocalAddr().String(), Options{Timeout: timeout})
+	if err != nil {
+		t.Fatalf("cannot create upstream: %s", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	_, err = ExchangeContext(ctx, u, createTestMessage())
+	assert.Equal(t, context.DeadlineExceeded, err)
+	assert.True(t, time.Since(start) < time.Second)
+
+	// Cancellation works the same way
+	ctx, cancel = context.WithCancel(context.Background())
+	time.AfterFunc(100*time.Millisecond, cancel)
+
+	start = time.Now()
+	_, err = ExchangeContext(ctx, u, createTestMessage())
+	assert.Equal(t, context.Canceled, err)
+	assert.True(t, time.Since(start) < time.Second)
+}
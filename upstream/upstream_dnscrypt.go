@@ -1,24 +1,30 @@
 package upstream
 
 import (
+	"context"
+	"crypto/rand"
 	"io"
 	"os"
+	"strings"
 	"sync"
 	"time"
 
 	"github.com/AdguardTeam/golibs/log"
-	"github.com/ameshkov/dnscrypt"
+	"github.com/ameshkov/dnscrypt/v2"
+	"github.com/ameshkov/dnscrypt/v2/xsecretbox"
+	"github.com/ameshkov/dnsstamps"
 	"github.com/joomcode/errorx"
 	"github.com/miekg/dns"
+	"golang.org/x/crypto/nacl/box"
 )
 
-//
 // DNSCrypt
-//
 type dnsCrypt struct {
-	boot       *bootstrapper
-	client     *dnscrypt.Client     // DNSCrypt client properties
-	serverInfo *dnscrypt.ServerInfo // DNSCrypt server info
+	boot         *bootstrapper
+	stamp        dnsstamps.ServerStamp  // the server stamp parsed from the address
+	client       *dnscrypt.Client       // DNSCrypt client properties
+	resolverInfo *dnscrypt.ResolverInfo // DNSCrypt resolver info
+	relays       *dnsCryptRelays        // Anonymized DNSCrypt relays, nil if the resolver is queried directly
 
 	sync.RWMutex // protects DNSCrypt client
 }
@@ -26,41 +32,45 @@ type dnsCrypt struct {
 func (p *dnsCrypt) Address() string { return p.boot.address }
 
 func (p *dnsCrypt) Exchange(m *dns.Msg) (*dns.Msg, error) {
-	reply, err := p.exchangeDNSCrypt(m)
+	return p.ExchangeContext(context.Background(), m)
+}
+
+func (p *dnsCrypt) ExchangeContext(ctx context.Context, m *dns.Msg) (*dns.Msg, error) {
+	reply, err := p.exchangeDNSCrypt(ctx, m)
 
-	if os.IsTimeout(err) || err == io.EOF {
+	if ctx.Err() == nil && (os.IsTimeout(err) || err == io.EOF) {
 		// If request times out, it is possible that the server configuration has been changed.
 		// It is safe to assume that the key was rotated (for instance, as it is described here: https://dnscrypt.pl/2017/02/26/how-key-rotation-is-automated/).
 		// We should re-fetch the server certificate info so that the new requests were not failing.
 		p.Lock()
 		p.client = nil
-		p.serverInfo = nil
+		p.resolverInfo = nil
 		p.Unlock()
 
 		// Retry the request one more time
-		return p.exchangeDNSCrypt(m)
+		return p.exchangeDNSCrypt(ctx, m)
 	}
 
 	return reply, err
 }
 
 // exchangeDNSCrypt attempts to send the DNS query and returns the response
-func (p *dnsCrypt) exchangeDNSCrypt(m *dns.Msg) (*dns.Msg, error) {
+func (p *dnsCrypt) exchangeDNSCrypt(ctx context.Context, m *dns.Msg) (*dns.Msg, error) {
 	var client *dnscrypt.Client
-	var serverInfo *dnscrypt.ServerInfo
+	var resolverInfo *dnscrypt.ResolverInfo
 
 	p.RLock()
 	client = p.client
-	serverInfo = p.serverInfo
+	resolverInfo = p.resolverInfo
 	p.RUnlock()
 
 	now := uint32(time.Now().Unix())
-	if client == nil || serverInfo == nil || (serverInfo != nil && serverInfo.ServerCert.NotAfter < now) {
+	if client == nil || resolverInfo == nil || resolverInfo.ResolverCert.NotAfter < now {
 		p.Lock()
 
 		// Using "udp" for DNSCrypt upstreams by default
-		client = &dnscrypt.Client{Timeout: p.boot.timeout, AdjustPayloadSize: false}
-		si, _, err := client.Dial(p.boot.address)
+		client = &dnscrypt.Client{Timeout: p.boot.timeout}
+		ri, err := p.fetchResolverInfo(ctx)
 
 		if err != nil {
 			p.Unlock()
@@ -68,17 +78,16 @@ func (p *dnsCrypt) exchangeDNSCrypt(m *dns.Msg) (*dns.Msg, error) {
 		}
 
 		p.client = client
-		p.serverInfo = si
-		serverInfo = si
+		p.resolverInfo = ri
+		resolverInfo = ri
 		p.Unlock()
 	}
 
-	reply, _, err := client.Exchange(m, serverInfo)
+	reply, err := p.exchangeNet(ctx, "udp", m, resolverInfo)
 
 	if reply != nil && reply.Truncated {
 		log.Tracef("Truncated message was received, retrying over TCP, question: %s", m.Question[0].String())
-		tcpClient := dnscrypt.Client{Timeout: p.boot.timeout, Proto: "tcp"}
-		reply, _, err = tcpClient.Exchange(m, serverInfo)
+		reply, err = p.exchangeNet(ctx, "tcp", m, resolverInfo)
 	}
 
 	if err == nil && reply != nil && reply.Id != m.Id {
@@ -87,3 +96,190 @@ func (p *dnsCrypt) exchangeDNSCrypt(m *dns.Msg) (*dns.Msg, error) {
 
 	return reply, err
 }
+
+// exchangeNet sends the encrypted DNS query over the specified network ("udp" or "tcp").
+// The connection is closed as soon as ctx is done.
+func (p *dnsCrypt) exchangeNet(ctx context.Context, network string, m *dns.Msg, resolverInfo *dnscrypt.ResolverInfo) (*dns.Msg, error) {
+	if p.relays != nil {
+		return p.relays.exchange(ctx, network, m, resolverInfo)
+	}
+
+	timeout := contextTimeout(ctx, p.boot.timeout)
+	client := &dnscrypt.Client{Timeout: timeout, Net: network}
+
+	conn, err := p.boot.dialer.DialContext(ctx, network, resolverInfo.ServerAddress)
+	if err != nil {
+		return nil, contextError(ctx, err)
+	}
+	defer conn.Close()
+
+	stop := closeOnDone(ctx, conn)
+	defer stop()
+
+	reply, err := client.ExchangeConn(conn, m, resolverInfo)
+	return reply, contextError(ctx, err)
+}
+
+// fetchResolverInfo fetches and validates the server certificate and computes the shared key.
+// It does the same as dnscrypt.Client.Dial, but the certificate is requested using the upstream's dialer.
+func (p *dnsCrypt) fetchResolverInfo(ctx context.Context) (*dnscrypt.ResolverInfo, error) {
+	// The relays limit each attempt with the timeout so that the next relay has time to respond
+	if p.boot.timeout > 0 && p.relays == nil {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, p.boot.timeout)
+		defer cancel()
+	}
+
+	resolverInfo := &dnscrypt.ResolverInfo{
+		ServerPublicKey: p.stamp.ServerPk,
+		ServerAddress:   p.stamp.ServerAddrStr,
+		ProviderName:    p.stamp.ProviderName,
+	}
+
+	publicKey, secretKey, err := box.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, errorx.Decorate(err, "failed to generate the key pair")
+	}
+	resolverInfo.PublicKey, resolverInfo.SecretKey = *publicKey, *secretKey
+
+	cert, err := p.fetchCert(ctx)
+	if err != nil {
+		return nil, err
+	}
+	resolverInfo.ResolverCert = cert
+
+	switch cert.EsVersion {
+	case dnscrypt.XChacha20Poly1305:
+		resolverInfo.SharedKey, err = xsecretbox.SharedKey(resolverInfo.SecretKey, cert.ResolverPk)
+		if err != nil {
+			return nil, err
+		}
+	case dnscrypt.XSalsa20Poly1305:
+		box.Precompute(&resolverInfo.SharedKey, &cert.ResolverPk, &resolverInfo.SecretKey)
+	default:
+		return nil, dnscrypt.ErrEsVersion
+	}
+	return resolverInfo, nil
+}
+
+// fetchCert requests the certificates of the DNSCrypt provider and returns the newest valid one
+func (p *dnsCrypt) fetchCert(ctx context.Context) (*dnscrypt.Cert, error) {
+	providerName := dns.Fqdn(p.stamp.ProviderName)
+	query := &dns.Msg{}
+	query.SetQuestion(providerName, dns.TypeTXT)
+
+	r, err := p.exchangeCertQuery(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	if r.Rcode != dns.RcodeSuccess {
+		return nil, dnscrypt.ErrFailedToFetchCert
+	}
+
+	var current *dnscrypt.Cert
+	certErr := error(dnscrypt.ErrFailedToFetchCert)
+	for _, rr := range r.Answer {
+		txt, ok := rr.(*dns.TXT)
+		if !ok {
+			continue
+		}
+
+		cert := &dnscrypt.Cert{}
+		err = cert.Deserialize(unescapeTXT(strings.Join(txt.Txt, "")))
+		if err != nil {
+			certErr = err
+			log.Debug("[%s] failed to deserialize cert: %s", providerName, err)
+			continue
+		}
+		if !cert.VerifyDate() {
+			certErr = dnscrypt.ErrInvalidDate
+			log.Debug("[%s] cert %d date is not valid", providerName, cert.Serial)
+			continue
+		}
+		if !cert.VerifySignature(p.stamp.ServerPk) {
+			certErr = dnscrypt.ErrInvalidCertSignature
+			log.Debug("[%s] cert %d signature is not valid", providerName, cert.Serial)
+			continue
+		}
+
+		// The newest certificate with the preferred crypto construction wins
+		if current == nil || cert.Serial > current.Serial ||
+			(cert.Serial == current.Serial && cert.EsVersion > current.EsVersion) {
+			current = cert
+		}
+	}
+
+	if current == nil {
+		return nil, certErr
+	}
+	log.Debug("[%s] using certificate %d", providerName, current.Serial)
+	return current, nil
+}
+
+// exchangeCertQuery sends the certificate request to the server directly or through the relays.
+// The request is retried over TCP if the response is truncated.
+func (p *dnsCrypt) exchangeCertQuery(ctx context.Context, query *dns.Msg) (*dns.Msg, error) {
+	r, err := p.exchangePlain(ctx, "udp", query)
+	if err == nil && r.Truncated {
+		log.Tracef("Truncated certificate response was received from %s, retrying over TCP", p.Address())
+		r, err = p.exchangePlain(ctx, "tcp", query)
+	}
+	return r, err
+}
+
+// exchangePlain sends the unencrypted DNS query over the specified network ("udp" or "tcp")
+func (p *dnsCrypt) exchangePlain(ctx context.Context, network string, query *dns.Msg) (*dns.Msg, error) {
+	if p.relays != nil {
+		return p.relays.exchangePlain(ctx, network, query)
+	}
+
+	rawConn, err := p.boot.dialer.DialContext(ctx, network, p.stamp.ServerAddrStr)
+	if err != nil {
+		return nil, contextError(ctx, err)
+	}
+	defer rawConn.Close()
+
+	stop := closeOnDone(ctx, rawConn)
+	defer stop()
+
+	// Use 1252 as the UDP size to make sure the buffer is not too small
+	client := dns.Client{Net: network, UDPSize: 1252, Timeout: contextTimeout(ctx, p.boot.timeout)}
+	r, _, err := client.ExchangeWithConn(query, &dns.Conn{Conn: rawConn, UDPSize: client.UDPSize})
+	if err != nil {
+		return nil, contextError(ctx, err)
+	}
+	return r, nil
+}
+
+// unescapeTXT converts the TXT record string escaped by miekg/dns (\DDD and \X) back to the raw bytes
+func unescapeTXT(s string) []byte {
+	b := make([]byte, 0, len(s))
+	for i := 0; i < len(s); i++ {
+		if s[i] != '\\' || i+1 == len(s) {
+			b = append(b, s[i])
+			continue
+		}
+		i++
+		if i+2 < len(s) && isDigit(s[i]) && isDigit(s[i+1]) && isDigit(s[i+2]) {
+			b = append(b, (s[i]-'0')*100+(s[i+1]-'0')*10+(s[i+2]-'0'))
+			i += 2
+			continue
+		}
+		switch s[i] {
+		case 't':
+			b = append(b, '\t')
+		case 'r':
+			b = append(b, '\r')
+		case 'n':
+			b = append(b, '\n')
+		default:
+			b = append(b, s[i])
+		}
+	}
+	return b
+}
+
+// isDigit checks if the byte is an ASCII digit
+func isDigit(b byte) bool {
+	return b >= '0' && b <= '9'
+}
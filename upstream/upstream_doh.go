@@ -1,10 +1,12 @@
 package upstream
 
 import (
+	"context"
 	"encoding/base64"
 	"fmt"
 	"io/ioutil"
 	"net/http"
+	"strings"
 	"sync"
 	"time"
 
@@ -34,14 +36,22 @@ type dnsOverHTTPS struct {
 func (p *dnsOverHTTPS) Address() string { return p.boot.address }
 
 func (p *dnsOverHTTPS) Exchange(m *dns.Msg) (*dns.Msg, error) {
+	return p.ExchangeContext(context.Background(), m)
+}
+
+func (p *dnsOverHTTPS) ExchangeContext(ctx context.Context, m *dns.Msg) (*dns.Msg, error) {
 	client, err := p.getClient()
 	if err != nil {
 		return nil, errorx.Decorate(err, "couldn't initialize HTTP client or transport")
 	}
 
 	logBegin(p.Address(), m)
-	r, err := p.exchangeHTTPSClient(m, client)
+	r, err := p.exchangeHTTPSClient(ctx, m, client)
 	logFinish(p.Address(), err)
+	if ctx.Err() != nil {
+		// The request was cancelled, the client is still usable
+		return nil, ctx.Err()
+	}
 	if err != nil {
 		p.Lock()
 		if client == p.client {
@@ -53,15 +63,20 @@ func (p *dnsOverHTTPS) Exchange(m *dns.Msg) (*dns.Msg, error) {
 }
 
 // exchangeHTTPSClient sends the DNS query to a DOH resolver using the specified http.Client instance
-func (p *dnsOverHTTPS) exchangeHTTPSClient(m *dns.Msg, client *http.Client) (*dns.Msg, error) {
+func (p *dnsOverHTTPS) exchangeHTTPSClient(ctx context.Context, m *dns.Msg, client *http.Client) (*dns.Msg, error) {
 	buf, err := m.Pack()
 	if err != nil {
 		return nil, errorx.Decorate(err, "couldn't pack request msg")
 	}
 
 	// It appears, that GET requests are more memory-efficient with Golang implementation of HTTP/2.
-	requestURL := p.boot.address + "?dns=" + base64.RawURLEncoding.EncodeToString(buf)
-	req, err := http.NewRequest("GET", requestURL, nil)
+	// The endpoint URL may have its own query parameters
+	sep := "?"
+	if strings.Contains(p.boot.address, "?") {
+		sep = "&"
+	}
+	requestURL := p.boot.address + sep + "dns=" + base64.RawURLEncoding.EncodeToString(buf)
+	req, err := http.NewRequestWithContext(ctx, "GET", requestURL, nil)
 	if err != nil {
 		return nil, errorx.Decorate(err, "couldn't create a HTTP request to %s", p.boot.address)
 	}
@@ -129,7 +144,7 @@ func (p *dnsOverHTTPS) getClient() (*http.Client, error) {
 	req.Id = dns.Id()
 	req.RecursionDesired = true
 	req.Question = []dns.Question{{Name: "ipv4only.arpa.", Qtype: dns.TypeA, Qclass: dns.ClassINET}}
-	_, err = p.exchangeHTTPSClient(&req, client)
+	_, err = p.exchangeHTTPSClient(context.Background(), &req, client)
 	if err != nil {
 		return nil, err
 	}
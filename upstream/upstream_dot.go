@@ -1,10 +1,10 @@
 package upstream
 
 import (
+	"context"
 	"net"
-	"sync"
+	"time"
 
-	"github.com/AdguardTeam/golibs/log"
 	"github.com/joomcode/errorx"
 	"github.com/miekg/dns"
 )
@@ -14,78 +14,43 @@ import (
 //
 type dnsOverTLS struct {
 	boot *bootstrapper
-	pool *TLSPool
+	pool *pipelinePool // pipelines the queries over a few long-lived TLS connections
+}
 
-	sync.RWMutex // protects pool
+// newDNSOverTLS creates a new DNS-over-TLS upstream
+// maxConns is the maximum number of TLS connections (0 means the default value)
+func newDNSOverTLS(boot *bootstrapper, maxConns int) *dnsOverTLS {
+	p := &dnsOverTLS{boot: boot}
+	p.pool = newPipelinePool(boot.address, p.dial, boot.timeout, maxConns)
+	return p
 }
 
 func (p *dnsOverTLS) Address() string { return p.boot.address }
 
 func (p *dnsOverTLS) Exchange(m *dns.Msg) (*dns.Msg, error) {
-	var pool *TLSPool
-	p.RLock()
-	pool = p.pool
-	p.RUnlock()
-	if pool == nil {
-		p.Lock()
-		// lazy initialize it
-		p.pool = &TLSPool{boot: p.boot}
-		p.Unlock()
-	}
-
-	p.RLock()
-	poolConn, err := p.pool.Get()
-	p.RUnlock()
-	if err != nil {
-		return nil, errorx.Decorate(err, "Failed to get a connection from TLSPool to %s", p.Address())
-	}
+	return p.ExchangeContext(context.Background(), m)
+}
 
+func (p *dnsOverTLS) ExchangeContext(ctx context.Context, m *dns.Msg) (*dns.Msg, error) {
 	logBegin(p.Address(), m)
-	reply, err := p.exchangeConn(poolConn, m)
+	reply, err := p.pool.Exchange(ctx, m)
 	logFinish(p.Address(), err)
-	if err != nil {
-		log.Tracef("The TLS connection is expired due to %s", err)
-
-		// The pooled connection might have been closed already (see https://github.com/AdguardTeam/dnsproxy/issues/3)
-		// So we're trying to re-connect right away here.
-		// We are forcing creation of a new connection instead of calling Get() again
-		// as there's no guarantee that other pooled connections are intact
-		p.RLock()
-		poolConn, err = p.pool.Create()
-		p.RUnlock()
-		if err != nil {
-			return nil, errorx.Decorate(err, "Failed to create a new connection from TLSPool to %s", p.Address())
-		}
-
-		// Retry sending the DNS request
-		logBegin(p.Address(), m)
-		reply, err = p.exchangeConn(poolConn, m)
-		logFinish(p.Address(), err)
-	}
-
-	if err == nil {
-		p.RLock()
-		p.pool.Put(poolConn)
-		p.RUnlock()
-	}
 	return reply, err
 }
 
-func (p *dnsOverTLS) exchangeConn(poolConn net.Conn, m *dns.Msg) (*dns.Msg, error) {
-	c := dns.Conn{Conn: poolConn}
-	err := c.WriteMsg(m)
+// dial opens a new TLS connection to the bootstrapped address
+func (p *dnsOverTLS) dial(ctx context.Context) (net.Conn, error) {
+	tlsConfig, dialContext, err := p.boot.get()
 	if err != nil {
-		poolConn.Close()
-		return nil, errorx.Decorate(err, "Failed to send a request to %s", p.Address())
+		return nil, err
 	}
 
-	reply, err := c.ReadMsg()
+	conn, err := tlsDial(ctx, dialContext, "tcp", tlsConfig)
 	if err != nil {
-		poolConn.Close()
-		return nil, errorx.Decorate(err, "Failed to read a request from %s", p.Address())
+		return nil, errorx.Decorate(err, "Failed to connect to %s", tlsConfig.ServerName)
 	}
-	if err == nil && reply.Id != m.Id {
-		err = dns.ErrId
-	}
-	return reply, err
+
+	// The connection is long-lived, the deadlines are set for every query separately
+	_ = conn.SetDeadline(time.Time{})
+	return conn, nil
 }
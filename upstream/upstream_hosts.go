@@ -0,0 +1,220 @@
+package upstream
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/AdguardTeam/golibs/log"
+	"github.com/joomcode/errorx"
+	"github.com/miekg/dns"
+)
+
+// ErrNotInHosts is returned by the hosts upstream with the fallthrough option if the name isn't in the hosts file,
+// the query should be sent to the other upstreams then.
+var ErrNotInHosts = errors.New("the name is not in the hosts file")
+
+const (
+	// hostsTTL is the TTL of the records from the hosts file
+	hostsTTL = 10
+
+	// hostsCheckInterval is how often the hosts file is checked for changes
+	hostsCheckInterval = time.Second
+)
+
+// hostsFile is the upstream that answers from the hosts-format file (hosts:///etc/hosts)
+type hostsFile struct {
+	path        string // path to the hosts file
+	passThrough bool   // if true, ErrNotInHosts is returned for the unknown names instead of NXDOMAIN
+
+	names     map[string][]net.IP // IP addresses by the lowercase FQDN
+	ptr       map[string][]string // hostnames by the reverse name (in-addr.arpa. or ip6.arpa.)
+	modTime   time.Time           // modification time of the file when it was loaded
+	checkedAt time.Time           // when the file was checked for changes
+	lock      sync.RWMutex        // protects the fields above
+}
+
+// newHostsFile creates a new hosts upstream and loads the file
+func newHostsFile(path string, opts Options) (*hostsFile, error) {
+	h := &hostsFile{path: path, passThrough: opts.Fallthrough}
+	err := h.load()
+	if err != nil {
+		return nil, err
+	}
+	return h, nil
+}
+
+// Address returns the original address
+func (h *hostsFile) Address() string { return "hosts://" + h.path }
+
+func (h *hostsFile) Exchange(m *dns.Msg) (*dns.Msg, error) {
+	return h.ExchangeContext(context.Background(), m)
+}
+
+// ExchangeContext answers the A, AAAA and PTR queries from the hosts file
+// The known names without records of the requested type get an empty NOERROR response.
+func (h *hostsFile) ExchangeContext(ctx context.Context, m *dns.Msg) (*dns.Msg, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if len(m.Question) == 0 {
+		return nil, errors.New("the query has no question")
+	}
+	h.reloadIfChanged()
+
+	q := m.Question[0]
+	name := strings.ToLower(q.Name)
+	hdr := dns.RR_Header{Name: q.Name, Rrtype: q.Qtype, Class: dns.ClassINET, Ttl: hostsTTL}
+
+	h.lock.RLock()
+	ips, found := h.names[name]
+	hostnames, foundPTR := h.ptr[name]
+	h.lock.RUnlock()
+
+	resp := &dns.Msg{}
+	resp.SetReply(m)
+	resp.Authoritative = true
+	resp.RecursionAvailable = true
+
+	switch {
+	case foundPTR:
+		if q.Qtype == dns.TypePTR {
+			for _, hostname := range hostnames {
+				resp.Answer = append(resp.Answer, &dns.PTR{Hdr: hdr, Ptr: hostname})
+			}
+		}
+	case found:
+		for _, ip := range ips {
+			if q.Qtype == dns.TypeA && ip.To4() != nil {
+				resp.Answer = append(resp.Answer, &dns.A{Hdr: hdr, A: ip.To4()})
+			} else if q.Qtype == dns.TypeAAAA && ip.To4() == nil {
+				resp.Answer = append(resp.Answer, &dns.AAAA{Hdr: hdr, AAAA: ip})
+			}
+		}
+	case h.passThrough:
+		return nil, ErrNotInHosts
+	default:
+		resp.Rcode = dns.RcodeNameError
+	}
+
+	return resp, nil
+}
+
+// reloadIfChanged reloads the file if it has been modified since it was loaded
+// The file is checked once in hostsCheckInterval at most, the old records are kept if it can't be loaded.
+func (h *hostsFile) reloadIfChanged() {
+	now := time.Now()
+	h.lock.Lock()
+	if now.Sub(h.checkedAt) < hostsCheckInterval {
+		h.lock.Unlock()
+		return
+	}
+	h.checkedAt = now
+	modTime := h.modTime
+	h.lock.Unlock()
+
+	info, err := os.Stat(h.path)
+	if err != nil {
+		log.Error("failed to check the hosts file %s: %s", h.path, err)
+		return
+	}
+	if info.ModTime().Equal(modTime) {
+		return
+	}
+
+	err = h.load()
+	if err != nil {
+		log.Error("failed to reload the hosts file, using the previous records: %s", err)
+		return
+	}
+	log.Printf("Reloaded the hosts file %s", h.path)
+}
+
+// load reads and parses the hosts file
+func (h *hostsFile) load() error {
+	f, err := os.Open(h.path)
+	if err != nil {
+		return errorx.Decorate(err, "failed to open the hosts file %s", h.path)
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return errorx.Decorate(err, "failed to read the hosts file %s", h.path)
+	}
+
+	names := map[string][]net.IP{}
+	ptr := map[string][]string{}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if i := strings.IndexByte(line, '#'); i != -1 {
+			line = line[:i]
+		}
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			continue
+		}
+
+		// Strip the IPv6 zone, e.g. fe80::1%lo0
+		ip := net.ParseIP(strings.SplitN(fields[0], "%", 2)[0])
+		if ip == nil {
+			log.Debug("hosts: %s: skipping the line with an invalid IP address: %s", h.path, line)
+			continue
+		}
+
+		reverse, err := dns.ReverseAddr(ip.String())
+		if err != nil {
+			continue
+		}
+		for _, hostname := range fields[1:] {
+			hostname = dns.Fqdn(strings.ToLower(hostname))
+			if _, ok := dns.IsDomainName(hostname); !ok {
+				log.Debug("hosts: %s: skipping the invalid hostname %s", h.path, hostname)
+				continue
+			}
+			names[hostname] = appendIP(names[hostname], ip)
+			ptr[reverse] = appendHostname(ptr[reverse], hostname)
+		}
+	}
+	if err = scanner.Err(); err != nil {
+		return errorx.Decorate(err, "failed to read the hosts file %s", h.path)
+	}
+
+	h.lock.Lock()
+	h.names, h.ptr, h.modTime = names, ptr, info.ModTime()
+	h.lock.Unlock()
+	return nil
+}
+
+// appendIP appends the IP address to the list if it's not there yet
+func appendIP(ips []net.IP, ip net.IP) []net.IP {
+	for _, existing := range ips {
+		if existing.Equal(ip) {
+			return ips
+		}
+	}
+	return append(ips, ip)
+}
+
+// appendHostname appends the hostname to the list if it's not there yet
+func appendHostname(hostnames []string, hostname string) []string {
+	for _, existing := range hostnames {
+		if existing == hostname {
+			return hostnames
+		}
+	}
+	return append(hostnames, hostname)
+}
+
+// IsLocal checks if the upstream answers from the local data without sending the queries over the network (hosts://).
+// Such upstreams are queried before the others and aren't health checked.
+func IsLocal(u Upstream) bool {
+	_, ok := u.(*hostsFile)
+	return ok
+}
@@ -0,0 +1,135 @@
+package upstream
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+const testHostsContent = `# comment
+127.0.0.1   localhost
+192.168.1.10  router.lan router   # the router
+192.168.1.11  nas.lan
+fe80::1%lo0   nas.lan
+invalid-ip    broken.lan
+`
+
+// writeTestHosts writes the hosts file to the temporary directory
+func writeTestHosts(t *testing.T, content string) string {
+	path := filepath.Join(t.TempDir(), "hosts")
+	err := os.WriteFile(path, []byte(content), 0o644)
+	assert.Nil(t, err)
+	return path
+}
+
+// exchangeHosts sends the query of the specified type to the hosts upstream
+func exchangeHosts(t *testing.T, u Upstream, name string, qtype uint16) *dns.Msg {
+	req := &dns.Msg{}
+	req.SetQuestion(name, qtype)
+	resp, err := u.Exchange(req)
+	assert.Nil(t, err)
+	return resp
+}
+
+func TestHostsUpstream(t *testing.T) {
+	path := writeTestHosts(t, testHostsContent)
+	u, err := AddressToUpstream("hosts://"+path, Options{})
+	assert.Nil(t, err)
+	assert.Equal(t, "hosts://"+path, u.Address())
+	assert.True(t, IsLocal(u))
+
+	resp := exchangeHosts(t, u, "Router.LAN.", dns.TypeA)
+	assert.Equal(t, dns.RcodeSuccess, resp.Rcode)
+	assert.True(t, resp.Authoritative)
+	assert.Len(t, resp.Answer, 1)
+	a := resp.Answer[0].(*dns.A)
+	assert.Equal(t, "Router.LAN.", a.Hdr.Name)
+	assert.Equal(t, uint32(hostsTTL), a.Hdr.Ttl)
+	assert.True(t, a.A.Equal(net.IPv4(192, 168, 1, 10)))
+
+	// the short alias
+	resp = exchangeHosts(t, u, "router.", dns.TypeA)
+	assert.Len(t, resp.Answer, 1)
+
+	resp = exchangeHosts(t, u, "nas.lan.", dns.TypeAAAA)
+	assert.Len(t, resp.Answer, 1)
+	assert.True(t, resp.Answer[0].(*dns.AAAA).AAAA.Equal(net.ParseIP("fe80::1")))
+
+	// a known name without records of this type
+	resp = exchangeHosts(t, u, "router.lan.", dns.TypeAAAA)
+	assert.Equal(t, dns.RcodeSuccess, resp.Rcode)
+	assert.Empty(t, resp.Answer)
+	resp = exchangeHosts(t, u, "router.lan.", dns.TypeMX)
+	assert.Equal(t, dns.RcodeSuccess, resp.Rcode)
+	assert.Empty(t, resp.Answer)
+
+	resp = exchangeHosts(t, u, "10.1.168.192.in-addr.arpa.", dns.TypePTR)
+	assert.Len(t, resp.Answer, 2)
+	assert.Equal(t, "router.lan.", resp.Answer[0].(*dns.PTR).Ptr)
+	assert.Equal(t, "router.", resp.Answer[1].(*dns.PTR).Ptr)
+
+	reverse, err := dns.ReverseAddr("fe80::1")
+	assert.Nil(t, err)
+	resp = exchangeHosts(t, u, reverse, dns.TypePTR)
+	assert.Len(t, resp.Answer, 1)
+	assert.Equal(t, "nas.lan.", resp.Answer[0].(*dns.PTR).Ptr)
+
+	// unknown and invalid entries
+	resp = exchangeHosts(t, u, "example.org.", dns.TypeA)
+	assert.Equal(t, dns.RcodeNameError, resp.Rcode)
+	resp = exchangeHosts(t, u, "broken.lan.", dns.TypeA)
+	assert.Equal(t, dns.RcodeNameError, resp.Rcode)
+}
+
+func TestHostsUpstreamFallthrough(t *testing.T) {
+	path := writeTestHosts(t, testHostsContent)
+	u, err := AddressToUpstream("hosts://"+path+"?fallthrough=1", Options{})
+	assert.Nil(t, err)
+
+	resp := exchangeHosts(t, u, "nas.lan.", dns.TypeA)
+	assert.Len(t, resp.Answer, 1)
+
+	req := &dns.Msg{}
+	req.SetQuestion("example.org.", dns.TypeA)
+	_, err = u.Exchange(req)
+	assert.Equal(t, ErrNotInHosts, err)
+}
+
+func TestHostsUpstreamReload(t *testing.T) {
+	path := writeTestHosts(t, testHostsContent)
+	u, err := newHostsFile(path, Options{})
+	assert.Nil(t, err)
+
+	err = os.WriteFile(path, []byte("10.0.0.1 new.lan\n"), 0o644)
+	assert.Nil(t, err)
+	future := time.Now().Add(time.Hour)
+	assert.Nil(t, os.Chtimes(path, future, future))
+
+	// the file isn't checked more often than hostsCheckInterval
+	u.lock.Lock()
+	u.checkedAt = time.Time{}
+	u.lock.Unlock()
+
+	resp := exchangeHosts(t, u, "new.lan.", dns.TypeA)
+	assert.Len(t, resp.Answer, 1)
+	resp = exchangeHosts(t, u, "nas.lan.", dns.TypeA)
+	assert.Equal(t, dns.RcodeNameError, resp.Rcode)
+
+	// the previous records are kept if the file can't be read
+	assert.Nil(t, os.Remove(path))
+	u.lock.Lock()
+	u.checkedAt = time.Time{}
+	u.lock.Unlock()
+	resp = exchangeHosts(t, u, "new.lan.", dns.TypeA)
+	assert.Len(t, resp.Answer, 1)
+}
+
+func TestHostsUpstreamNoFile(t *testing.T) {
+	_, err := AddressToUpstream("hosts:///nonexistent/hosts", Options{})
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,407 @@
+package upstream
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/AdguardTeam/golibs/log"
+	"github.com/joomcode/errorx"
+	"github.com/miekg/dns"
+)
+
+// defaultMaxConnections is the default maximum number of connections per tcp:// or tls:// upstream
+const defaultMaxConnections = 3
+
+// errPipelineConnClosed is returned for the queries that were pending when the connection was closed
+var errPipelineConnClosed = errors.New("connection closed")
+
+// pipelineDialer opens a new stream connection to the upstream
+type pipelineDialer func(ctx context.Context) (net.Conn, error)
+
+// pipelinePool is a connection manager for the upstreams that use stream connections (tcp:// and tls://).
+// It pipelines the queries over a few long-lived connections: many queries can be outstanding
+// on the same connection at once, the responses are matched by the message ID.
+// A new connection is opened when all the existing ones are busy (up to maxConns).
+// The connections closed by the server are dropped, a new one is opened by the next query.
+type pipelinePool struct {
+	address  string         // upstream address (for logging)
+	dial     pipelineDialer // opens new connections
+	timeout  time.Duration  // query timeout (0 == infinite)
+	maxConns int            // maximum number of connections
+
+	conns     []*pipelineConn
+	dialing   int           // number of connections being opened
+	firstDial *pipelineDial // the connection being opened when there are no connections at all
+	mu        sync.Mutex    // protects conns, dialing and firstDial
+}
+
+// newPipelinePool creates a new pipelinePool
+// maxConns=0 means defaultMaxConnections
+func newPipelinePool(address string, dial pipelineDialer, timeout time.Duration, maxConns int) *pipelinePool {
+	if maxConns <= 0 {
+		maxConns = defaultMaxConnections
+	}
+	return &pipelinePool{
+		address:  address,
+		dial:     dial,
+		timeout:  timeout,
+		maxConns: maxConns,
+	}
+}
+
+// Exchange sends the DNS query over one of the pooled connections and waits for the response.
+// If the connection is closed before the response is received, the query is retried once over a new connection.
+func (p *pipelinePool) Exchange(ctx context.Context, m *dns.Msg) (*dns.Msg, error) {
+	buf, err := m.Pack()
+	if err != nil {
+		return nil, errorx.Decorate(err, "couldn't pack request msg")
+	}
+
+	pc, err := p.get(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	reply, err := pc.exchange(ctx, buf, p.timeout)
+	if err == errPipelineConnClosed && ctx.Err() == nil {
+		// The connection might have been closed by the server due to the idle timeout
+		log.Tracef("The connection to %s is closed, retrying over a new one", p.address)
+		pc, err = p.get(ctx)
+		if err != nil {
+			return nil, err
+		}
+		reply, err = pc.exchange(ctx, buf, p.timeout)
+	}
+	if err != nil {
+		if isContextError(err) {
+			return nil, err
+		}
+		return nil, errorx.Decorate(err, "failed to exchange with %s", p.address)
+	}
+
+	// Restore the original message ID, it has been replaced with a unique one
+	reply.Id = m.Id
+	return reply, nil
+}
+
+// Close closes all the pooled connections
+func (p *pipelinePool) Close() {
+	p.mu.Lock()
+	conns := p.conns
+	p.conns = nil
+	p.mu.Unlock()
+
+	for _, pc := range conns {
+		pc.close(errPipelineConnClosed)
+	}
+}
+
+// get returns the least loaded connection or opens a new one.
+// If all the connections are busy and the limit is not reached, a new one is opened in the background.
+func (p *pipelinePool) get(ctx context.Context) (*pipelineConn, error) {
+	p.mu.Lock()
+	pc := p.leastLoaded()
+	if pc != nil {
+		if pc.load() > 0 && len(p.conns)+p.dialing < p.maxConns {
+			p.dialing++
+			go p.dialAsync(nil)
+		}
+		p.mu.Unlock()
+		return pc, nil
+	}
+
+	// There are no connections, all the queries wait for the same new one
+	d := p.firstDial
+	if d == nil {
+		d = &pipelineDial{done: make(chan struct{})}
+		p.firstDial = d
+		p.dialing++
+		go p.dialAsync(d)
+	}
+	p.mu.Unlock()
+
+	select {
+	case <-d.done:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+
+	if d.err != nil {
+		err := contextError(ctx, d.err)
+		if isContextError(err) {
+			return nil, err
+		}
+		return nil, errorx.Decorate(err, "failed to connect to %s", p.address)
+	}
+	return d.pc, nil
+}
+
+// pipelineDial is the result of opening a new connection that is shared by the waiting queries
+type pipelineDial struct {
+	pc   *pipelineConn
+	err  error
+	done chan struct{} // closed when the dial is finished
+}
+
+// dialAsync opens a new connection in the background
+// If d is not nil, the result is reported to the queries waiting for it
+func (p *pipelinePool) dialAsync(d *pipelineDial) {
+	// The connection is shared so it does not depend on the context of a query
+	ctx := context.Background()
+	if p.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, p.timeout)
+		defer cancel()
+	}
+
+	pc, err := p.open(ctx)
+	if err != nil {
+		log.Tracef("failed to open a new connection to %s: %s", p.address, err)
+	}
+
+	p.mu.Lock()
+	p.dialing--
+	if d != nil {
+		p.firstDial = nil
+	}
+	p.mu.Unlock()
+
+	if d != nil {
+		d.pc, d.err = pc, err
+		close(d.done)
+	}
+}
+
+// open dials a new connection and adds it to the pool
+func (p *pipelinePool) open(ctx context.Context) (*pipelineConn, error) {
+	conn, err := p.dial(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	pc := newPipelineConn(conn)
+	go pc.readLoop()
+
+	p.mu.Lock()
+	p.conns = append(p.conns, pc)
+	p.mu.Unlock()
+
+	log.Tracef("Opened a new connection to %s", p.address)
+	return pc, nil
+}
+
+// leastLoaded removes the closed connections and returns the one with the fewest pending queries
+// p.mu must be locked
+func (p *pipelinePool) leastLoaded() *pipelineConn {
+	var best *pipelineConn
+	conns := p.conns[:0]
+	for _, pc := range p.conns {
+		if pc.isClosed() {
+			continue
+		}
+		conns = append(conns, pc)
+		if best == nil || pc.load() < best.load() {
+			best = pc
+		}
+	}
+	for i := len(conns); i < len(p.conns); i++ {
+		p.conns[i] = nil
+	}
+	p.conns = conns
+	return best
+}
+
+// pipelineConn is a stream connection with many outstanding queries
+type pipelineConn struct {
+	conn net.Conn
+
+	writeMu sync.Mutex // serializes writes
+
+	pending  map[uint16]chan *dns.Msg // pending queries by the message ID
+	lastRead time.Time                // the last time a response was received
+	err      error                    // the reason the connection is closed (nil if it's alive)
+	mu       sync.Mutex               // protects pending, lastRead and err
+	done     chan struct{}            // closed when the connection is closed
+}
+
+// newPipelineConn creates a new pipelineConn
+func newPipelineConn(conn net.Conn) *pipelineConn {
+	return &pipelineConn{
+		conn:     conn,
+		pending:  map[uint16]chan *dns.Msg{},
+		lastRead: time.Now(),
+		done:     make(chan struct{}),
+	}
+}
+
+// exchange sends the packed query and waits for the response
+// The ID of the query is replaced with the one that is unique on this connection
+func (pc *pipelineConn) exchange(ctx context.Context, buf []byte, timeout time.Duration) (*dns.Msg, error) {
+	id, ch, err := pc.register()
+	if err != nil {
+		return nil, err
+	}
+	defer pc.unregister(id)
+
+	// Length prefix + the query with the unique ID
+	req := make([]byte, 2+len(buf))
+	binary.BigEndian.PutUint16(req, uint16(len(buf)))
+	copy(req[2:], buf)
+	binary.BigEndian.PutUint16(req[2:], id)
+
+	timeout = contextTimeout(ctx, timeout)
+	err = pc.write(req, timeout)
+	if err != nil {
+		pc.close(err)
+		return nil, errPipelineConnClosed
+	}
+
+	var timer <-chan time.Time
+	if timeout > 0 {
+		t := time.NewTimer(timeout)
+		defer t.Stop()
+		timer = t.C
+	}
+
+	select {
+	case reply := <-ch:
+		return reply, nil
+	case <-pc.done:
+		return nil, errPipelineConnClosed
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-timer:
+		pc.checkStalled(timeout)
+		return nil, contextError(ctx, fmt.Errorf("no response received in %s", timeout))
+	}
+}
+
+// register allocates a unique message ID for a new query
+func (pc *pipelineConn) register() (uint16, chan *dns.Msg, error) {
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+
+	if pc.err != nil {
+		return 0, nil, errPipelineConnClosed
+	}
+
+	id := dns.Id()
+	for _, ok := pc.pending[id]; ok; _, ok = pc.pending[id] {
+		id = dns.Id()
+	}
+
+	ch := make(chan *dns.Msg, 1)
+	pc.pending[id] = ch
+	return id, ch, nil
+}
+
+// unregister removes the query from the pending ones
+func (pc *pipelineConn) unregister(id uint16) {
+	pc.mu.Lock()
+	delete(pc.pending, id)
+	pc.mu.Unlock()
+}
+
+// write writes the query to the connection, there's no deadline if timeout is 0
+func (pc *pipelineConn) write(req []byte, timeout time.Duration) error {
+	pc.writeMu.Lock()
+	defer pc.writeMu.Unlock()
+
+	// The deadline is always set so that the one of the previous write didn't apply to this one
+	var deadline time.Time
+	if timeout > 0 {
+		deadline = time.Now().Add(timeout)
+	}
+	_ = pc.conn.SetWriteDeadline(deadline)
+	_, err := pc.conn.Write(req)
+	return err
+}
+
+// readLoop reads the responses and passes them to the pending queries until the connection is closed
+func (pc *pipelineConn) readLoop() {
+	r := bufio.NewReader(pc.conn)
+	l := make([]byte, 2)
+	for {
+		_, err := io.ReadFull(r, l)
+		if err != nil {
+			pc.close(err)
+			return
+		}
+
+		buf := make([]byte, binary.BigEndian.Uint16(l))
+		_, err = io.ReadFull(r, buf)
+		if err != nil {
+			pc.close(err)
+			return
+		}
+
+		reply := &dns.Msg{}
+		err = reply.Unpack(buf)
+		if err != nil {
+			log.Tracef("failed to unpack a response from %s: %s", pc.conn.RemoteAddr(), err)
+			continue
+		}
+
+		pc.mu.Lock()
+		pc.lastRead = time.Now()
+		ch, ok := pc.pending[reply.Id]
+		delete(pc.pending, reply.Id)
+		pc.mu.Unlock()
+
+		if ok {
+			ch <- reply
+		} else {
+			log.Tracef("unexpected response with ID %d from %s", reply.Id, pc.conn.RemoteAddr())
+		}
+	}
+}
+
+// checkStalled closes the connection if nothing has been received for the whole timeout
+// while there are outstanding queries. Otherwise the dead connection would be used forever.
+func (pc *pipelineConn) checkStalled(timeout time.Duration) {
+	pc.mu.Lock()
+	stalled := time.Since(pc.lastRead) >= timeout
+	pc.mu.Unlock()
+
+	if stalled {
+		pc.close(errors.New("connection stalled"))
+	}
+}
+
+// close closes the connection, the pending queries fail with errPipelineConnClosed
+func (pc *pipelineConn) close(reason error) {
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+
+	if pc.err != nil {
+		return
+	}
+	if reason == nil {
+		reason = errPipelineConnClosed
+	}
+	pc.err = reason
+	log.Tracef("Closing the connection to %s: %s", pc.conn.RemoteAddr(), reason)
+	_ = pc.conn.Close()
+	close(pc.done)
+}
+
+// load returns the number of pending queries
+func (pc *pipelineConn) load() int {
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+	return len(pc.pending)
+}
+
+// isClosed returns true if the connection is closed
+func (pc *pipelineConn) isClosed() bool {
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+	return pc.err != nil
+}
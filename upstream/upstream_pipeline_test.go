@@ -0,0 +1,192 @@
+package upstream
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPipelinePoolOutOfOrder(t *testing.T) {
+	// The server reads two queries and answers them in the reverse order
+	addr, accepted := startPipelineTestServer(t, func(c *dns.Conn) {
+		q1, err := c.ReadMsg()
+		if err != nil {
+			return
+		}
+		q2, err := c.ReadMsg()
+		if err != nil {
+			return
+		}
+		_ = c.WriteMsg(pipelineTestReply(q2))
+		_ = c.WriteMsg(pipelineTestReply(q1))
+	})
+
+	u := newPlainDNSOverTCP(addr, timeout, 1)
+
+	var wg sync.WaitGroup
+	for _, host := range []string{"first.example.org", "second.example.org"} {
+		wg.Add(1)
+		go func(host string) {
+			defer wg.Done()
+			req := createHostTestMessage(host)
+			reply, err := u.Exchange(req)
+			assert.Nil(t, err)
+			if assert.NotNil(t, reply) {
+				assert.Equal(t, req.Id, reply.Id)
+				assert.Equal(t, dns.Fqdn(host), reply.Question[0].Name)
+			}
+		}(host)
+	}
+	wg.Wait()
+
+	// Both queries have been sent over the same connection
+	assert.Equal(t, int32(1), atomic.LoadInt32(accepted))
+}
+
+func TestPipelinePoolReconnect(t *testing.T) {
+	// The server closes the connection after every response
+	addr, accepted := startPipelineTestServer(t, func(c *dns.Conn) {
+		q, err := c.ReadMsg()
+		if err != nil {
+			return
+		}
+		_ = c.WriteMsg(pipelineTestReply(q))
+	})
+
+	u := newPlainDNSOverTCP(addr, timeout, 1)
+	for i := 0; i < 3; i++ {
+		reply, err := u.Exchange(createHostTestMessage("example.org"))
+		assert.Nil(t, err)
+		assert.NotNil(t, reply)
+
+		// Let the pool notice that the connection is closed
+		time.Sleep(50 * time.Millisecond)
+	}
+	assert.Equal(t, int32(3), atomic.LoadInt32(accepted))
+}
+
+func TestPipelinePoolMaxConnections(t *testing.T) {
+	addr, accepted := startPipelineTestServer(t, func(c *dns.Conn) {
+		var lock sync.Mutex
+		for {
+			q, err := c.ReadMsg()
+			if err != nil {
+				return
+			}
+			go func() {
+				time.Sleep(50 * time.Millisecond)
+				lock.Lock()
+				_ = c.WriteMsg(pipelineTestReply(q))
+				lock.Unlock()
+			}()
+		}
+	})
+
+	const maxConns = 2
+	u := newPlainDNSOverTCP(addr, timeout, maxConns)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			reply, err := u.Exchange(createHostTestMessage(fmt.Sprintf("host%d.example.org", i)))
+			assert.Nil(t, err)
+			assert.NotNil(t, reply)
+		}(i)
+	}
+	wg.Wait()
+
+	n := atomic.LoadInt32(accepted)
+	assert.True(t, n >= 1 && n <= maxConns, "accepted %d connections", n)
+}
+
+func TestPipelinePoolCancel(t *testing.T) {
+	// The server never responds
+	addr, _ := startPipelineTestServer(t, func(c *dns.Conn) {
+		for {
+			_, err := c.ReadMsg()
+			if err != nil {
+				return
+			}
+		}
+	})
+
+	u := newPlainDNSOverTCP(addr, timeout, 1)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	_, err := u.ExchangeContext(ctx, createHostTestMessage("example.org"))
+	assert.Equal(t, context.DeadlineExceeded, err)
+	assert.True(t, time.Since(start) < time.Second)
+
+	// The connection is still usable for the other queries
+	u.pool.mu.Lock()
+	assert.Equal(t, 1, len(u.pool.conns))
+	u.pool.mu.Unlock()
+}
+
+// startPipelineTestServer starts a TCP DNS server that handles every connection with the specified function.
+// Returns the server address and the number of the accepted connections.
+func TestPipelineConnWriteDeadline(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+	go func() { _, _ = io.Copy(io.Discard, server) }()
+
+	pc := &pipelineConn{conn: client}
+	assert.Nil(t, pc.write([]byte{1}, 10*time.Millisecond))
+
+	// The deadline of the previous write has passed, but it doesn't apply to this one
+	time.Sleep(50 * time.Millisecond)
+	assert.Nil(t, pc.write([]byte{2}, 0))
+}
+
+func startPipelineTestServer(t *testing.T, handle func(c *dns.Conn)) (string, *int32) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("cannot listen: %s", err)
+	}
+	t.Cleanup(func() {
+		_ = l.Close()
+	})
+
+	var accepted int32
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			atomic.AddInt32(&accepted, 1)
+			go func() {
+				c := &dns.Conn{Conn: conn}
+				handle(c)
+				_ = c.Close()
+			}()
+		}
+	}()
+
+	return l.Addr().String(), &accepted
+}
+
+// pipelineTestReply creates a response to the test query
+func pipelineTestReply(req *dns.Msg) *dns.Msg {
+	resp := &dns.Msg{}
+	resp.SetReply(req)
+	resp.Answer = append(resp.Answer, &dns.A{
+		Hdr: dns.RR_Header{Name: req.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60},
+		A:   net.IP{1, 2, 3, 4},
+	})
+	return resp
+}
@@ -1,6 +1,9 @@
 package upstream
 
 import (
+	"context"
+	"fmt"
+	"net"
 	"time"
 
 	"github.com/AdguardTeam/golibs/log"
@@ -14,6 +17,36 @@ type plainDNS struct {
 	address   string
 	timeout   time.Duration
 	preferTCP bool
+	pool      *pipelinePool // pipelines the queries over a few long-lived TCP connections (if preferTCP is set)
+	dialer    contextDialer // opens the connections (nil means a direct net.Dialer)
+}
+
+// newPlainDNS creates a new plain DNS upstream with the specified options
+// If preferTCP is set, it uses TCP only, otherwise it uses UDP and TCP for the truncated responses.
+func newPlainDNS(address string, preferTCP bool, opts Options) (*plainDNS, error) {
+	if !preferTCP && opts.Proxy != nil {
+		return nil, fmt.Errorf("plain DNS-over-UDP upstream %s can't be used with the proxy, use tcp://%s instead", address, address)
+	}
+
+	dialer, err := newDialer(opts)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &plainDNS{address: address, timeout: opts.Timeout}
+	if preferTCP {
+		p = newPlainDNSOverTCP(address, opts.Timeout, opts.MaxConnections)
+	}
+	p.dialer = dialer
+	return p, nil
+}
+
+// newPlainDNSOverTCP creates a new plain DNS upstream that uses TCP only
+// maxConns is the maximum number of TCP connections (0 means the default value)
+func newPlainDNSOverTCP(address string, timeout time.Duration, maxConns int) *plainDNS {
+	p := &plainDNS{address: address, timeout: timeout, preferTCP: true}
+	p.pool = newPipelinePool(p.Address(), p.dialTCP, timeout, maxConns)
+	return p
 }
 
 // Address returns the original address that we've put in initially, not resolved one
@@ -25,27 +58,61 @@ func (p *plainDNS) Address() string {
 }
 
 func (p *plainDNS) Exchange(m *dns.Msg) (*dns.Msg, error) {
+	return p.ExchangeContext(context.Background(), m)
+}
+
+func (p *plainDNS) ExchangeContext(ctx context.Context, m *dns.Msg) (*dns.Msg, error) {
 	if p.preferTCP {
-		tcpClient := dns.Client{Net: "tcp", Timeout: p.timeout}
 		logBegin(p.Address(), m)
-		reply, _, tcpErr := tcpClient.Exchange(m, p.address)
+		reply, tcpErr := p.pool.Exchange(ctx, m)
 		logFinish(p.Address(), tcpErr)
 		return reply, tcpErr
 	}
 
-	client := dns.Client{Timeout: p.timeout, UDPSize: dns.MaxMsgSize}
-
 	logBegin(p.Address(), m)
-	reply, _, err := client.Exchange(m, p.address)
+	reply, err := p.exchangeNet(ctx, "udp", m)
 	logFinish(p.Address(), err)
 
 	if reply != nil && reply.Truncated {
 		log.Tracef("Truncated message was received, retrying over TCP, question: %s", m.Question[0].String())
-		tcpClient := dns.Client{Net: "tcp", Timeout: p.timeout}
 		logBegin(p.Address(), m)
-		reply, _, err = tcpClient.Exchange(m, p.address)
+		reply, err = p.exchangeNet(ctx, "tcp", m)
 		logFinish(p.Address(), err)
 	}
 
 	return reply, err
 }
+
+// exchangeNet sends the DNS query over the specified network ("udp" or "tcp").
+// The connection is closed as soon as ctx is done.
+func (p *plainDNS) exchangeNet(ctx context.Context, network string, m *dns.Msg) (*dns.Msg, error) {
+	timeout := contextTimeout(ctx, p.timeout)
+	client := dns.Client{Net: network, Timeout: timeout, UDPSize: dns.MaxMsgSize}
+
+	rawConn, err := p.dial(ctx, network)
+	if err != nil {
+		return nil, contextError(ctx, err)
+	}
+	conn := &dns.Conn{Conn: rawConn, UDPSize: client.UDPSize}
+	defer conn.Close()
+
+	stop := closeOnDone(ctx, rawConn)
+	defer stop()
+
+	reply, _, err := client.ExchangeWithConn(m, conn)
+	return reply, contextError(ctx, err)
+}
+
+// dialTCP opens a new TCP connection for the pipelinePool
+func (p *plainDNS) dialTCP(ctx context.Context) (net.Conn, error) {
+	return p.dial(ctx, "tcp")
+}
+
+// dial opens a new connection to the upstream
+func (p *plainDNS) dial(ctx context.Context, network string) (net.Conn, error) {
+	dialer := p.dialer
+	if dialer == nil {
+		dialer = &net.Dialer{Timeout: p.timeout}
+	}
+	return dialer.DialContext(ctx, network, p.address)
+}
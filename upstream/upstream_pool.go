@@ -14,6 +14,10 @@ import (
 const dialTimeout = 10 * time.Second
 
 // TLSPool is a connections pool for the DNS-over-TLS Upstream.
+// Every connection taken from the pool is used for a single query at a time.
+//
+// Deprecated: DNS-over-TLS upstreams pipeline the queries over a few long-lived connections now,
+// TLSPool is kept for the backward compatibility only.
 //
 // Example:
 //  pool := TLSPool{Address: "tls://1.1.1.1:853"}
@@ -72,7 +76,7 @@ func (n *TLSPool) Create() (net.Conn, error) {
 	}
 
 	// we'll need a new connection, dial now
-	conn, err := tlsDial(dialContext, "tcp", tlsConfig)
+	conn, err := tlsDial(context.TODO(), dialContext, "tcp", tlsConfig)
 	if err != nil {
 		return nil, errorx.Decorate(err, "Failed to connect to %s", tlsConfig.ServerName)
 	}
@@ -90,9 +94,9 @@ func (n *TLSPool) Put(c net.Conn) {
 }
 
 // tlsDial is basically the same as tls.DialWithDialer, but we will call our own dialContext function to get connection
-func tlsDial(dialContext dialHandler, network string, config *tls.Config) (*tls.Conn, error) {
+func tlsDial(ctx context.Context, dialContext dialHandler, network string, config *tls.Config) (*tls.Conn, error) {
 	// we're using bootstrapped address instead of what's passed to the function
-	rawConn, err := dialContext(context.TODO(), network, "")
+	rawConn, err := dialContext(ctx, network, "")
 	if err != nil {
 		return nil, err
 	}
@@ -107,7 +111,7 @@ func tlsDial(dialContext dialHandler, network string, config *tls.Config) (*tls.
 		return nil, err
 	}
 
-	err = conn.Handshake()
+	err = conn.HandshakeContext(ctx)
 	if err != nil {
 		conn.Close()
 		return nil, err
@@ -0,0 +1,260 @@
+package upstream
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/AdguardTeam/golibs/log"
+	"github.com/joomcode/errorx"
+	"github.com/miekg/dns"
+	"github.com/quic-go/quic-go"
+)
+
+// NextProtoDQ is the ALPN token for DNS-over-QUIC (RFC 9250)
+const NextProtoDQ = "doq"
+
+// QUICCodeNoError is used when the connection or stream needs to be closed, but there is no error to signal
+const QUICCodeNoError = quic.ApplicationErrorCode(0)
+
+// handshakeTimeout is the default QUIC handshake timeout
+const handshakeTimeout = 5 * time.Second
+
+// DNS-over-QUIC
+type dnsOverQUIC struct {
+	boot *bootstrapper
+	conn *quic.Conn // QUIC connection that is shared by all the queries
+
+	sync.RWMutex // protects conn
+}
+
+func (p *dnsOverQUIC) Address() string { return p.boot.address }
+
+func (p *dnsOverQUIC) Exchange(m *dns.Msg) (*dns.Msg, error) {
+	return p.ExchangeContext(context.Background(), m)
+}
+
+func (p *dnsOverQUIC) ExchangeContext(ctx context.Context, m *dns.Msg) (*dns.Msg, error) {
+	conn, err := p.getConnection()
+	if err != nil {
+		return nil, errorx.Decorate(err, "failed to open a QUIC connection to %s", p.Address())
+	}
+
+	logBegin(p.Address(), m)
+	reply, err := p.exchangeQUIC(ctx, conn, m)
+	logFinish(p.Address(), err)
+	if ctx.Err() != nil {
+		// Only the stream is cancelled, the connection is still usable
+		return nil, ctx.Err()
+	}
+	if err != nil && isQUICConnClosed(conn, err) {
+		log.Tracef("The QUIC connection is expired due to %s", err)
+
+		// The connection might have been closed by the server due to the idle timeout.
+		// So we're trying to re-connect right away here.
+		p.resetConnection(conn)
+		conn, err = p.getConnection()
+		if err != nil {
+			return nil, errorx.Decorate(err, "failed to open a new QUIC connection to %s", p.Address())
+		}
+
+		// Retry sending the DNS request
+		logBegin(p.Address(), m)
+		reply, err = p.exchangeQUIC(ctx, conn, m)
+		logFinish(p.Address(), err)
+	}
+
+	return reply, err
+}
+
+// exchangeQUIC sends the DNS query in a new stream of the specified QUIC connection
+func (p *dnsOverQUIC) exchangeQUIC(ctx context.Context, conn *quic.Conn, m *dns.Msg) (*dns.Msg, error) {
+	// When sending queries over a QUIC connection, the DNS Message ID MUST be set to 0.
+	// We don't modify the original message as it may be shared by several upstreams.
+	req := m.Copy()
+	req.Id = 0
+	buf, err := req.Pack()
+	if err != nil {
+		return nil, errorx.Decorate(err, "couldn't pack request msg")
+	}
+	buf = append([]byte{0, 0}, buf...)
+	binary.BigEndian.PutUint16(buf, uint16(len(buf)-2))
+
+	if p.boot.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, p.boot.timeout)
+		defer cancel()
+	}
+
+	stream, err := conn.OpenStreamSync(ctx)
+	if err != nil {
+		return nil, errorx.Decorate(err, "failed to open a QUIC stream to %s", p.Address())
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = stream.SetDeadline(deadline)
+	}
+	// Abort the stream (but not the whole connection) as soon as ctx is done
+	stop := context.AfterFunc(ctx, func() {
+		stream.CancelRead(0)
+		stream.CancelWrite(0)
+	})
+	defer stop()
+
+	_, err = stream.Write(buf)
+	if err != nil {
+		return nil, errorx.Decorate(err, "failed to send a request to %s", p.Address())
+	}
+
+	// The client MUST indicate through the STREAM FIN mechanism
+	// that no further data will be sent on that stream.
+	_ = stream.Close()
+
+	var length uint16
+	err = binary.Read(stream, binary.BigEndian, &length)
+	if err != nil {
+		return nil, errorx.Decorate(err, "failed to read a response from %s", p.Address())
+	}
+	respBuf := make([]byte, length)
+	_, err = io.ReadFull(stream, respBuf)
+	if err != nil {
+		return nil, errorx.Decorate(err, "failed to read a response from %s", p.Address())
+	}
+
+	reply := &dns.Msg{}
+	err = reply.Unpack(respBuf)
+	if err != nil {
+		return nil, errorx.Decorate(err, "couldn't unpack DNS response from %s", p.Address())
+	}
+
+	// Restore the original message ID so that the response matched the request
+	reply.Id = m.Id
+	return reply, nil
+}
+
+// isQUICConnClosed checks if the query failed because the QUIC connection is closed
+// (e.g. by the server due to the idle timeout) so that it's worth retrying over a new connection.
+// The other errors, e.g. timeouts, are returned right away.
+func isQUICConnClosed(conn *quic.Conn, err error) bool {
+	if conn.Context().Err() != nil {
+		return true
+	}
+
+	// errorx doesn't support errors.As
+	for e := errorx.Cast(err); e != nil; e = errorx.Cast(err) {
+		err = e.Cause()
+	}
+
+	var idleErr *quic.IdleTimeoutError
+	var appErr *quic.ApplicationError
+	var transportErr *quic.TransportError
+	var resetErr *quic.StatelessResetError
+	return errors.As(err, &idleErr) || errors.As(err, &appErr) || errors.As(err, &transportErr) ||
+		errors.As(err, &resetErr) || errors.Is(err, net.ErrClosed)
+}
+
+// getConnection returns the active QUIC connection or opens a new one.
+// The connection is opened without holding the lock so that the other queries weren't blocked.
+func (p *dnsOverQUIC) getConnection() (*quic.Conn, error) {
+	p.RLock()
+	conn := p.conn
+	p.RUnlock()
+	if conn != nil && conn.Context().Err() == nil {
+		return conn, nil
+	}
+
+	conn, err := p.openConnection()
+	if err != nil {
+		return nil, err
+	}
+
+	p.Lock()
+	defer p.Unlock()
+
+	// Another connection might have been opened in the meantime
+	if p.conn != nil && p.conn.Context().Err() == nil {
+		_ = conn.CloseWithError(QUICCodeNoError, "")
+		return p.conn, nil
+	}
+	p.conn = conn
+	return conn, nil
+}
+
+// resetConnection closes the specified connection if it's still the active one
+// so that the next query opened a new connection
+func (p *dnsOverQUIC) resetConnection(conn *quic.Conn) {
+	p.Lock()
+	defer p.Unlock()
+
+	if p.conn == conn {
+		_ = conn.CloseWithError(QUICCodeNoError, "")
+		p.conn = nil
+	}
+}
+
+// openConnection dials a new QUIC connection to the bootstrapped address
+func (p *dnsOverQUIC) openConnection() (*quic.Conn, error) {
+	tlsConfig, dialContext, err := p.boot.get()
+	if err != nil {
+		return nil, err
+	}
+
+	// We're using the bootstrapped address instead of what's passed to the function.
+	// It does not create an actual connection, but it helps us determine
+	// what IP address is actually reachable (when there are both IPv4 and IPv6 addresses)
+	rawConn, err := dialContext(context.TODO(), "udp", "")
+	if err != nil {
+		return nil, err
+	}
+	// It's never actually used
+	_ = rawConn.Close()
+
+	udpConn, ok := rawConn.(*net.UDPConn)
+	if !ok {
+		return nil, fmt.Errorf("failed to open connection to %s", p.Address())
+	}
+	addr := udpConn.RemoteAddr()
+
+	// The proxy is rejected in AddressToUpstream so that the dialer is always the direct one
+	dialer, ok := p.boot.dialer.(*directDialer)
+	if !ok {
+		return nil, fmt.Errorf("DNS-over-QUIC upstream %s can't be used with the proxy", p.Address())
+	}
+
+	tlsConfig = tlsConfig.Clone()
+	tlsConfig.NextProtos = []string{NextProtoDQ}
+
+	quicConfig := &quic.Config{
+		HandshakeIdleTimeout: handshakeTimeout,
+	}
+
+	ctx := context.Background()
+	if p.boot.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, p.boot.timeout)
+		defer cancel()
+	}
+
+	// The socket is bound to the outbound address and interface
+	packetConn, err := dialer.listenUDP(ctx)
+	if err != nil {
+		return nil, errorx.Decorate(err, "failed to open UDP socket for %s", p.Address())
+	}
+
+	conn, err := quic.Dial(ctx, packetConn, addr, tlsConfig, quicConfig)
+	if err != nil {
+		_ = packetConn.Close()
+		return nil, errorx.Decorate(err, "failed to open QUIC connection to %s", p.Address())
+	}
+
+	// quic.Dial leaves closing the socket to the caller
+	go func() {
+		<-conn.Context().Done()
+		_ = packetConn.Close()
+	}()
+	return conn, nil
+}
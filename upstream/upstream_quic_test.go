@@ -0,0 +1,226 @@
+package upstream
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/binary"
+	"io"
+	"math/big"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/quic-go/quic-go"
+	"github.com/stretchr/testify/assert"
+)
+
+const tlsServerName = "testdns.adguard.com"
+
+func TestUpstreamDOQ(t *testing.T) {
+	srv := startTestQUICServer(t, false)
+	defer srv.close()
+
+	address := "quic://" + net.JoinHostPort(tlsServerName, srv.port())
+	u, err := AddressToUpstream(address, Options{Timeout: timeout, ServerIP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("Failed to generate upstream from address %s: %s", address, err)
+	}
+	assert.Equal(t, address, u.Address())
+
+	// The same connection must be reused for every query
+	for i := 0; i < 3; i++ {
+		checkUpstream(t, u, address)
+	}
+	assert.Equal(t, int32(1), atomic.LoadInt32(&srv.conns))
+}
+
+func TestUpstreamDOQReconnect(t *testing.T) {
+	// The server drops the connection instead of answering the second query on it,
+	// so the client has to re-connect and retry the query
+	srv := startTestQUICServer(t, true)
+	defer srv.close()
+
+	address := "quic://" + net.JoinHostPort(tlsServerName, srv.port())
+	u, err := AddressToUpstream(address, Options{Timeout: timeout, ServerIP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("Failed to generate upstream from address %s: %s", address, err)
+	}
+
+	for i := 0; i < 3; i++ {
+		checkUpstream(t, u, address)
+	}
+	assert.True(t, atomic.LoadInt32(&srv.conns) > 1)
+}
+
+func TestUpstreamDOQTimeout(t *testing.T) {
+	srv := startTestQUICServer(t, false)
+	defer srv.close()
+
+	address := "quic://" + net.JoinHostPort(tlsServerName, srv.port())
+	u, err := AddressToUpstream(address, Options{Timeout: 300 * time.Millisecond, ServerIP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("Failed to generate upstream from address %s: %s", address, err)
+	}
+	checkUpstream(t, u, address)
+
+	// The timeout on a working connection isn't retried over a new one
+	atomic.StoreInt32(&srv.silent, 1)
+	start := time.Now()
+	_, err = u.Exchange(createTestMessage())
+	assert.NotNil(t, err)
+	assert.Less(t, time.Since(start), 600*time.Millisecond)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&srv.conns))
+}
+
+func TestUpstreamDOQStamp(t *testing.T) {
+	// AdGuard DNS (DNS-over-QUIC)
+	u, err := AddressToUpstream("sdns://BAcAAAAAAAAAAAAXZG5zLmFkZ3VhcmQtZG5zLmNvbTo3ODQ", Options{Bootstrap: []string{"8.8.8.8"}})
+	if err != nil {
+		t.Fatalf("Failed to generate upstream from the stamp: %s", err)
+	}
+	_, ok := u.(*dnsOverQUIC)
+	assert.True(t, ok)
+	assert.Equal(t, "quic://dns.adguard-dns.com:784", u.Address())
+}
+
+// testQUICServer is a simple DNS-over-QUIC server that responds with 8.8.8.8 to every query
+type testQUICServer struct {
+	listener  *quic.Listener
+	closeConn bool              // if true, the server answers only one query per connection
+	silent    int32             // if 1, the server reads the queries but doesn't answer them
+	conns     int32             // number of accepted connections
+	client    atomic.Value      // address of the last accepted client (net.Addr)
+	cert      *x509.Certificate // server certificate
+}
+
+// startTestQUICServer starts a DoQ server on a random port and adds its certificate to RootCAs
+func startTestQUICServer(t *testing.T, closeConn bool) *testQUICServer {
+	tlsConfig, roots := createServerTLSConfig(t)
+	tlsConfig.NextProtos = []string{NextProtoDQ}
+
+	oldRootCAs := RootCAs
+	RootCAs = roots
+	t.Cleanup(func() { RootCAs = oldRootCAs })
+
+	l, err := quic.ListenAddr("127.0.0.1:0", tlsConfig, nil)
+	if err != nil {
+		t.Fatalf("cannot start the QUIC listener: %s", err)
+	}
+
+	cert, err := x509.ParseCertificate(tlsConfig.Certificates[0].Certificate[0])
+	if err != nil {
+		t.Fatalf("failed to parse certificate: %s", err)
+	}
+
+	srv := &testQUICServer{listener: l, closeConn: closeConn, cert: cert}
+	go srv.serve()
+	return srv
+}
+
+func (s *testQUICServer) port() string {
+	_, port, _ := net.SplitHostPort(s.listener.Addr().String())
+	return port
+}
+
+func (s *testQUICServer) close() {
+	_ = s.listener.Close()
+}
+
+func (s *testQUICServer) serve() {
+	for {
+		conn, err := s.listener.Accept(context.Background())
+		if err != nil {
+			return
+		}
+		atomic.AddInt32(&s.conns, 1)
+		s.client.Store(conn.RemoteAddr())
+
+		go func() {
+			for i := 0; ; i++ {
+				stream, err := conn.AcceptStream(context.Background())
+				if err != nil {
+					return
+				}
+				if s.closeConn && i > 0 {
+					_ = conn.CloseWithError(QUICCodeNoError, "")
+					return
+				}
+				s.handleStream(stream)
+			}
+		}()
+	}
+}
+
+func (s *testQUICServer) handleStream(stream *quic.Stream) {
+	defer stream.Close()
+
+	var length uint16
+	if binary.Read(stream, binary.BigEndian, &length) != nil {
+		return
+	}
+	buf := make([]byte, length)
+	if _, err := io.ReadFull(stream, buf); err != nil {
+		return
+	}
+
+	req := &dns.Msg{}
+	if req.Unpack(buf) != nil || req.Id != 0 || atomic.LoadInt32(&s.silent) == 1 {
+		return
+	}
+
+	resp := &dns.Msg{}
+	resp.SetReply(req)
+	resp.Answer = append(resp.Answer, &dns.A{
+		Hdr: dns.RR_Header{Name: req.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60},
+		A:   net.IPv4(8, 8, 8, 8),
+	})
+	packed, _ := resp.Pack()
+	packed = append([]byte{0, 0}, packed...)
+	binary.BigEndian.PutUint16(packed, uint16(len(packed)-2))
+	_, _ = stream.Write(packed)
+}
+
+// createServerTLSConfig creates a self-signed certificate for tlsServerName
+// and returns the server TLS config and the pool with this certificate
+func createServerTLSConfig(t *testing.T) (*tls.Config, *x509.CertPool) {
+	privateKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("cannot generate the key: %s", err)
+	}
+
+	template := x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{Organization: []string{"AdGuard Tests"}},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(24 * time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		DNSNames:              []string{tlsServerName},
+	}
+
+	derBytes, err := x509.CreateCertificate(rand.Reader, &template, &template, &privateKey.PublicKey, privateKey)
+	if err != nil {
+		t.Fatalf("failed to create certificate: %s", err)
+	}
+	cert, err := x509.ParseCertificate(derBytes)
+	if err != nil {
+		t.Fatalf("failed to parse certificate: %s", err)
+	}
+
+	roots := x509.NewCertPool()
+	roots.AddCert(cert)
+
+	tlsConfig := &tls.Config{
+		Certificates: []tls.Certificate{{Certificate: [][]byte{derBytes}, PrivateKey: privateKey}},
+	}
+	return tlsConfig, roots
+}
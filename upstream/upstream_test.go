@@ -2,11 +2,20 @@ package upstream
 
 import (
 	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
 	"fmt"
 	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
 	"testing"
 	"time"
 
+	"github.com/ameshkov/dnsstamps"
 	"github.com/miekg/dns"
 	"github.com/stretchr/testify/assert"
 )
@@ -112,11 +121,13 @@ func TestTLSPoolReconnect(t *testing.T) {
 	}
 	assertResponse(t, reply)
 
-	// Now let's close the pooled connection and return it back to the pool
+	// Now let's close the pooled connection
 	p := u.(*dnsOverTLS)
-	conn, _ := p.pool.Get()
-	conn.Close()
-	p.pool.Put(conn)
+	p.pool.mu.Lock()
+	for _, pc := range p.pool.conns {
+		_ = pc.conn.Close()
+	}
+	p.pool.mu.Unlock()
 
 	// Send the second test message
 	req = createTestMessage()
@@ -127,6 +138,8 @@ func TestTLSPoolReconnect(t *testing.T) {
 	assertResponse(t, reply)
 
 	// Now assert that the number of connections in the pool is not changed
+	p.pool.mu.Lock()
+	defer p.pool.mu.Unlock()
 	if len(p.pool.conns) != 1 {
 		t.Fatal("wrong number of pooled connections")
 	}
@@ -147,14 +160,14 @@ func TestTLSPoolDeadLine(t *testing.T) {
 	}
 	assertResponse(t, response)
 
-	p := u.(*dnsOverTLS)
+	pool := &TLSPool{boot: u.(*dnsOverTLS).boot}
 
 	// Now let's get connection from the pool and use it
-	conn, err := p.pool.Get()
+	conn, err := pool.Get()
 	if err != nil {
 		t.Fatalf("couldn't get connection from pool: %s", err)
 	}
-	response, err = p.exchangeConn(conn, req)
+	response, err = exchangePoolConn(conn, req)
 	if err != nil {
 		t.Fatalf("first DNS message failed: %s", err)
 	}
@@ -165,14 +178,14 @@ func TestTLSPoolDeadLine(t *testing.T) {
 	if err != nil {
 		t.Fatalf("can't set new deadLine for connection. Looks like it's already closed: %s", err)
 	}
-	p.pool.Put(conn)
+	pool.Put(conn)
 
 	// Get connection from the pool and reuse it
-	conn, err = p.pool.Get()
+	conn, err = pool.Get()
 	if err != nil {
 		t.Fatalf("couldn't get connection from pool: %s", err)
 	}
-	response, err = p.exchangeConn(conn, req)
+	response, err = exchangePoolConn(conn, req)
 	if err != nil {
 		t.Fatalf("first DNS message failed: %s", err)
 	}
@@ -185,12 +198,22 @@ func TestTLSPoolDeadLine(t *testing.T) {
 	}
 
 	// Connection with expired deadLine can't be used
-	response, err = p.exchangeConn(conn, req)
+	response, err = exchangePoolConn(conn, req)
 	if err == nil {
 		t.Fatalf("this connection should be already closed, got response %s", response)
 	}
 }
 
+// exchangePoolConn sends the DNS query over the connection taken from TLSPool
+func exchangePoolConn(conn net.Conn, req *dns.Msg) (*dns.Msg, error) {
+	c := dns.Conn{Conn: conn}
+	err := c.WriteMsg(req)
+	if err != nil {
+		return nil, err
+	}
+	return c.ReadMsg()
+}
+
 func TestDNSTruncated(t *testing.T) {
 	// AdGuard DNS
 	address := "176.103.130.130:53"
@@ -262,7 +285,7 @@ func TestDialContext(t *testing.T) {
 		},
 	}
 	for _, test := range resolved {
-		dialContext := createDialContext(test.addresses, 2*time.Second)
+		dialContext := createDialContext(test.addresses, newHappyEyeballsDialer(&net.Dialer{Timeout: 2 * time.Second}, NoIPPreference))
 		_, err := dialContext(context.TODO(), "tcp", "")
 		if err != nil {
 			t.Fatalf("Couldn't dial to %s: %s", test.host, err)
@@ -391,6 +414,211 @@ func TestUpstreamAddress(t *testing.T) {
 
 	u, _ = AddressToUpstream("https://one.one.one.one", opt)
 	assert.Equal(t, "https://one.one.one.one:443", u.Address())
+
+	u, _ = AddressToUpstream("quic://one.one.one.one", opt)
+	assert.Equal(t, "quic://one.one.one.one:853", u.Address())
+}
+
+func TestUpstreamOptions(t *testing.T) {
+	u, err := AddressToUpstream("tls://dns.example?ip=1.2.3.4&timeout=2s&sni=other.name&insecure=1", Options{Timeout: timeout})
+	assert.Nil(t, err)
+	assert.Equal(t, "tls://dns.example:853", u.Address())
+	boot := u.(*dnsOverTLS).boot
+	assert.Equal(t, 2*time.Second, boot.timeout)
+	assert.Equal(t, "other.name", boot.resolvedConfig.ServerName)
+	assert.True(t, boot.resolvedConfig.InsecureSkipVerify)
+
+	u, err = AddressToUpstream("https://dns.example/dns-query?bootstrap=9.9.9.9&bootstrap=8.8.8.8", Options{Bootstrap: []string{"1.1.1.1"}})
+	assert.Nil(t, err)
+	assert.Equal(t, "https://dns.example:443/dns-query", u.Address())
+	boot = u.(*dnsOverHTTPS).boot
+	assert.Equal(t, 2, len(boot.resolvers))
+	assert.Equal(t, "9.9.9.9", boot.resolvers[0].resolverAddress)
+	assert.Equal(t, "8.8.8.8", boot.resolvers[1].resolverAddress)
+
+	// The DoH endpoint's own query parameters are specified with the url- prefix
+	u, err = AddressToUpstream("https://dns.example/dns-query?url-token=a%2Fb&timeout=2s&url-id=1", Options{Bootstrap: []string{"1.1.1.1"}})
+	assert.Nil(t, err)
+	assert.Equal(t, "https://dns.example:443/dns-query?token=a%2Fb&id=1", u.Address())
+	assert.Equal(t, 2*time.Second, u.(*dnsOverHTTPS).boot.timeout)
+
+	u, err = AddressToUpstream("8.8.8.8?timeout=500ms", Options{Timeout: timeout})
+	assert.Nil(t, err)
+	assert.Equal(t, "8.8.8.8:53", u.Address())
+	assert.Equal(t, 500*time.Millisecond, u.(*plainDNS).timeout)
+
+	invalid := []string{
+		"tls://dns.example?ip=dns.example",
+		"tls://dns.example?timeout=2",
+		"tls://dns.example?insecure=maybe",
+		"tls://dns.example?ip=1.2.3.4&foo=bar",
+		"8.8.8.8?foo=bar",
+		"https://dns.example/dns-query?timout=2s",
+		"tls://dns.example?url-token=abc",
+	}
+	for _, address := range invalid {
+		_, err = AddressToUpstream(address, Options{})
+		assert.NotNil(t, err, address)
+	}
+	_, err = AddressToUpstream("tls://dns.example?foo=bar", Options{})
+	assert.Contains(t, err.Error(), `unknown option "foo"`)
+}
+
+func TestUpstreamDOHQueryParams(t *testing.T) {
+	var token string
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token = r.URL.Query().Get("token")
+		buf, err := base64.RawURLEncoding.DecodeString(r.URL.Query().Get("dns"))
+		req := &dns.Msg{}
+		if err != nil || req.Unpack(buf) != nil {
+			http.Error(w, "invalid query", http.StatusBadRequest)
+			return
+		}
+		resp, _ := pipelineTestReply(req).Pack()
+		w.Header().Set("Content-Type", "application/dns-message")
+		_, _ = w.Write(resp)
+	}))
+	tlsConfig, roots := createServerTLSConfig(t)
+	srv.TLS = tlsConfig
+	srv.EnableHTTP2 = true
+	srv.StartTLS()
+	defer srv.Close()
+
+	oldRootCAs := RootCAs
+	RootCAs = roots
+	defer func() { RootCAs = oldRootCAs }()
+
+	_, port, _ := net.SplitHostPort(srv.Listener.Addr().String())
+	address := fmt.Sprintf("https://%s:%s/dns-query?url-token=secret&ip=127.0.0.1", tlsServerName, port)
+	u, err := AddressToUpstream(address, Options{Timeout: timeout})
+	assert.Nil(t, err)
+	reply, err := u.Exchange(createTestMessage())
+	assert.Nil(t, err)
+	assert.NotNil(t, reply)
+	assert.Equal(t, "secret", token)
+}
+
+func TestUpstreamOptionsSNI(t *testing.T) {
+	srv := startTestQUICServer(t, false)
+	defer srv.close()
+
+	// The certificate is issued for tlsServerName and the resolver IP is pinned
+	address := "quic://" + net.JoinHostPort("dns.example", srv.port())
+	u, err := AddressToUpstream(address+"?ip=127.0.0.1&sni="+tlsServerName, Options{Timeout: timeout})
+	assert.Nil(t, err)
+	checkUpstream(t, u, address)
+
+	// The certificate doesn't match the host name
+	u, err = AddressToUpstream(address+"?ip=127.0.0.1", Options{Timeout: timeout})
+	assert.Nil(t, err)
+	_, err = u.Exchange(createTestMessage())
+	assert.NotNil(t, err)
+
+	// The certificate isn't verified
+	u, err = AddressToUpstream(address+"?ip=127.0.0.1&insecure=true", Options{Timeout: timeout})
+	assert.Nil(t, err)
+	checkUpstream(t, u, address)
+}
+
+func TestUpstreamPinning(t *testing.T) {
+	srv := startTestQUICServer(t, false)
+	defer srv.close()
+
+	spki := sha256.Sum256(srv.cert.RawSubjectPublicKeyInfo)
+	tbs := sha256.Sum256(srv.cert.RawTBSCertificate)
+	wrong := sha256.Sum256([]byte("wrong"))
+	address := "quic://" + net.JoinHostPort(tlsServerName, srv.port())
+
+	// The pin is specified in the address
+	u, err := AddressToUpstream(address+"?pin="+url.QueryEscape(base64.StdEncoding.EncodeToString(spki[:])), Options{Timeout: timeout, ServerIP: net.IPv4(127, 0, 0, 1)})
+	assert.Nil(t, err)
+	checkUpstream(t, u, address)
+
+	// One of the pins matches the TBS certificate hash like in the DNS stamps
+	opts := Options{Timeout: timeout, ServerIP: net.IPv4(127, 0, 0, 1), Pins: [][]byte{wrong[:], tbs[:]}}
+	u, err = AddressToUpstream(address, opts)
+	assert.Nil(t, err)
+	checkUpstream(t, u, address)
+
+	// The pin doesn't match, the error names the server's key
+	u, err = AddressToUpstream(address+"?pin="+hex.EncodeToString(wrong[:]), Options{Timeout: timeout, ServerIP: net.IPv4(127, 0, 0, 1)})
+	assert.Nil(t, err)
+	_, err = u.Exchange(createTestMessage())
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), "certificate pin mismatch")
+	assert.Contains(t, err.Error(), base64.StdEncoding.EncodeToString(spki[:]))
+
+	_, err = AddressToUpstream(address+"?pin=abcd", Options{})
+	assert.NotNil(t, err)
+}
+
+func TestUpstreamPinningExtraCert(t *testing.T) {
+	// The server's own certificate is trusted, but it's not the pinned one.
+	// The pinned certificate is public, so the server appends it to the chain.
+	tlsConfig, roots := createServerTLSConfig(t)
+	pinnedConfig, _ := createServerTLSConfig(t)
+	pinned, err := x509.ParseCertificate(pinnedConfig.Certificates[0].Certificate[0])
+	if err != nil {
+		t.Fatalf("failed to parse certificate: %s", err)
+	}
+	leaf, err := x509.ParseCertificate(tlsConfig.Certificates[0].Certificate[0])
+	if err != nil {
+		t.Fatalf("failed to parse certificate: %s", err)
+	}
+	tlsConfig.Certificates[0].Certificate = append(tlsConfig.Certificates[0].Certificate, pinned.Raw)
+
+	l, err := tls.Listen("tcp", "127.0.0.1:0", tlsConfig)
+	if err != nil {
+		t.Fatalf("cannot listen: %s", err)
+	}
+	srv := &dns.Server{Listener: l, Handler: dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+		_ = w.WriteMsg(pipelineTestReply(req))
+	})}
+	go func() { _ = srv.ActivateAndServe() }()
+	defer func() { _ = srv.Shutdown() }()
+
+	oldRootCAs := RootCAs
+	RootCAs = roots
+	defer func() { RootCAs = oldRootCAs }()
+
+	_, port, _ := net.SplitHostPort(l.Addr().String())
+	address := "tls://" + net.JoinHostPort(tlsServerName, port)
+	pinnedSPKI := sha256.Sum256(pinned.RawSubjectPublicKeyInfo)
+	leafSPKI := sha256.Sum256(leaf.RawSubjectPublicKeyInfo)
+
+	for _, insecure := range []bool{false, true} {
+		opts := Options{Timeout: timeout, ServerIP: net.IPv4(127, 0, 0, 1), InsecureSkipVerify: insecure}
+
+		opts.Pins = [][]byte{pinnedSPKI[:]}
+		u, err := AddressToUpstream(address, opts)
+		assert.Nil(t, err)
+		_, err = u.Exchange(createTestMessage())
+		if assert.NotNil(t, err, "insecure: %t", insecure) {
+			assert.Contains(t, err.Error(), "certificate pin mismatch")
+		}
+
+		opts.Pins = [][]byte{leafSPKI[:]}
+		u, err = AddressToUpstream(address, opts)
+		assert.Nil(t, err)
+		_, err = u.Exchange(createTestMessage())
+		assert.Nil(t, err, "insecure: %t", insecure)
+	}
+}
+
+func TestUpstreamStampPins(t *testing.T) {
+	hash := sha256.Sum256([]byte("cert"))
+	stamp := dnsstamps.ServerStamp{
+		Proto:         dnsstamps.StampProtoTypeTLS,
+		ServerAddrStr: "1.1.1.1",
+		ProviderName:  "one.one.one.one",
+		Hashes:        [][]byte{hash[:]},
+	}
+
+	u, err := AddressToUpstream(stamp.String(), Options{})
+	assert.Nil(t, err)
+	boot := u.(*dnsOverTLS).boot
+	assert.Equal(t, [][]byte{hash[:]}, boot.pins)
+	assert.NotNil(t, boot.resolvedConfig.VerifyPeerCertificate)
 }
 
 func TestUpstreamDOTBootstrap(t *testing.T) {